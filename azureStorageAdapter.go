@@ -5,13 +5,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net/url"
+	"path"
 	"strings"
-	"time"
 
 	"github.com/Azure/azure-storage-blob-go/2016-05-31/azblob"
-	goavro "gopkg.in/linkedin/goavro.v2"
+	goavro "github.com/linkedin/goavro/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type AzureStorageAdapter struct {
@@ -21,108 +23,231 @@ type AzureStorageAdapter struct {
 
 	Codec           *goavro.Codec
 	PartitionColumn string
+	PartitionSpec   *PartitionSpec // partitioning used by the BlockManager, defaults to identity on PartitionColumn
 	KeyColumn       string
+	IdentityColumns []string // rows sharing these column values are returned once by Query
 	CompressionName string
+	IcebergMetadata bool // maintain Iceberg table metadata under metadata/ in the container
 
-	Input chan *Block
+	Input          chan *Block
+	Retry          *RetryPolicy         // defaults to 5 attempts backing off from 1s, with no dead letter directory
+	Errors         chan error           // reports blocks that could not be written; must be read if set
+	Metrics        Metrics              // defaults to recording nothing
+	Logger         Logger               // defaults to slog.Default()
+	TracerProvider trace.TracerProvider // defaults to the global provider
 
+	table        *icebergTable
+	rewrites     partitionLocks // serializes ReplaceBlocks per partition
 	containerURL azblob.ContainerURL
-	context      context.Context
-	running      bool
+	done         chan struct{}
 }
 
-func (asa *AzureStorageAdapter) uploadBlock(block *Block) (err error) {
-	log.Printf("Uploading block PartitionKey: %s StartingKey: %d EndingKey: %d with %d rows\n", block.PartitionKey, block.StartingKey, block.EndingKey, len(block.Rows))
+func (asa *AzureStorageAdapter) logger() Logger {
+	return LoggerOrDefault(asa.Logger)
+}
+
+func (asa *AzureStorageAdapter) metrics() metricsScope {
+	return metricsScope{metrics: asa.Metrics, labels: MetricLabels{"adapter": "azure"}}
+}
+
+func (asa *AzureStorageAdapter) tracer() trace.Tracer {
+	return tracerFrom(asa.TracerProvider)
+}
+
+func (asa *AzureStorageAdapter) uploadBlock(ctx context.Context, block *Block) (err error) {
+	_, span := asa.tracer().Start(block.traceContext(ctx), "AzureStorageAdapter.uploadBlock", blockSpanAttributes(block))
+	defer func() { endSpan(span, err) }()
+
+	blobFilePath, blobSize, err := asa.writeBlockObject(ctx, block)
+
+	if err == nil {
+		asa.metrics().addCounter(MetricBytesWritten, float64(blobSize))
+		span.SetAttributes(attribute.String(attributeBlock, path.Base(blobFilePath)), attribute.Int64(attributeBytes, blobSize))
+	}
+
+	if err == nil && asa.table != nil {
+		err = asa.table.appendBlock(ctx, block, blobFilePath, blobSize)
+	}
+
+	return err
+}
+
+// writeBlockObject uploads a block and its statistics, returning the block's
+// blob path and size.
+func (asa *AzureStorageAdapter) writeBlockObject(ctx context.Context, block *Block) (blobFilePath string, blobSize int64, err error) {
+	asa.logger().Debug("Uploading block", blockLogArgs(block)...)
 
 	avroBuffer := new(bytes.Buffer)
 
-	ocfWriter, err := goavro.NewOCFWriter(goavro.OCFConfig{
-		W:               avroBuffer,
-		CompressionName: asa.CompressionName,
-		Schema:          asa.Codec.Schema(),
-	})
+	if err = writeBlockOCF(avroBuffer, block, asa.Codec, asa.CompressionName); err != nil {
+		return "", 0, err
+	}
+
+	blobFilePath = blockObjectPath(block.PartitionKey, block.KeyColumn, block.GetFilename())
+	blobURL := asa.containerURL.NewBlockBlobURL(blobFilePath)
+
+	avroBytes := avroBuffer.Bytes()
+
+	_, err = azblob.UploadBufferToBlockBlob(ctx, avroBytes, blobURL, azblob.UploadToBlockBlobOptions{
+		BlockSize:   4 * 1024 * 1024,
+		Parallelism: 16})
+
+	if err == nil {
+		err = asa.uploadStatistics(ctx, block, blobFilePath)
+	}
+
+	if err == nil {
+		asa.logger().Info("Uploaded block", append(blockLogArgs(block), "block", path.Base(blobFilePath))...)
+	}
+
+	return blobFilePath, int64(len(avroBytes)), err
+}
+
+func (asa *AzureStorageAdapter) uploadStatistics(ctx context.Context, block *Block, blobFilePath string) (err error) {
+	if block.Statistics == nil {
+		return nil
+	}
 
+	statisticsBytes, err := block.Statistics.Marshal()
 	if err != nil {
 		return err
 	}
 
-	if err = ocfWriter.Append(block.Rows); err != nil {
-		return err
+	return asa.writeObject(ctx, statisticsFilename(blobFilePath), statisticsBytes)
+}
+
+func (asa *AzureStorageAdapter) readObject(ctx context.Context, objectPath string) (data []byte, err error) {
+	blobURL := asa.containerURL.NewBlockBlobURL(objectPath)
+
+	stream := azblob.NewDownloadStream(ctx, blobURL.GetBlob, azblob.DownloadStreamOptions{})
+	defer stream.Close()
+
+	data, err = ioutil.ReadAll(stream)
+	if storageError, ok := err.(azblob.StorageError); ok && storageError.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+		return nil, errObjectNotFound
 	}
 
-	blobPath := asa.buildBlobPath(block.PartitionKey, block.KeyColumn)
-	blobFilePath := fmt.Sprintf("%s/%s", blobPath, block.GetFilename())
-	blobURL := asa.containerURL.NewBlockBlobURL(blobFilePath)
+	return data, err
+}
 
-	avroBytes := avroBuffer.Bytes()
+func (asa *AzureStorageAdapter) writeObject(ctx context.Context, objectPath string, data []byte) (err error) {
+	blobURL := asa.containerURL.NewBlockBlobURL(objectPath)
 
-	_, err = azblob.UploadBufferToBlockBlob(asa.context, avroBytes, blobURL, azblob.UploadToBlockBlobOptions{
+	_, err = azblob.UploadBufferToBlockBlob(ctx, data, blobURL, azblob.UploadToBlockBlobOptions{
 		BlockSize:   4 * 1024 * 1024,
 		Parallelism: 16})
 
-	log.Printf("Uploading block PartitionKey: %s StartingKey: %d EndingKey: %d finished\n", block.PartitionKey, block.StartingKey, block.EndingKey)
 	return err
 }
 
+func (asa *AzureStorageAdapter) deleteObject(ctx context.Context, objectPath string) (err error) {
+	blobURL := asa.containerURL.NewBlobURL(objectPath)
+
+	_, err = blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	if storageError, ok := err.(azblob.StorageError); ok && storageError.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+		return errObjectNotFound
+	}
+
+	return err
+}
+
+func (asa *AzureStorageAdapter) objectURI(objectPath string) string {
+	return fmt.Sprintf("wasbs://%s@%s.blob.core.windows.net/%s", asa.Container, asa.StorageAccount, objectPath)
+}
+
 func (asa *AzureStorageAdapter) buildBlobPath(partitionKey string, keyColumn string) string {
 	return fmt.Sprintf("%s/%s", partitionKey, keyColumn)
 }
 
-func (asa *AzureStorageAdapter) processBlocks() {
+func (asa *AzureStorageAdapter) processBlocks(ctx context.Context, done chan struct{}) {
 	go func() {
+		defer close(done)
+
 		for {
-			block, more := <-asa.Input
+			var block *Block
+			var more bool
+
+			select {
+			case block, more = <-asa.Input:
+			case <-ctx.Done():
+				asa.logger().Info("AzureStorageAdapter stopped taking blocks", "error", ctx.Err())
+				return
+			}
 
 			if !more {
-				log.Printf("Input has closed, emitting adapter finished\n")
-				asa.running = false
-				break
+				return
 			}
 
-			if err := asa.uploadBlock(block); err != nil {
-				log.Printf("Uploading block failed PartitionKey: %s StartingKey: %d EndingKey: %d with %s. Retrying.\n", block.PartitionKey, block.StartingKey, block.EndingKey, err)
-
-				asa.Input <- block
+			if err := asa.Retry.writeBlock(ctx, block, asa.uploadBlock, asa.metrics(), asa.logger()); err != nil {
+				reportStorageError(ctx, asa.logger(), asa.Errors, err)
 			}
 		}
 	}()
 }
 
-func (asa *AzureStorageAdapter) Load(partitionKey string, blockFilename string, blocks chan *Block, errors chan error) {
+func (asa *AzureStorageAdapter) Load(ctx context.Context, partitionKey string, blockFilename string, blocks chan *Block, errors chan error) {
+	ctx, span := startLoadSpan(ctx, asa.tracer(), "AzureStorageAdapter.Load", partitionKey, blockFilename)
+
+	if err := ctx.Err(); err != nil {
+		endSpan(span, err)
+		errors <- err
+		return
+	}
+
 	blobPath := asa.buildBlobPath(partitionKey, asa.KeyColumn)
 	blobFilePath := fmt.Sprintf("%s/%s", blobPath, blockFilename)
 	blobURL := asa.containerURL.NewBlockBlobURL(blobFilePath)
 
-	stream := azblob.NewDownloadStream(asa.context, blobURL.GetBlob, azblob.DownloadStreamOptions{})
+	stream := azblob.NewDownloadStream(ctx, blobURL.GetBlob, azblob.DownloadStreamOptions{})
+	defer stream.Close()
 
-	block := &Block{
-		Codec:        asa.Codec,
-		Rows:         []interface{}{},
-		PartitionKey: partitionKey,
-		KeyColumn:    asa.KeyColumn,
-	}
+	block := newLoadedBlock(partitionKey, asa.KeyColumn, blockFilename, asa.Codec, asa.Logger)
 
 	rows := make(chan interface{})
-	ReadOCFIntoChannel(stream, rows, errors)
+	readErrors := make(chan error, 1)
+	ReadOCFIntoChannel(stream, rows, readErrors, asa.logger())
 
 	for {
 		row, more := <-rows
 		if !more {
 			break
 		}
-		block.Write(row)
+		block.Rows = append(block.Rows, row)
+	}
+
+	select {
+	case err := <-readErrors:
+		endSpan(span, err)
+		errors <- err
+		return
+	default:
 	}
 
+	span.SetAttributes(attribute.Int(attributeRows, len(block.Rows)))
+	span.End()
+
 	blocks <- block
 }
 
-func (asa *AzureStorageAdapter) GetPartitionFileNames(partitionKey string) (partitionFileNames []string, err error) {
+func (asa *AzureStorageAdapter) LoadStatistics(ctx context.Context, partitionKey string, blockFilename string) (statistics *BlockStatistics, err error) {
+	blobPath := asa.buildBlobPath(partitionKey, asa.KeyColumn)
+	blobFilePath := fmt.Sprintf("%s/%s", blobPath, statisticsFilename(blockFilename))
+
+	statisticsBytes, err := asa.readObject(ctx, blobFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return UnmarshalBlockStatistics(statisticsBytes, asa.Codec)
+}
+
+func (asa *AzureStorageAdapter) GetPartitionFileNames(ctx context.Context, partitionKey string) (partitionFileNames []string, err error) {
 	partitionFileNames = []string{}
-	partitionPath := asa.buildBlobPath(partitionKey, asa.KeyColumn)
+	partitionPath := asa.buildBlobPath(partitionKey, asa.KeyColumn) + "/"
 
 	for marker := (azblob.Marker{}); marker.NotDone(); {
 		// Get a result segment starting with the blob indicated by the current Marker.
-		listBlob, err := asa.containerURL.ListBlobs(asa.context, marker, azblob.ListBlobsOptions{
+		listBlob, err := asa.containerURL.ListBlobs(ctx, marker, azblob.ListBlobsOptions{
 			Prefix: partitionPath,
 		})
 
@@ -136,9 +261,10 @@ func (asa *AzureStorageAdapter) GetPartitionFileNames(partitionKey string) (part
 
 		// Process the blobs returned in this result segment (if the segment is empty, the loop body won't execute)
 		for _, blobInfo := range listBlob.Blobs.Blob {
-			nameParts := strings.Split(blobInfo.Name, "/")
-			if len(nameParts) == 3 {
-				partitionFileNames = append(partitionFileNames, nameParts[2])
+			// partition keys may span several path segments, so take the name after the prefix
+			blockFilename := strings.TrimPrefix(blobInfo.Name, partitionPath)
+			if !strings.Contains(blockFilename, "/") && isBlockFilename(blockFilename) {
+				partitionFileNames = append(partitionFileNames, blockFilename)
 			}
 		}
 	}
@@ -146,32 +272,102 @@ func (asa *AzureStorageAdapter) GetPartitionFileNames(partitionKey string) (part
 	return partitionFileNames, nil
 }
 
-func (asa *AzureStorageAdapter) Query(partitionKey string, startKey interface{}, endKey interface{}) (results []interface{}, err error) {
-	partitionFileNames, err := asa.GetPartitionFileNames(partitionKey)
-	intersectingPartitionFilenames := IntersectingBlockFilenames(partitionFileNames, startKey, endKey)
+// ListPartitions returns the partition keys in the container that start with
+// prefix, found from the paths of their block blobs.
+func (asa *AzureStorageAdapter) ListPartitions(ctx context.Context, prefix string) (partitionKeys []string, err error) {
+	partitionKeys = []string{}
+	seen := make(map[string]bool)
+	keyColumnSegment := "/" + asa.KeyColumn + "/"
 
-	blocks := make(chan *Block)
-	errors := make(chan error)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listBlob, err := asa.containerURL.ListBlobs(ctx, marker, azblob.ListBlobsOptions{
+			Prefix: prefix,
+		})
 
-	results = make([]interface{}, 0)
-	for _, intersectingPartitionFilename := range intersectingPartitionFilenames {
-		go asa.Load(partitionKey, intersectingPartitionFilename, blocks, errors)
-	}
+		if err != nil {
+			return nil, err
+		}
 
-	for i := 0; i < len(intersectingPartitionFilenames); i++ {
-		select {
-		case block := <-blocks:
-			filteredRows := block.RowsForKeyRange(startKey, endKey)
-			results = append(results, filteredRows)
-		case err = <-errors:
-			return results, err
+		marker = listBlob.NextMarker
+
+		for _, blobInfo := range listBlob.Blobs.Blob {
+			keyColumnIndex := strings.LastIndex(blobInfo.Name, keyColumnSegment)
+			if keyColumnIndex <= 0 || !isBlockFilename(blobInfo.Name[keyColumnIndex+len(keyColumnSegment):]) {
+				continue
+			}
+
+			partitionKey := blobInfo.Name[:keyColumnIndex]
+			if !seen[partitionKey] {
+				seen[partitionKey] = true
+				partitionKeys = append(partitionKeys, partitionKey)
+			}
 		}
 	}
 
-	return
+	return partitionKeys, nil
+}
+
+func (asa *AzureStorageAdapter) lockPartition(partitionKey string) (unlock func()) {
+	return asa.rewrites.lock(partitionKey)
+}
+
+func (asa *AzureStorageAdapter) ReplaceBlocks(ctx context.Context, partitionKey string, added []*Block, removedFilenames []string) (err error) {
+	return replaceBlocks(ctx, asa, asa.table, asa.KeyColumn, partitionKey, added, removedFilenames)
 }
 
-func (asa *AzureStorageAdapter) Start() (err error) {
+func (asa *AzureStorageAdapter) Query(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}) (results []interface{}, err error) {
+	return asa.QueryWithOptions(ctx, partitionKey, startKey, endKey, nil)
+}
+
+func (asa *AzureStorageAdapter) QueryWithOptions(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, options *QueryOptions) (results []interface{}, err error) {
+	iter, err := asa.QueryIter(ctx, partitionKey, startKey, endKey, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return collectRows(iter)
+}
+
+func (asa *AzureStorageAdapter) QueryIter(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error) {
+	return asa.QueryPartitionsIter(ctx, []string{partitionKey}, startKey, endKey, options)
+}
+
+func (asa *AzureStorageAdapter) QueryPartitionsIter(ctx context.Context, partitionKeys []string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error) {
+	ctx, span := startQuerySpan(ctx, asa.tracer(), "AzureStorageAdapter.Query", partitionKeys)
+
+	startKey, endKey, err = normalizeKeyRange(asa.Codec, asa.KeyColumn, startKey, endKey)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	return newBlockRowIterator(ctx, asa, partitionKeys, startKey, endKey, options, asa.IdentityColumns, asa.metrics(), span)
+}
+
+func (asa *AzureStorageAdapter) QueryPrefixIter(ctx context.Context, prefix string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error) {
+	partitionKeys, err := asa.ListPartitions(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return asa.QueryPartitionsIter(ctx, partitionKeys, startKey, endKey, options)
+}
+
+func (asa *AzureStorageAdapter) Delete(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, predicates []Predicate) (removed int64, err error) {
+	startKey, endKey, err = normalizeKeyRange(asa.Codec, asa.KeyColumn, startKey, endKey)
+	if err != nil {
+		return 0, err
+	}
+
+	return deleteRows(ctx, asa, asa.logger(), asa.KeyColumn, partitionKey, startKey, endKey, predicates)
+}
+
+func (asa *AzureStorageAdapter) SetInput(input chan *Block, errors chan error) {
+	asa.Input = input
+	asa.Errors = errors
+}
+
+func (asa *AzureStorageAdapter) Start(ctx context.Context) (err error) {
 	if len(asa.StorageAccount) == 0 {
 		return errors.New("AzureStorageAdapter not correctly configured with StorageAccount")
 	}
@@ -195,25 +391,33 @@ func (asa *AzureStorageAdapter) Start() (err error) {
 	}
 
 	asa.containerURL = azblob.NewContainerURL(*URL, pipeline)
-	asa.context = context.Background()
+	asa.containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
 
-	asa.containerURL.Create(asa.context, azblob.Metadata{}, azblob.PublicAccessNone)
+	if asa.IcebergMetadata {
+		if asa.table, err = newIcebergTable(ctx, asa, asa.Codec, resolvePartitionSpec(asa.PartitionSpec, asa.PartitionColumn)); err != nil {
+			return err
+		}
+	}
 
-	asa.processBlocks()
-	asa.running = true
+	done := make(chan struct{})
+	asa.done = done
+	asa.processBlocks(ctx, done)
 
 	return nil
 }
 
-func (asa *AzureStorageAdapter) Stop() (err error) {
-	log.Println("AzureStorageAdapter stopping")
+// Done is closed once the adapter has stopped taking blocks from Input.
+func (asa *AzureStorageAdapter) Done() <-chan struct{} {
+	return asa.done
+}
+
+func (asa *AzureStorageAdapter) Stop(ctx context.Context) (err error) {
+	asa.logger().Info("AzureStorageAdapter stopping")
 
-	// wait for completion
-	ttl := 100
-	for asa.running && ttl > 0 {
-		ttl--
-		log.Printf("AzureStorageAdapter waiting for finish: ttl: %d\n", ttl)
-		time.Sleep(200 * time.Millisecond)
+	select {
+	case <-asa.Done():
+	case <-ctx.Done():
+		return fmt.Errorf("AzureStorageAdapter: input did not finish: %w", ctx.Err())
 	}
 
 	if len(asa.Input) > 0 {
@@ -221,7 +425,7 @@ func (asa *AzureStorageAdapter) Stop() (err error) {
 		return errors.New(errorText)
 	}
 
-	log.Printf("AzureStorageAdapter stopped\n")
+	asa.logger().Info("AzureStorageAdapter stopped")
 
 	return nil
 }
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"log"
 	"os"
 	"testing"
@@ -26,7 +27,7 @@ func TestAzureStorageAdapterWrite(t *testing.T) {
 		Input: input,
 	}
 
-	if err := azureStorageAdapter.Start(); err != nil {
+	if err := azureStorageAdapter.Start(context.Background()); err != nil {
 		t.Errorf("AzureStorageAdapter failed to start: %s", err)
 	}
 
@@ -38,7 +39,7 @@ func TestAzureStorageAdapterWrite(t *testing.T) {
 	input <- block
 	close(input)
 
-	if err := azureStorageAdapter.Stop(); err != nil {
+	if err := azureStorageAdapter.Stop(context.Background()); err != nil {
 		t.Errorf("AzureStorageAdapter failed to stop: %s", err)
 	}
 
@@ -67,12 +68,12 @@ func TestAzureStorageAdapterQuery(t *testing.T) {
 		Input: input,
 	}
 
-	err := azureStorageAdapter.Start()
+	err := azureStorageAdapter.Start(context.Background())
 	if err != nil {
 		t.Errorf("AzureStorageAdapter failed to start: %s", err)
 	}
 
-	results, err := azureStorageAdapter.Query(fixtureMap["user_id"].(string), beforeTimestamp, afterTimestamp)
+	results, err := azureStorageAdapter.Query(context.Background(), fixtureMap["user_id"].(string), beforeTimestamp, afterTimestamp)
 
 	if err != nil {
 		t.Errorf("AzureStorageAdapter query failed with error: %s", err)
@@ -5,12 +5,12 @@ import (
 	"encoding/base32"
 	"errors"
 	"fmt"
-	"log"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	goavro "gopkg.in/linkedin/goavro.v2"
+	goavro "github.com/linkedin/goavro/v2"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Block struct {
@@ -21,6 +21,20 @@ type Block struct {
 	KeyColumn    string
 	StartingKey  interface{}
 	EndingKey    interface{}
+	Statistics   *BlockStatistics
+
+	// IdentityColumns identify rows describing the same event, eg. user_id and
+	// timestamp; Write drops a row whose identity the block already holds.
+	IdentityColumns []string
+
+	Logger Logger // defaults to slog.Default()
+
+	identities        map[string]bool
+	wal               *blockWAL
+	durableCallbacks  []func()
+	durableMutex      sync.Mutex
+	sourceLinks       []trace.Link      // spans the block's rows arrived in
+	commitSpanContext trace.SpanContext // of the span that committed the block
 }
 
 func NewBlock(partitionKey string, keyColumn string, codec *goavro.Codec) (block *Block) {
@@ -30,43 +44,79 @@ func NewBlock(partitionKey string, keyColumn string, codec *goavro.Codec) (block
 		PartitionKey: partitionKey,
 		KeyColumn:    keyColumn,
 		Rows:         []interface{}{},
+		Statistics:   NewBlockStatistics(),
 	}
 }
 
-func (b *Block) updateInt64KeyRange(keyValue int64) {
-	if b.StartingKey == nil || b.StartingKey.(int64) > keyValue {
-		b.StartingKey = keyValue
+// newLoadedBlock returns an empty block for the rows of a stored block, with
+// the key range its filename records. Loaders append rows to it directly, as
+// the statistics, key range and identities Write maintains were settled when
+// the block was written.
+func newLoadedBlock(partitionKey string, keyColumn string, blockFilename string, codec *goavro.Codec, logger Logger) (block *Block) {
+	block = &Block{
+		Codec:        codec,
+		Rows:         []interface{}{},
+		PartitionKey: partitionKey,
+		KeyColumn:    keyColumn,
+		Logger:       logger,
 	}
 
-	if b.EndingKey == nil || b.EndingKey.(int64) > keyValue {
-		b.EndingKey = keyValue
+	if keyType, err := KeyTypeFromCodec(codec, keyColumn); err == nil {
+		block.StartingKey, block.EndingKey, _ = parseBlockFilenameKeyRange(blockFilename, keyType.template())
 	}
+
+	return block
+}
+
+// keyType derives the key type from the codec schema, falling back to the
+// type of the key value for blocks without a codec.
+func (b *Block) keyType(key interface{}) KeyType {
+	if b.Codec != nil {
+		if keyType, err := KeyTypeFromCodec(b.Codec, b.KeyColumn); err == nil {
+			return keyType
+		}
+	}
+
+	return keyTypeOf(key)
+}
+
+// rowKey returns the row's key normalized for comparison.
+func (b *Block) rowKey(row interface{}) (key interface{}, err error) {
+	rowMap, ok := row.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("rowKey: row is not a record: %T", row)
+	}
+
+	rawKey := unwrapUnion(rowMap[b.KeyColumn])
+
+	return b.keyType(rawKey).Normalize(rawKey)
 }
 
 func (b *Block) updateKeyRange(row interface{}) (err error) {
-	rowMap := row.(map[string]interface{})
+	key, err := b.rowKey(row)
+	if err != nil {
+		return err
+	}
+
+	if b.StartingKey == nil || compareKeys(key, b.StartingKey) < 0 {
+		b.StartingKey = key
+	}
 
-	switch t := rowMap[b.KeyColumn].(type) {
-	case int64:
-		b.updateInt64KeyRange(rowMap[b.KeyColumn].(int64))
-	default:
-		errorText := fmt.Sprintf("updateKeyRange: unsupported type %T", t)
-		return errors.New(errorText)
+	if b.EndingKey == nil || compareKeys(key, b.EndingKey) > 0 {
+		b.EndingKey = key
 	}
 
 	return nil
 }
 
-func base32Encode(key interface{}) string {
-	var s string
+func (b *Block) logger() Logger {
+	return LoggerOrDefault(b.Logger)
+}
 
-	switch t := key.(type) {
-	case string:
-		s = key.(string)
-	case int64:
-		s = strconv.FormatInt(key.(int64), 10)
-	default:
-		log.Printf("block: type %T not supported", t)
+func (b *Block) base32Encode(key interface{}) string {
+	s, err := encodeKey(key)
+	if err != nil {
+		b.logger().Warn("Encoding block key failed", "partition_key", b.PartitionKey, "key", key, "error", err)
 		return ""
 	}
 
@@ -74,19 +124,72 @@ func base32Encode(key interface{}) string {
 }
 
 func (b *Block) GetStartingKeyAsBase32() string {
-	return base32Encode(b.StartingKey)
+	return b.base32Encode(b.StartingKey)
 }
 
 func (b *Block) GetEndingKeyAsBase32() string {
-	return base32Encode(b.EndingKey)
+	return b.base32Encode(b.EndingKey)
 }
 
 func (b *Block) Write(row interface{}) {
-	b.updateKeyRange(row)
+	if b.isDuplicate(row) {
+		return
+	}
+
+	if err := b.updateKeyRange(row); err != nil {
+		b.logger().Warn("Updating block key range failed", "partition_key", b.PartitionKey, "error", err)
+	}
+
+	if b.Statistics == nil {
+		b.Statistics = NewBlockStatistics()
+	}
+	b.Statistics.Update(row)
 
 	b.Rows = append(b.Rows, row)
 }
 
+func (b *Block) isDuplicate(row interface{}) bool {
+	if len(b.IdentityColumns) == 0 {
+		return false
+	}
+
+	identity, ok := rowIdentity(row, b.IdentityColumns)
+	if !ok {
+		return false
+	}
+
+	if b.identities == nil {
+		b.identities = make(map[string]bool)
+	}
+
+	if b.identities[identity] {
+		return true
+	}
+
+	b.identities[identity] = true
+	return false
+}
+
+// OnDurable registers a callback to run once a storage adapter has durably
+// written the block.
+func (b *Block) OnDurable(callback func()) {
+	b.durableMutex.Lock()
+	b.durableCallbacks = append(b.durableCallbacks, callback)
+	b.durableMutex.Unlock()
+}
+
+// MarkDurable is called by storage adapters after the block has been written.
+func (b *Block) MarkDurable() {
+	b.durableMutex.Lock()
+	callbacks := b.durableCallbacks
+	b.durableCallbacks = nil
+	b.durableMutex.Unlock()
+
+	for _, callback := range callbacks {
+		callback()
+	}
+}
+
 func (b *Block) Length() int {
 	return len(b.Rows)
 }
@@ -97,7 +200,7 @@ func (b *Block) GetHashForRows() (blockBinary []byte) {
 	for _, row := range b.Rows {
 		rowBinary, err := b.Codec.BinaryFromNative(nil, row)
 		if err != nil {
-			fmt.Printf("GetRowsAsBinary: %s\n", err)
+			b.logger().Warn("Encoding row for block hash failed", "partition_key", b.PartitionKey, "error", err)
 		}
 
 		h.Write(rowBinary)
@@ -117,22 +220,31 @@ func (b *Block) GetFilename() string {
 func (b *Block) RowsForKeyRange(startKey interface{}, endKey interface{}) (rowsInRange []interface{}) {
 	rowsInRange = make([]interface{}, 0)
 
+	if len(b.Rows) == 0 {
+		return
+	}
+
+	keyType := b.keyType(unwrapUnion(b.Rows[0].(map[string]interface{})[b.KeyColumn]))
+
+	startKey, err := keyType.Normalize(startKey)
+	if err != nil {
+		b.logger().Warn("Normalizing query key range failed", "partition_key", b.PartitionKey, "error", err)
+		return
+	}
+
+	endKey, err = keyType.Normalize(endKey)
+	if err != nil {
+		b.logger().Warn("Normalizing query key range failed", "partition_key", b.PartitionKey, "error", err)
+		return
+	}
+
 	for _, row := range b.Rows {
-		rowMap := row.(map[string]interface{})
-		key := rowMap[b.KeyColumn]
-
-		var intersects bool
-		switch t := key.(type) {
-		case int64:
-			intersects = (key.(int64) >= startKey.(int64) && key.(int64) <= endKey.(int64))
-		case string:
-			intersects = (key.(string) >= startKey.(string) && key.(string) <= endKey.(string))
-		default:
-			fmt.Printf("blockFilenameIntersectsKeyRange: Type %T not yet supported", t)
-			intersects = false
+		key, err := b.rowKey(row)
+		if err != nil {
+			continue
 		}
 
-		if intersects {
+		if compareKeys(key, startKey) >= 0 && compareKeys(key, endKey) <= 0 {
 			rowsInRange = append(rowsInRange, row)
 		}
 	}
@@ -140,50 +252,64 @@ func (b *Block) RowsForKeyRange(startKey interface{}, endKey interface{}) (rowsI
 	return
 }
 
-func filenameIntersectsKeyRange(blockFilename string, startKey interface{}, endKey interface{}) (intersects bool) {
+func parseBlockFilenameKeyRange(blockFilename string, keyTemplate interface{}) (blockStartKey interface{}, blockEndKey interface{}, err error) {
 	const kStartKeyIndex = 0
 	const kEndKeyIndex = 1
 
-	parts := strings.Split(blockFilename, "-")
-
-	if len(parts) != 3 {
-		return false
+	if !isBlockFilename(blockFilename) {
+		errorText := fmt.Sprintf("parseBlockFilenameKeyRange: %s is not a block filename", blockFilename)
+		return nil, nil, errors.New(errorText)
 	}
 
+	parts := strings.Split(blockFilename, "-")
+
 	blockStartKeyData, err := base32.StdEncoding.DecodeString(parts[kStartKeyIndex])
 	if err != nil {
-		return false
+		return nil, nil, err
 	}
 
 	blockEndKeyData, err := base32.StdEncoding.DecodeString(parts[kEndKeyIndex])
 	if err != nil {
-		return false
+		return nil, nil, err
 	}
 
-	blockStartKeyString := string(blockStartKeyData)
-	blockEndKeyString := string(blockEndKeyData)
-
-	blockStartKey, err := convertBlockKeyToType(startKey, blockStartKeyString)
+	blockStartKey, err = convertBlockKeyToType(keyTemplate, string(blockStartKeyData))
 	if err != nil {
-		return false
+		return nil, nil, err
 	}
 
-	blockEndKey, err := convertBlockKeyToType(endKey, blockEndKeyString)
+	blockEndKey, err = convertBlockKeyToType(keyTemplate, string(blockEndKeyData))
 	if err != nil {
+		return nil, nil, err
+	}
+
+	return blockStartKey, blockEndKey, nil
+}
+
+// isBlockFilename distinguishes block files from the sidecars stored beside them.
+func isBlockFilename(filename string) bool {
+	parts := strings.Split(filename, "-")
+
+	if len(parts) != 3 {
 		return false
 	}
 
-	switch t := startKey.(type) {
-	case int64:
-		intersects = !(startKey.(int64) > blockEndKey.(int64) || endKey.(int64) < blockStartKey.(int64))
-	case string:
-		intersects = !(startKey.(string) > blockEndKey.(string) || endKey.(string) < blockStartKey.(string))
-	default:
-		fmt.Printf("blockFilenameIntersectsKeyRange: Type %T not yet supported", t)
-		intersects = false
+	for _, part := range parts {
+		if _, err := base32.StdEncoding.DecodeString(part); err != nil {
+			return false
+		}
 	}
 
-	return
+	return true
+}
+
+func filenameIntersectsKeyRange(blockFilename string, startKey interface{}, endKey interface{}) (intersects bool) {
+	blockStartKey, blockEndKey, err := parseBlockFilenameKeyRange(blockFilename, startKey)
+	if err != nil {
+		return false
+	}
+
+	return compareKeys(startKey, blockEndKey) <= 0 && compareKeys(endKey, blockStartKey) >= 0
 }
 
 func IntersectingBlockFilenames(blockFilenames []string, startKey interface{}, endKey interface{}) (intersectingBlockFilenames []string) {
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"container/list"
+	"sync"
+)
+
+// blockCache is a least recently used set of entries bounded by the sum of
+// their sizes. Entries carry a decoded block, or none where the cache only
+// tracks files held elsewhere, eg. on disk; onEvict, if set, is called with
+// the key of each entry evicted to make room.
+type blockCache struct {
+	maxBytes int64
+	onEvict  func(key string)
+
+	bytes   int64
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+	mutex   sync.Mutex
+}
+
+type blockCacheEntry struct {
+	key   string
+	block *Block
+	size  int64
+}
+
+func newBlockCache(maxBytes int64, onEvict func(key string)) *blockCache {
+	return &blockCache{
+		maxBytes: maxBytes,
+		onEvict:  onEvict,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the entry for key, marking it most recently used.
+func (bc *blockCache) get(key string) (block *Block, ok bool) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	element, ok := bc.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	bc.order.MoveToFront(element)
+	return element.Value.(*blockCacheEntry).block, true
+}
+
+// add inserts or replaces the entry for key and evicts the least recently
+// used entries until the cache fits in maxBytes. An entry larger than
+// maxBytes on its own is not added, and add reports false.
+func (bc *blockCache) add(key string, block *Block, size int64) (added bool) {
+	if size > bc.maxBytes {
+		return false
+	}
+
+	var evicted []string
+
+	bc.mutex.Lock()
+	if element, ok := bc.entries[key]; ok {
+		bc.removeElement(element)
+	}
+
+	bc.entries[key] = bc.order.PushFront(&blockCacheEntry{key: key, block: block, size: size})
+	bc.bytes += size
+
+	for bc.bytes > bc.maxBytes {
+		oldest := bc.order.Back()
+		bc.removeElement(oldest)
+		evicted = append(evicted, oldest.Value.(*blockCacheEntry).key)
+	}
+	bc.mutex.Unlock()
+
+	if bc.onEvict != nil {
+		for _, key := range evicted {
+			bc.onEvict(key)
+		}
+	}
+
+	return true
+}
+
+// remove drops the entry for key, if any, without calling onEvict.
+func (bc *blockCache) remove(key string) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if element, ok := bc.entries[key]; ok {
+		bc.removeElement(element)
+	}
+}
+
+func (bc *blockCache) removeElement(element *list.Element) {
+	entry := element.Value.(*blockCacheEntry)
+
+	bc.order.Remove(element)
+	delete(bc.entries, entry.key)
+	bc.bytes -= entry.size
+}
+
+// size returns the number of entries and the sum of their sizes.
+func (bc *blockCache) size() (entries int, bytes int64) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	return len(bc.entries), bc.bytes
+}
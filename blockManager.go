@@ -1,90 +1,353 @@
 package core
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
-	goavro "gopkg.in/linkedin/goavro.v2"
+	goavro "github.com/linkedin/goavro/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type BlockManager struct {
 	ID string
 
 	PartitionColumn string
+	PartitionSpec   *PartitionSpec // multi-level partitioning, takes precedence over PartitionColumn
 	KeyColumn       string
+	IdentityColumns []string // rows sharing these column values are only written once per block
 
 	MaxAge  uint32 // in milliseconds
 	MaxSize int    // in rows
 
-	Input    chan interface{}
-	Output   chan *Block
-	Codec    *goavro.Codec
-	Finished chan bool
+	WALPath string // directory for the write-ahead log of uncommitted rows, disabled if empty
 
-	blocks       map[string]*Block // partitionKey -> block
-	managerMutex sync.Mutex
+	Input   chan interface{}
+	Output  chan *Block
+	Errors  chan error // reports rows rejected because they could not be logged; must be read if set
+	Codec   *goavro.Codec
+	Metrics Metrics // defaults to recording nothing
+	Logger  Logger  // defaults to slog.Default()
+
+	TracerProvider trace.TracerProvider // defaults to the global provider
+
+	blocks        map[string]*Block // partitionKey -> block
+	managerMutex  sync.Mutex        // guards blocks, and is never held while sending to Output
+	cancel        context.CancelFunc
+	cancelled     <-chan struct{} // closed once Start's ctx ends or Stop gives up
+	stopAgeChecks context.CancelFunc
+	ageChecks     sync.WaitGroup
+	done          chan struct{}
 }
 
-func (bm *BlockManager) processRows() {
+func (bm *BlockManager) processRows(ctx context.Context, done chan struct{}) {
 	go func() {
+		defer close(done)
+
 		for {
-			row, more := <-bm.Input
+			var row interface{}
+			var more bool
+
+			select {
+			case row, more = <-bm.Input:
+			case <-ctx.Done():
+				bm.logger().Info("BlockManager stopped taking rows", "error", ctx.Err())
+				return
+			}
 
 			if !more {
-				bm.Finished <- true
-				break
+				return
 			}
 
-			rowMap := row.(map[string]interface{})
+			var onDurable func()
+			var sourceContext context.Context
+			if trackedRow, ok := row.(*TrackedRow); ok {
+				row = trackedRow.Row
+				onDurable = trackedRow.OnDurable
+				sourceContext = trackedRow.Context
+			}
 
-			var partitionKey string
-			switch t := rowMap[bm.PartitionColumn].(type) {
-			case map[string]interface{}:
-				columnMap := rowMap[bm.PartitionColumn].(map[string]interface{})
-				for _, value := range columnMap {
-					partitionKey = value.(string)
-				}
-			case string:
-				partitionKey = rowMap[bm.PartitionColumn].(string)
-			default:
-				log.Printf("processRows unknown type: %T", t)
+			partitionKey, err := bm.partitionKey(row)
+			bm.metrics().addCounter(MetricRowsIngested, 1)
+
+			if err != nil {
+				bm.rejectRow(ctx, fmt.Errorf("BlockManager: rejected row, as partitioning it failed: %w", err), onDurable)
+				continue
 			}
 
 			bm.managerMutex.Lock()
 
 			block, exists := bm.blocks[partitionKey]
 			if !exists {
-				block = NewBlock(partitionKey, bm.KeyColumn, bm.Codec)
+				if block, err = bm.newBlock(partitionKey); err != nil {
+					bm.managerMutex.Unlock()
+					bm.rejectRow(ctx, fmt.Errorf("BlockManager: rejected row for partition %s, as logging it failed: %w", partitionKey, err), nil)
+					continue
+				}
+			}
+
+			// a row is only accepted, and so only ever made durable, once it
+			// has been logged
+			if block.wal != nil {
+				if err := block.wal.Append(row); err != nil {
+					if !exists {
+						block.wal.Remove()
+					}
+					bm.managerMutex.Unlock()
+
+					// a row that cannot be encoded never will be, unlike one
+					// lost to a failing disk
+					rejectedDurable := onDurable
+					if !errors.Is(err, errRowNotEncodable) {
+						rejectedDurable = nil
+					}
+
+					bm.rejectRow(ctx, fmt.Errorf("BlockManager: rejected row for partition %s, as logging it failed: %w", partitionKey, err), rejectedDurable)
+					continue
+				}
+			}
+
+			if !exists {
 				bm.blocks[partitionKey] = block
-				log.Printf("Creating block for partition key: %s uncommitted block count: %d\n", partitionKey, len(bm.blocks))
+				bm.metrics().setGauge(MetricOpenBlocks, float64(len(bm.blocks)))
+				bm.logger().Debug("Creating block", "partition_key", partitionKey, "uncommitted_blocks", len(bm.blocks))
 			}
 
 			block.Write(row)
 
-			if block.Length() >= bm.MaxSize {
-				bm.commitBlock(block)
+			if onDurable != nil {
+				block.OnDurable(onDurable)
 			}
 
+			block.linkSource(sourceContext)
+
+			if block.Length() < bm.MaxSize {
+				bm.managerMutex.Unlock()
+				continue
+			}
+
+			bm.detachBlock(block)
 			bm.managerMutex.Unlock()
+
+			if err := bm.commitBlock(ctx, block, "size"); err != nil {
+				bm.reattachBlocks([]*Block{block})
+				bm.logger().Info("BlockManager stopped taking rows", "error", err)
+				return
+			}
 		}
 	}()
 }
 
-func (bm *BlockManager) commitBlock(block *Block) (err error) {
-	log.Printf("Committing block PartitionKey: %+v StartingKey: %+v EndingKey: %+v with %d rows.  %d uncommitted blocks remaining.\n", block.PartitionKey, block.StartingKey, block.EndingKey, len(block.Rows), len(bm.blocks))
+func (bm *BlockManager) partitionKey(row interface{}) (partitionKey string, err error) {
+	if bm.PartitionSpec != nil {
+		return bm.PartitionSpec.PartitionKey(row)
+	}
+
+	rowMap := row.(map[string]interface{})
+
+	switch t := rowMap[bm.PartitionColumn].(type) {
+	case map[string]interface{}:
+		columnMap := rowMap[bm.PartitionColumn].(map[string]interface{})
+		for _, value := range columnMap {
+			partitionKey = value.(string)
+		}
+	case string:
+		partitionKey = rowMap[bm.PartitionColumn].(string)
+	default:
+		bm.logger().Warn("Partitioning row failed", "partition_column", bm.PartitionColumn, "type", fmt.Sprintf("%T", t))
+	}
+
+	return partitionKey, nil
+}
+
+func (bm *BlockManager) newBlock(partitionKey string) (block *Block, err error) {
+	block = NewBlock(partitionKey, bm.KeyColumn, bm.Codec)
+	block.IdentityColumns = bm.IdentityColumns
+	block.Logger = bm.Logger
+
+	if len(bm.WALPath) == 0 {
+		return block, nil
+	}
+
+	wal, err := createBlockWAL(bm.WALPath, partitionKey, bm.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	bm.attachWAL(block, wal)
+
+	return block, nil
+}
+
+// rejectRow reports a row that could not be partitioned or logged to the
+// write-ahead log, and is not written to a block. A row rejected for good is
+// passed with its onDurable, which is called so that a StreamAdapter tracking
+// it, such as KafkaStreamAdapter, moves past it rather than delivering it
+// again after every restart. Passing a nil onDurable leaves the row to be
+// delivered again, for failures, such as a full disk, that may not recur.
+func (bm *BlockManager) rejectRow(ctx context.Context, err error, onDurable func()) {
+	bm.logger().Error("Rejecting row", "error", err)
+
+	if onDurable != nil {
+		onDurable()
+	}
+
+	if bm.Errors == nil {
+		return
+	}
+
+	select {
+	case bm.Errors <- err:
+	case <-ctx.Done():
+	}
+}
+
+// attachWAL ties a log to a block, removing it once the block is durable.
+func (bm *BlockManager) attachWAL(block *Block, wal *blockWAL) {
+	if block.wal == nil {
+		block.wal = wal
+	}
+
+	block.OnDurable(func() {
+		if err := wal.Remove(); err != nil {
+			bm.logger().Warn("Removing write-ahead log failed", "path", wal.filePath, "error", err)
+		}
+	})
+}
+
+// replayWAL rebuilds the uncommitted blocks recorded in the write-ahead log.
+func (bm *BlockManager) replayWAL() (err error) {
+	walFilenames, err := listWALFiles(bm.WALPath)
+	if err != nil {
+		return err
+	}
+
+	for _, walFilename := range walFilenames {
+		walFilePath := filepath.Join(bm.WALPath, walFilename)
+
+		partitionKey, err := walPartitionKey(walFilename)
+		if err != nil {
+			bm.logger().Warn("Skipping write-ahead log", "path", walFilePath, "error", err)
+			continue
+		}
+
+		rows, err := readWALRows(walFilePath, bm.Codec, bm.logger())
+		if err != nil {
+			return err
+		}
+
+		wal, err := openBlockWAL(walFilePath, bm.Codec)
+		if err != nil {
+			return err
+		}
+
+		// logs for the same partition, from a block committed but not yet
+		// durable at the time of the crash, are folded into one block
+		block, exists := bm.blocks[partitionKey]
+		if !exists {
+			block = NewBlock(partitionKey, bm.KeyColumn, bm.Codec)
+			block.IdentityColumns = bm.IdentityColumns
+			block.Logger = bm.Logger
+			if walFileInfo, err := os.Stat(walFilePath); err == nil {
+				block.CreationTime = walFileInfo.ModTime()
+			}
+			bm.blocks[partitionKey] = block
+		} else {
+			wal.Close()
+		}
+
+		bm.attachWAL(block, wal)
+
+		for _, row := range rows {
+			block.Write(row)
+		}
+
+		bm.logger().Info("Replayed write-ahead log", "partition_key", partitionKey, "rows", len(rows))
+	}
+
+	return nil
+}
+
+func (bm *BlockManager) logger() Logger {
+	return LoggerOrDefault(bm.Logger)
+}
+
+func (bm *BlockManager) tracer() trace.Tracer {
+	return tracerFrom(bm.TracerProvider)
+}
 
-	bm.Output <- block
+func (bm *BlockManager) metrics() metricsScope {
+	return metricsScope{metrics: bm.Metrics}
+}
 
+// detachBlock stops holding a block, so that rows are no longer written to it
+// while it is committed. The caller holds managerMutex.
+func (bm *BlockManager) detachBlock(block *Block) {
 	delete(bm.blocks, block.PartitionKey)
+	bm.metrics().setGauge(MetricOpenBlocks, float64(len(bm.blocks)))
+}
+
+// reattachBlocks holds again blocks whose commit was abandoned, so that a
+// later flush commits them, unless a newer block for the partition exists.
+func (bm *BlockManager) reattachBlocks(blocks []*Block) {
+	bm.managerMutex.Lock()
+	defer bm.managerMutex.Unlock()
+
+	for _, block := range blocks {
+		if _, exists := bm.blocks[block.PartitionKey]; !exists {
+			bm.blocks[block.PartitionKey] = block
+		}
+	}
+
+	bm.metrics().setGauge(MetricOpenBlocks, float64(len(bm.blocks)))
+}
+
+// commitBlock sends a detached block to Output; reason is size, age or flush.
+// If ctx ends first, ctx's error is returned and the block's write-ahead log,
+// if any, is left for replay.
+func (bm *BlockManager) commitBlock(ctx context.Context, block *Block, reason string) (err error) {
+	if block.wal != nil {
+		block.wal.Close()
+	}
+
+	bm.logger().Info("Committing block", append(blockLogArgs(block), "reason", reason)...)
+
+	// the span covers handing the block to storage, and the spans writing it
+	// are its children
+	_, span := bm.tracer().Start(context.Background(), "BlockManager.commitBlock",
+		trace.WithLinks(block.sourceLinks...),
+		blockSpanAttributes(block),
+		trace.WithAttributes(attribute.String(attributeCommitReason, reason)),
+	)
+	block.commitSpanContext = span.SpanContext()
+
+	select {
+	case bm.Output <- block:
+	case <-ctx.Done():
+		bm.logger().Warn("Committing block abandoned", append(blockLogArgs(block), "reason", reason, "error", ctx.Err())...)
+		endSpan(span, ctx.Err())
+		return ctx.Err()
+	}
+	span.End()
+
+	bm.metrics().observeSince(MetricBlockAge, block.CreationTime)
+	bm.metrics().addCounter(MetricBlocksCommitted, 1, "reason", reason)
 
 	return nil
 }
 
-func (bm *BlockManager) CommitBlocks(commitAll bool) (err error) {
+// CommitBlocks sends the blocks older than MaxAge, or every block if
+// commitAll, to Output, stopping with ctx's error if ctx ends first. The
+// blocks not sent by then are held again.
+func (bm *BlockManager) CommitBlocks(ctx context.Context, commitAll bool) (err error) {
 	bm.managerMutex.Lock()
 
-	log.Printf("Committing blocks, all: %+v", commitAll)
+	bm.logger().Debug("Committing blocks", "all", commitAll, "uncommitted_blocks", len(bm.blocks))
 	blocksToCommit := []*Block{}
 
 	for _, block := range bm.blocks {
@@ -95,47 +358,119 @@ func (bm *BlockManager) CommitBlocks(commitAll bool) (err error) {
 	}
 
 	for _, block := range blocksToCommit {
-		bm.commitBlock(block)
+		bm.detachBlock(block)
 	}
 
 	bm.managerMutex.Unlock()
 
+	reason := "age"
+	if commitAll {
+		reason = "flush"
+	}
+
+	for i, block := range blocksToCommit {
+		if err = bm.commitBlock(ctx, block, reason); err != nil {
+			bm.reattachBlocks(blocksToCommit[i:])
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (bm *BlockManager) checkBlockAges() {
+// checkBlockAges commits blocks older than MaxAge every second until ctx ends.
+func (bm *BlockManager) checkBlockAges(ctx context.Context) {
 	checkTicker := time.NewTicker(1 * time.Second)
 
+	bm.ageChecks.Add(1)
 	go func() {
-		for _ = range checkTicker.C {
-			bm.CommitBlocks(false)
+		defer bm.ageChecks.Done()
+		defer checkTicker.Stop()
+
+		for {
+			select {
+			case <-checkTicker.C:
+				bm.CommitBlocks(ctx, false)
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 }
 
-func (bm *BlockManager) Start() (err error) {
+// Start takes rows from Input until it is closed or ctx is cancelled.
+func (bm *BlockManager) Start(ctx context.Context) (err error) {
 	bm.blocks = make(map[string]*Block)
 	bm.managerMutex = sync.Mutex{}
 
-	bm.processRows()
-	bm.checkBlockAges()
+	if len(bm.WALPath) > 0 {
+		if err = bm.replayWAL(); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	bm.done = done
+
+	ctx, bm.cancel = context.WithCancel(ctx)
+	bm.cancelled = ctx.Done()
+
+	ageCtx, stopAgeChecks := context.WithCancel(ctx)
+	bm.stopAgeChecks = stopAgeChecks
+
+	bm.processRows(ctx, done)
+	bm.checkBlockAges(ageCtx)
 
 	return nil
 }
 
-func (bm *BlockManager) Stop() (err error) {
-	log.Println("Stopping BlockManager")
+// Done is closed once the BlockManager has stopped taking rows from Input.
+func (bm *BlockManager) Done() <-chan struct{} {
+	return bm.done
+}
 
-	// wait for completion
-	ttl := 100
-	for len(bm.Input) > 0 && ttl > 0 {
-		log.Printf("waiting for BlockManager to stop:  %d remaining Blocks, %d TTL\n", len(bm.Input), ttl)
+// Stop waits for Input to be closed and drained, and then commits every block
+// still held to Output, until either ctx or Start's ctx ends. If ctx ends
+// first, Stop gives up taking rows and returns ctx's error; the blocks not yet
+// committed keep their write-ahead logs, if any, for replay. Nothing is sent
+// to Output once Stop has returned.
+func (bm *BlockManager) Stop(ctx context.Context) (err error) {
+	bm.logger().Info("Stopping BlockManager")
+
+	// nothing is running before Start, or after it failed
+	if bm.done == nil {
+		return nil
+	}
 
-		ttl--
-		time.Sleep(200 * time.Millisecond)
+	select {
+	case <-bm.Done():
+	case <-ctx.Done():
+		err = fmt.Errorf("BlockManager: input did not finish, still has %d rows remaining: %w", len(bm.Input), ctx.Err())
 	}
 
-	bm.CommitBlocks(true)
+	// an age check in progress gives up its commit, holding its blocks again
+	// for the flush below
+	bm.stopAgeChecks()
+	bm.ageChecks.Wait()
 
-	return nil
+	if err != nil {
+		bm.cancel()
+		<-bm.Done()
+		return err
+	}
+
+	defer bm.cancel()
+
+	flushCtx, cancelFlush := context.WithCancel(ctx)
+	defer cancelFlush()
+
+	go func() {
+		select {
+		case <-bm.cancelled:
+			cancelFlush()
+		case <-flushCtx.Done():
+		}
+	}()
+
+	return bm.CommitBlocks(flushCtx, true)
 }
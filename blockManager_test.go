@@ -1,7 +1,11 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -24,7 +28,7 @@ func TestBlockManager(t *testing.T) {
 		Codec:           GetCodecFixture(),
 	}
 
-	err := blockManager.Start()
+	err := blockManager.Start(context.Background())
 	if err != nil {
 		t.Errorf("Block Manager start failed with error: %s", err)
 	}
@@ -47,3 +51,382 @@ func TestBlockManager(t *testing.T) {
 
 	log.Println("Finished TestBlockManager")
 }
+
+func TestBlockManagerWALReplay(t *testing.T) {
+	log.Println("Starting TestBlockManagerWALReplay")
+
+	walPath := "./test/wal"
+	os.RemoveAll(walPath)
+	defer os.RemoveAll(walPath)
+
+	input := make(chan interface{})
+
+	blockManager := &BlockManager{
+		MaxAge:          60000, // milliseconds
+		MaxSize:         8192,  // rows
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		WALPath:         walPath,
+		Input:           input,
+		Output:          make(chan *Block),
+		Codec:           GetCodecFixture(),
+	}
+
+	if err := blockManager.Start(context.Background()); err != nil {
+		t.Errorf("Block Manager start failed with error: %s", err)
+	}
+
+	input <- GetNativeFixture()
+
+	// waits for the row to be logged before standing in for a crash
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		walFilenames, err := listWALFiles(walPath)
+		if err != nil {
+			t.Fatalf("Listing write-ahead log failed with error: %s", err)
+		}
+
+		if len(walFilenames) == 1 {
+			rows, err := readWALRows(filepath.Join(walPath, walFilenames[0]), blockManager.Codec, LoggerOrDefault(nil))
+			if err != nil {
+				t.Fatalf("Reading write-ahead log failed with error: %s", err)
+			}
+			if len(rows) == 1 {
+				break
+			}
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Block Manager did not log the row to its write-ahead log")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a new BlockManager over the same log stands in for a restart after a crash
+	replayedBlockManager := &BlockManager{
+		MaxAge:          60000, // milliseconds
+		MaxSize:         8192,  // rows
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		WALPath:         walPath,
+		Input:           make(chan interface{}),
+		Output:          make(chan *Block),
+		Codec:           GetCodecFixture(),
+	}
+
+	if err := replayedBlockManager.Start(context.Background()); err != nil {
+		t.Errorf("Block Manager start failed with error: %s", err)
+	}
+
+	replayedBlockManager.managerMutex.Lock()
+	block, exists := replayedBlockManager.blocks["userid1"]
+	replayedBlockManager.managerMutex.Unlock()
+
+	if !exists {
+		t.Fatalf("Block Manager did not replay block from write-ahead log")
+	}
+
+	if block.Length() != 1 {
+		t.Errorf("Replayed block is the wrong size: %d vs. 1", block.Length())
+	}
+
+	block.MarkDurable()
+
+	walFilenames, err := listWALFiles(walPath)
+	if err != nil {
+		t.Errorf("Listing write-ahead log failed with error: %s", err)
+	}
+
+	if len(walFilenames) != 0 {
+		t.Errorf("Write-ahead log not removed once block was durable: %d files remaining", len(walFilenames))
+	}
+
+	log.Println("Finished TestBlockManagerWALReplay")
+}
+
+func TestBlockManagerStopDeadline(t *testing.T) {
+	log.Println("Starting TestBlockManagerStopDeadline")
+
+	input := make(chan interface{})
+
+	blockManager := &BlockManager{
+		MaxAge:          60000, // milliseconds
+		MaxSize:         8192,  // rows
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		Input:           input,
+		Output:          make(chan *Block), // never read, as by a stopped StorageAdapter
+		Codec:           GetCodecFixture(),
+	}
+
+	if err := blockManager.Start(context.Background()); err != nil {
+		t.Fatalf("Block Manager start failed with error: %s", err)
+	}
+
+	input <- GetNativeFixture()
+	close(input)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- blockManager.Stop(ctx)
+	}()
+
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Block Manager stop returned %v instead of the deadline", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Block Manager stop did not return at its deadline")
+	}
+
+	log.Println("Finished TestBlockManagerStopDeadline")
+}
+
+func TestBlockManagerStopBeforeStart(t *testing.T) {
+	log.Println("Starting TestBlockManagerStopBeforeStart")
+
+	blockManager := &BlockManager{
+		MaxAge:          60000, // milliseconds
+		MaxSize:         8192,  // rows
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		Input:           make(chan interface{}),
+		Output:          make(chan *Block),
+		Codec:           GetCodecFixture(),
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- blockManager.Stop(context.Background())
+	}()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Block Manager stop before start returned error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Block Manager stop before start did not return")
+	}
+
+	log.Println("Finished TestBlockManagerStopBeforeStart")
+}
+
+func TestBlockManagerSizeCommitAbandoned(t *testing.T) {
+	log.Println("Starting TestBlockManagerSizeCommitAbandoned")
+
+	input := make(chan interface{})
+
+	blockManager := &BlockManager{
+		MaxAge:          60000, // milliseconds
+		MaxSize:         1,     // rows
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		Input:           input,
+		Output:          make(chan *Block), // never read, as by a stopped StorageAdapter
+		Codec:           GetCodecFixture(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := blockManager.Start(ctx); err != nil {
+		t.Fatalf("Block Manager start failed with error: %s", err)
+	}
+
+	// the row fills its block, whose commit is then abandoned
+	input <- GetNativeFixture()
+	cancel()
+
+	select {
+	case <-blockManager.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Block Manager did not stop taking rows once its ctx ended")
+	}
+
+	blockManager.managerMutex.Lock()
+	block, exists := blockManager.blocks["userid1"]
+	blockManager.managerMutex.Unlock()
+
+	if !exists || block.Length() != 1 {
+		t.Errorf("Block Manager did not hold the block whose commit was abandoned")
+	}
+
+	log.Println("Finished TestBlockManagerSizeCommitAbandoned")
+}
+
+func TestBlockManagerStopDuringAgeCommit(t *testing.T) {
+	log.Println("Starting TestBlockManagerStopDuringAgeCommit")
+
+	input := make(chan interface{})
+
+	blockManager := &BlockManager{
+		MaxAge:          1,    // milliseconds
+		MaxSize:         8192, // rows
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		Input:           input,
+		Output:          make(chan *Block), // never read, as by storage retrying a block
+		Codec:           GetCodecFixture(),
+	}
+
+	if err := blockManager.Start(context.Background()); err != nil {
+		t.Fatalf("Block Manager start failed with error: %s", err)
+	}
+
+	input <- map[string]interface{}{"user_id": "userid1", "timestamp": int64(100000)}
+	close(input)
+
+	// the age check is now stuck committing the block
+	time.Sleep(1500 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- blockManager.Stop(ctx)
+	}()
+
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Block Manager stop returned %v instead of the deadline", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Block Manager stop did not return at its deadline")
+	}
+
+	blockManager.managerMutex.Lock()
+	blockCount := len(blockManager.blocks)
+	blockManager.managerMutex.Unlock()
+
+	if blockCount != 1 {
+		t.Errorf("Block Manager did not keep the block it could not commit: %d blocks", blockCount)
+	}
+
+	log.Println("Finished TestBlockManagerStopDuringAgeCommit")
+}
+
+func TestBlockManagerWALRejectsRow(t *testing.T) {
+	log.Println("Starting TestBlockManagerWALRejectsRow")
+
+	walPath := "./test/wal-reject"
+	os.RemoveAll(walPath)
+	defer os.RemoveAll(walPath)
+
+	input := make(chan interface{})
+	errors := make(chan error, 1)
+
+	blockManager := &BlockManager{
+		MaxAge:          60000, // milliseconds
+		MaxSize:         8192,  // rows
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		WALPath:         walPath,
+		Input:           input,
+		Output:          make(chan *Block),
+		Errors:          errors,
+		Codec:           GetCodecFixture(),
+	}
+
+	if err := blockManager.Start(context.Background()); err != nil {
+		t.Fatalf("Block Manager start failed with error: %s", err)
+	}
+
+	// a row the codec cannot encode cannot be logged
+	durable := false
+	input <- &TrackedRow{
+		Row:       map[string]interface{}{"user_id": "userid1"},
+		OnDurable: func() { durable = true },
+	}
+
+	select {
+	case err := <-errors:
+		if err == nil {
+			t.Errorf("Block Manager reported a nil error for the rejected row")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Block Manager did not report the row it could not log")
+	}
+
+	blockManager.managerMutex.Lock()
+	blockCount := len(blockManager.blocks)
+	blockManager.managerMutex.Unlock()
+
+	if blockCount != 0 {
+		t.Errorf("Block Manager accepted a row it could not log: %d blocks", blockCount)
+	}
+
+	// the row will never encode, so it is acknowledged rather than replayed
+	if !durable {
+		t.Errorf("Block Manager did not acknowledge a row it can never log")
+	}
+
+	walFilenames, err := listWALFiles(walPath)
+	if err != nil || len(walFilenames) != 0 {
+		t.Errorf("Block Manager left %d write-ahead logs for the rejected row: %v", len(walFilenames), err)
+	}
+
+	log.Println("Finished TestBlockManagerWALRejectsRow")
+}
+
+func TestBlockManagerRejectsUnpartitionableRow(t *testing.T) {
+	log.Println("Starting TestBlockManagerRejectsUnpartitionableRow")
+
+	input := make(chan interface{})
+	errors := make(chan error, 1)
+
+	blockManager := &BlockManager{
+		MaxAge:  60000, // milliseconds
+		MaxSize: 8192,  // rows
+		PartitionSpec: &PartitionSpec{
+			Fields: []PartitionField{
+				{SourceColumn: "timestamp", Transform: DayTransform},
+			},
+		},
+		KeyColumn: "timestamp",
+		Input:     input,
+		Output:    make(chan *Block),
+		Errors:    errors,
+		Codec:     GetCodecFixture(),
+	}
+
+	if err := blockManager.Start(context.Background()); err != nil {
+		t.Fatalf("Block Manager start failed with error: %s", err)
+	}
+
+	// a day transform cannot partition a row whose timestamp is not a time
+	durable := false
+	input <- &TrackedRow{
+		Row:       map[string]interface{}{"user_id": "userid1", "timestamp": "yesterday"},
+		OnDurable: func() { durable = true },
+	}
+
+	select {
+	case err := <-errors:
+		if err == nil {
+			t.Errorf("Block Manager reported a nil error for the rejected row")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Block Manager did not report the row it could not partition")
+	}
+
+	blockManager.managerMutex.Lock()
+	blockCount := len(blockManager.blocks)
+	blockManager.managerMutex.Unlock()
+
+	if blockCount != 0 {
+		t.Errorf("Block Manager accepted a row it could not partition: %d blocks", blockCount)
+	}
+
+	if !durable {
+		t.Errorf("Block Manager did not acknowledge a row it can never partition")
+	}
+
+	log.Println("Finished TestBlockManagerRejectsUnpartitionableRow")
+}
@@ -0,0 +1,267 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	goavro "github.com/linkedin/goavro/v2"
+)
+
+// BlockStore is implemented by storage adapters whose committed blocks can be
+// listed and rewritten, for maintenance such as compaction.
+type BlockStore interface {
+	ListPartitions(ctx context.Context, prefix string) (partitionKeys []string, err error)
+	GetPartitionFileNames(ctx context.Context, partitionKey string) (partitionFileNames []string, err error)
+
+	// Load sends the named block to blocks or, if any of it cannot be read,
+	// an error to errors, but never both.
+	Load(ctx context.Context, partitionKey string, blockFilename string, blocks chan *Block, errors chan error)
+	LoadStatistics(ctx context.Context, partitionKey string, blockFilename string) (statistics *BlockStatistics, err error)
+
+	// ReplaceBlocks writes added to the partition and then removes the blocks
+	// named by removedFilenames. Iceberg readers see the swap as a single
+	// snapshot; Query may briefly see both sets of rows. It fails, changing
+	// nothing, if a removed block has already been replaced by another
+	// rewrite, such as a Delete racing a Compactor.
+	ReplaceBlocks(ctx context.Context, partitionKey string, added []*Block, removedFilenames []string) (err error)
+}
+
+// errBlockReplaced is returned by ReplaceBlocks for a removed block that is no
+// longer in the partition.
+var errBlockReplaced = errors.New("block has already been replaced")
+
+// blockObjectStore is the object level access ReplaceBlocks is built from.
+type blockObjectStore interface {
+	objectStore
+	writeBlockObject(ctx context.Context, block *Block) (blockObjectPath string, size int64, err error)
+	GetPartitionFileNames(ctx context.Context, partitionKey string) (partitionFileNames []string, err error)
+	lockPartition(partitionKey string) (unlock func())
+}
+
+// partitionLocks serializes the rewrites of each partition of a store.
+type partitionLocks struct {
+	mutex sync.Mutex
+	locks map[string]*partitionLock
+}
+
+type partitionLock struct {
+	sync.Mutex
+	waiters int // holders and those waiting, so that an unused lock is dropped
+}
+
+func (pl *partitionLocks) lock(partitionKey string) (unlock func()) {
+	pl.mutex.Lock()
+	if pl.locks == nil {
+		pl.locks = make(map[string]*partitionLock)
+	}
+	lock, exists := pl.locks[partitionKey]
+	if !exists {
+		lock = &partitionLock{}
+		pl.locks[partitionKey] = lock
+	}
+	lock.waiters++
+	pl.mutex.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		pl.mutex.Lock()
+		lock.waiters--
+		if lock.waiters == 0 {
+			delete(pl.locks, partitionKey)
+		}
+		pl.mutex.Unlock()
+	}
+}
+
+// writeBlockOCF encodes a block's rows to w as an Avro OCF with codec's schema,
+// compressed with compressionName, or uncompressed if it is empty.
+func writeBlockOCF(w io.Writer, block *Block, codec *goavro.Codec, compressionName string) (err error) {
+	ocfWriter, err := goavro.NewOCFWriter(goavro.OCFConfig{
+		W:               w,
+		CompressionName: compressionName,
+		Schema:          codec.Schema(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return ocfWriter.Append(block.Rows)
+}
+
+// writeOCFFile writes a block to filePath as writeBlockOCF encodes it, via a
+// temporary file so that a partially written file is never loaded or left
+// behind, returning its size.
+func writeOCFFile(filePath string, block *Block, codec *goavro.Codec, compressionName string) (size int64, err error) {
+	tempFilePath := filePath + ".tmp"
+
+	toFile, err := os.Create(tempFilePath)
+	if err != nil {
+		return 0, err
+	}
+
+	err = writeBlockOCF(toFile, block, codec, compressionName)
+
+	if err == nil {
+		size, err = toFile.Seek(0, io.SeekCurrent)
+	}
+
+	if closeErr := toFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tempFilePath, filePath)
+	}
+
+	if err != nil {
+		os.Remove(tempFilePath)
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func blockObjectPath(partitionKey string, keyColumn string, blockFilename string) string {
+	return fmt.Sprintf("%s/%s/%s", partitionKey, keyColumn, blockFilename)
+}
+
+// replaceBlocks writes added to a partition, commits the swap to the Iceberg
+// table, if any, and then deletes the removed blocks. If writing or committing
+// fails, the blocks already added are deleted again, leaving the partition as
+// it was rather than holding both sets of rows. Once a removed block has been
+// deleted, or the table has committed the swap, the added blocks are kept and
+// the remaining deletes are still attempted, as removing the added blocks then
+// would lose rows.
+//
+// Rewriters such as Delete, a Compactor and a RetentionManager read blocks
+// before replacing them, so each replacement is made under the partition's
+// lock and only if every removed block is still there. Otherwise a rewrite
+// of blocks another has since replaced would bring back the rows it removed.
+func replaceBlocks(ctx context.Context, store blockObjectStore, table *icebergTable, keyColumn string, partitionKey string, added []*Block, removedFilenames []string) (err error) {
+	unlock := store.lockPartition(partitionKey)
+	defer unlock()
+
+	partitionFileNames, err := store.GetPartitionFileNames(ctx, partitionKey)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, partitionFileName := range partitionFileNames {
+		existing[partitionFileName] = true
+	}
+
+	for _, removedFilename := range removedFilenames {
+		if !existing[removedFilename] {
+			return fmt.Errorf("%w: %s in partition %s", errBlockReplaced, removedFilename, partitionKey)
+		}
+	}
+
+	removedPaths := make(map[string]bool)
+	for _, removedFilename := range removedFilenames {
+		removedPaths[blockObjectPath(partitionKey, keyColumn, removedFilename)] = true
+	}
+
+	addedPaths := make(map[string]bool)
+	var writtenPaths []string
+	var dataFiles []*icebergDataFile
+
+	// rollBack deletes the blocks written so far, except those that replaced
+	// a removed block of the same name and so hold the same rows
+	rollBack := func(err error) error {
+		for _, writtenPath := range writtenPaths {
+			if removedPaths[writtenPath] {
+				continue
+			}
+
+			if deleteErr := store.deleteObject(ctx, writtenPath); deleteErr != nil && deleteErr != errObjectNotFound {
+				store.logger().Error("Rolling back added block failed", "partition_key", partitionKey, "block", path.Base(writtenPath), "error", deleteErr)
+			}
+
+			if deleteErr := store.deleteObject(ctx, statisticsFilename(writtenPath)); deleteErr != nil && deleteErr != errObjectNotFound {
+				store.logger().Warn("Rolling back added block statistics failed", "partition_key", partitionKey, "block", path.Base(writtenPath), "error", deleteErr)
+			}
+		}
+
+		return err
+	}
+
+	for _, block := range added {
+		objectPath, size, err := store.writeBlockObject(ctx, block)
+		if err != nil {
+			return rollBack(err)
+		}
+
+		addedPaths[objectPath] = true
+		writtenPaths = append(writtenPaths, objectPath)
+
+		if table != nil {
+			dataFile, err := table.newDataFile(block, objectPath, size)
+			if err != nil {
+				return rollBack(err)
+			}
+			dataFiles = append(dataFiles, dataFile)
+		}
+	}
+
+	var deletePaths []string
+	for _, removedFilename := range removedFilenames {
+		// a rewrite with identical rows produces the same filename, which now holds the new block
+		removedPath := blockObjectPath(partitionKey, keyColumn, removedFilename)
+		if !addedPaths[removedPath] {
+			deletePaths = append(deletePaths, removedPath)
+		}
+	}
+
+	if table != nil {
+		if err = table.commit(ctx, dataFiles, deletePaths); err != nil {
+			return rollBack(err)
+		}
+	}
+
+	deleted := 0
+	for _, deletePath := range deletePaths {
+		if deleteErr := store.deleteObject(ctx, deletePath); deleteErr != nil && deleteErr != errObjectNotFound {
+			if table == nil && deleted == 0 {
+				return rollBack(deleteErr)
+			}
+
+			store.logger().Error("Deleting replaced block failed", "partition_key", partitionKey, "block", path.Base(deletePath), "error", deleteErr)
+			if err == nil {
+				err = deleteErr
+			}
+			continue
+		}
+		deleted++
+
+		if deleteErr := store.deleteObject(ctx, statisticsFilename(deletePath)); deleteErr != nil && deleteErr != errObjectNotFound {
+			store.logger().Warn("Deleting statistics failed", "partition_key", partitionKey, "block", path.Base(deletePath), "error", deleteErr)
+		}
+	}
+
+	return err
+}
+
+// readBlock loads a single block synchronously.
+func readBlock(ctx context.Context, source blockSource, partitionKey string, blockFilename string) (block *Block, err error) {
+	loadedBlocks := make(chan *Block)
+	loadErrors := make(chan error)
+
+	go source.Load(ctx, partitionKey, blockFilename, loadedBlocks, loadErrors)
+
+	select {
+	case block = <-loadedBlocks:
+		return block, nil
+	case err = <-loadErrors:
+		return nil, err
+	}
+}
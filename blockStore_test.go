@@ -0,0 +1,159 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// failingObjectStore holds objects in memory, failing writes once failWritesAfter
+// blocks have been written and failing deletes of blocks if failDeletes is set.
+type failingObjectStore struct {
+	failWritesAfter int
+	failDeletes     bool
+
+	objects  map[string][]byte
+	written  int
+	mutex    sync.Mutex
+	rewrites partitionLocks
+}
+
+func (fos *failingObjectStore) readObject(ctx context.Context, objectPath string) (data []byte, err error) {
+	fos.mutex.Lock()
+	defer fos.mutex.Unlock()
+
+	data, ok := fos.objects[objectPath]
+	if !ok {
+		return nil, errObjectNotFound
+	}
+
+	return data, nil
+}
+
+func (fos *failingObjectStore) writeObject(ctx context.Context, objectPath string, data []byte) (err error) {
+	fos.mutex.Lock()
+	defer fos.mutex.Unlock()
+
+	fos.objects[objectPath] = data
+	return nil
+}
+
+func (fos *failingObjectStore) objectURI(objectPath string) string {
+	return "memory://" + objectPath
+}
+
+func (fos *failingObjectStore) writeBlockObject(ctx context.Context, block *Block) (blockObjectPath string, size int64, err error) {
+	fos.mutex.Lock()
+	defer fos.mutex.Unlock()
+
+	if fos.written >= fos.failWritesAfter {
+		return "", 0, errors.New("write failed")
+	}
+	fos.written++
+
+	blockObjectPath = fmt.Sprintf("%s/%s/added-%d.avro", block.PartitionKey, block.KeyColumn, fos.written)
+	fos.objects[blockObjectPath] = []byte{}
+	fos.objects[statisticsFilename(blockObjectPath)] = []byte{}
+
+	return blockObjectPath, 0, nil
+}
+
+func (fos *failingObjectStore) deleteObject(ctx context.Context, objectPath string) (err error) {
+	fos.mutex.Lock()
+	defer fos.mutex.Unlock()
+
+	if fos.failDeletes && !strings.Contains(objectPath, "added-") {
+		return errors.New("delete failed")
+	}
+
+	if _, ok := fos.objects[objectPath]; !ok {
+		return errObjectNotFound
+	}
+
+	delete(fos.objects, objectPath)
+	return nil
+}
+
+func (fos *failingObjectStore) GetPartitionFileNames(ctx context.Context, partitionKey string) (partitionFileNames []string, err error) {
+	for _, blockPath := range fos.blockPaths() {
+		if strings.HasPrefix(blockPath, partitionKey+"/") {
+			partitionFileNames = append(partitionFileNames, path.Base(blockPath))
+		}
+	}
+
+	return partitionFileNames, nil
+}
+
+func (fos *failingObjectStore) lockPartition(partitionKey string) (unlock func()) {
+	return fos.rewrites.lock(partitionKey)
+}
+
+func (fos *failingObjectStore) logger() Logger {
+	return LoggerOrDefault(nil)
+}
+
+func (fos *failingObjectStore) blockPaths() (blockPaths []string) {
+	fos.mutex.Lock()
+	defer fos.mutex.Unlock()
+
+	for objectPath := range fos.objects {
+		if strings.HasSuffix(objectPath, ".avro") {
+			blockPaths = append(blockPaths, objectPath)
+		}
+	}
+
+	return blockPaths
+}
+
+func TestReplaceBlocksRollsBack(t *testing.T) {
+	log.Println("Starting TestReplaceBlocksRollsBack")
+
+	added := []*Block{
+		{PartitionKey: "userid1", KeyColumn: "timestamp"},
+		{PartitionKey: "userid1", KeyColumn: "timestamp"},
+	}
+
+	for _, store := range []*failingObjectStore{
+		{failWritesAfter: 1}, // the second added block fails to write
+		{failWritesAfter: 2, failDeletes: true},
+	} {
+		store.objects = map[string][]byte{"userid1/timestamp/removed.avro": {}}
+
+		if err := replaceBlocks(context.Background(), store, nil, "timestamp", "userid1", added, []string{"removed.avro"}); err == nil {
+			t.Errorf("replaceBlocks did not report the failure")
+		}
+
+		blockPaths := store.blockPaths()
+		if len(blockPaths) != 1 || blockPaths[0] != "userid1/timestamp/removed.avro" {
+			t.Errorf("replaceBlocks left the partition holding %v instead of only the removed block", blockPaths)
+		}
+	}
+
+	log.Println("Finished TestReplaceBlocksRollsBack")
+}
+
+func TestReplaceBlocksAlreadyReplaced(t *testing.T) {
+	log.Println("Starting TestReplaceBlocksAlreadyReplaced")
+
+	store := &failingObjectStore{failWritesAfter: 2}
+	store.objects = map[string][]byte{"userid1/timestamp/kept.avro": {}}
+
+	// removed.avro was read by this rewrite but has since been replaced by another
+	added := []*Block{{PartitionKey: "userid1", KeyColumn: "timestamp"}}
+	err := replaceBlocks(context.Background(), store, nil, "timestamp", "userid1", added, []string{"kept.avro", "removed.avro"})
+	if !errors.Is(err, errBlockReplaced) {
+		t.Errorf("replaceBlocks did not fail for a block already replaced: %v", err)
+	}
+
+	blockPaths := store.blockPaths()
+	if len(blockPaths) != 1 || blockPaths[0] != "userid1/timestamp/kept.avro" {
+		t.Errorf("replaceBlocks changed the partition to %v instead of failing", blockPaths)
+	}
+
+	log.Println("Finished TestReplaceBlocksAlreadyReplaced")
+}
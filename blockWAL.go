@@ -0,0 +1,208 @@
+package core
+
+import (
+	"bufio"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	goavro "github.com/linkedin/goavro/v2"
+)
+
+const walFileSuffix = ".wal"
+
+// errRowNotEncodable is returned by Append for a row the codec cannot encode,
+// which no retry will log.
+var errRowNotEncodable = errors.New("row cannot be encoded")
+
+// blockWAL is the write-ahead log for a single uncommitted block. Each row is
+// appended as a uvarint length followed by its Avro binary encoding and synced
+// to disk before the BlockManager moves on to the next row. The file is removed
+// once the block has been durably written by a storage adapter.
+type blockWAL struct {
+	filePath string
+	file     *os.File
+	codec    *goavro.Codec
+	failed   error // set once a partial record could not be cut back off the log
+}
+
+func createBlockWAL(walPath string, partitionKey string, codec *goavro.Codec) (wal *blockWAL, err error) {
+	if err = os.MkdirAll(walPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	walFilename := fmt.Sprintf("%s-%d%s", base32.StdEncoding.EncodeToString([]byte(partitionKey)), time.Now().UnixNano(), walFileSuffix)
+
+	if wal, err = openBlockWAL(filepath.Join(walPath, walFilename), codec); err != nil {
+		return nil, err
+	}
+
+	// without syncing its directory, a crash could lose the log's name even
+	// though its rows were synced
+	if err = syncDir(walPath); err != nil {
+		wal.Remove()
+		return nil, err
+	}
+
+	return wal, nil
+}
+
+// syncDir makes the creation of the files in dirPath durable.
+func syncDir(dirPath string) (err error) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+func openBlockWAL(filePath string, codec *goavro.Codec) (wal *blockWAL, err error) {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blockWAL{
+		filePath: filePath,
+		file:     file,
+		codec:    codec,
+	}, nil
+}
+
+func (w *blockWAL) Append(row interface{}) (err error) {
+	rowBinary, err := w.codec.BinaryFromNative(nil, row)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errRowNotEncodable, err)
+	}
+
+	record := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(rowBinary))
+	record = append(record[:binary.PutUvarint(record, uint64(len(rowBinary)))], rowBinary...)
+
+	if w.failed != nil {
+		return w.failed
+	}
+
+	fileInfo, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := fileInfo.Size()
+
+	if _, err = w.file.Write(record); err == nil {
+		err = w.file.Sync()
+	}
+
+	if err != nil {
+		// a failed append is cut back off the log, so that later rows are not
+		// logged behind a partial record that replay would stop at. The file
+		// is opened O_APPEND, so writes resume at the truncated end.
+		if truncateErr := w.file.Truncate(offset); truncateErr != nil {
+			w.failed = fmt.Errorf("write-ahead log %s holds a partial record: %w", w.filePath, truncateErr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Close stops appends to the log but leaves it on disk.
+func (w *blockWAL) Close() (err error) {
+	if w.file == nil {
+		return nil
+	}
+
+	err = w.file.Close()
+	w.file = nil
+
+	return err
+}
+
+func (w *blockWAL) Remove() (err error) {
+	w.Close()
+
+	return os.Remove(w.filePath)
+}
+
+// walPartitionKey recovers the partition key encoded in a log's filename.
+func walPartitionKey(walFilename string) (partitionKey string, err error) {
+	parts := strings.SplitN(strings.TrimSuffix(walFilename, walFileSuffix), "-", 2)
+
+	partitionKeyBytes, err := base32.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+
+	return string(partitionKeyBytes), nil
+}
+
+// readWALRows decodes every complete row in a log. A record cut short by a
+// crash mid-append is ignored, as it was never acknowledged.
+func readWALRows(filePath string, codec *goavro.Codec, logger Logger) (rows []interface{}, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	rows = []interface{}{}
+
+	for {
+		length, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			logger.Warn("Ignoring truncated write-ahead log record length", "path", filePath, "rows", len(rows))
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		rowBinary := make([]byte, length)
+		if _, err = io.ReadFull(reader, rowBinary); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				logger.Warn("Ignoring truncated write-ahead log record", "path", filePath, "rows", len(rows))
+				return rows, nil
+			}
+			return nil, err
+		}
+
+		row, _, err := codec.NativeFromBinary(rowBinary)
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, row)
+	}
+}
+
+func listWALFiles(walPath string) (walFilenames []string, err error) {
+	fileInfos, err := ioutil.ReadDir(walPath)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	walFilenames = []string{}
+	for _, fileInfo := range fileInfos {
+		if strings.HasSuffix(fileInfo.Name(), walFileSuffix) {
+			walFilenames = append(walFilenames, fileInfo.Name())
+		}
+	}
+
+	return walFilenames, nil
+}
@@ -19,3 +19,73 @@ func TestBlockWrite(t *testing.T) {
 
 	log.Println("Finished TestBlockWrite")
 }
+
+func TestBlockWriteIdentity(t *testing.T) {
+	log.Println("Starting TestBlockWriteIdentity")
+
+	block := NewBlock("userid1", "timestamp", GetCodecFixture())
+	block.IdentityColumns = []string{"user_id", "timestamp"}
+
+	for _, timestamp := range []int64{100, 200, 100} {
+		native := GetNativeFixture().(map[string]interface{})
+		native["timestamp"] = timestamp
+		block.Write(native)
+	}
+
+	if block.Length() != 2 {
+		t.Errorf("Row length after writing duplicate incorrect: %d", block.Length())
+	}
+
+	if block.Statistics.RowCount != 2 {
+		t.Errorf("Statistics row count after writing duplicate incorrect: %d", block.Statistics.RowCount)
+	}
+
+	log.Println("Finished TestBlockWriteIdentity")
+}
+
+func TestBlockKeyRange(t *testing.T) {
+	log.Println("Starting TestBlockKeyRange")
+
+	block := NewBlock("userid1", "timestamp", GetCodecFixture())
+
+	for _, timestamp := range []int64{200, 100, 300} {
+		native := GetNativeFixture().(map[string]interface{})
+		native["timestamp"] = timestamp
+		block.Write(native)
+	}
+
+	if block.StartingKey.(int64) != 100 || block.EndingKey.(int64) != 300 {
+		t.Errorf("Block key range incorrect: %v - %v", block.StartingKey, block.EndingKey)
+	}
+
+	if !filenameIntersectsKeyRange(block.GetFilename(), int64(250), int64(400)) {
+		t.Errorf("Block filename should intersect key range 250 - 400")
+	}
+
+	if filenameIntersectsKeyRange(block.GetFilename(), int64(301), int64(400)) {
+		t.Errorf("Block filename should not intersect key range 301 - 400")
+	}
+
+	// a block loaded back from storage takes its key range from the filename
+	loaded := newLoadedBlock("userid1", "timestamp", block.GetFilename(), GetCodecFixture(), nil)
+	if loaded.StartingKey != int64(100) || loaded.EndingKey != int64(300) {
+		t.Errorf("Loaded block key range incorrect: %v - %v", loaded.StartingKey, loaded.EndingKey)
+	}
+
+	if len(block.RowsForKeyRange(150, 250)) != 1 {
+		t.Errorf("Block returned wrong rows for key range 150 - 250")
+	}
+
+	stringKeyedBlock := NewBlock("userid1", "user_id", GetCodecFixture())
+	for _, userID := range []string{"b", "a", "c"} {
+		native := GetNativeFixture().(map[string]interface{})
+		native["user_id"] = userID
+		stringKeyedBlock.Write(native)
+	}
+
+	if stringKeyedBlock.StartingKey.(string) != "a" || stringKeyedBlock.EndingKey.(string) != "c" {
+		t.Errorf("String keyed block key range incorrect: %v - %v", stringKeyedBlock.StartingKey, stringKeyedBlock.EndingKey)
+	}
+
+	log.Println("Finished TestBlockKeyRange")
+}
@@ -0,0 +1,427 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	goavro "github.com/linkedin/goavro/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultCacheMaxBytes     = 256 * 1024 * 1024
+	defaultCacheDiskMaxBytes = 4 * 1024 * 1024 * 1024
+)
+
+// CachingStorageAdapter wraps another StorageAdapter, serving the blocks its
+// queries read from a least recently used cache of decoded blocks, so that
+// dashboards re-querying the same window neither download nor decode its
+// blocks again. Block filenames embed a hash of their rows, so a cached block
+// never goes stale: a rewritten block has a new name and the old one is no
+// longer listed.
+//
+// With DiskPath set, every block downloaded is also kept there as an Avro OCF,
+// which is cheaper to decode again than to fetch from Azure or S3 once the
+// block has been evicted from memory. Blocks already in DiskPath at Start are
+// kept.
+//
+// Writes, deletes and listings go straight to Adapter, which the
+// CachingStorageAdapter starts and stops, and which must also be a BlockStore,
+// as every storage adapter in this package is. Rows of cached blocks are
+// shared between queries and must not be modified.
+type CachingStorageAdapter struct {
+	Adapter StorageAdapter
+
+	Codec           *goavro.Codec
+	KeyColumn       string
+	IdentityColumns []string // rows sharing these column values are returned once by Query
+
+	MaxBytes     int64  // of cached rows' Avro binary encoding, defaults to 256MB
+	DiskPath     string // directory of the on-disk tier, disabled if empty
+	DiskMaxBytes int64  // of files under DiskPath, defaults to 4GB
+
+	Metrics        Metrics              // defaults to recording nothing
+	Logger         Logger               // defaults to slog.Default()
+	TracerProvider trace.TracerProvider // defaults to the global provider
+
+	store        BlockStore
+	memory       *blockCache
+	disk         *blockCache
+	loading      map[string]*blockLoad
+	loadingMutex sync.Mutex
+}
+
+// blockLoad is a block being fetched, which concurrent queries of the same
+// block wait for rather than fetching it again.
+type blockLoad struct {
+	done  chan struct{}
+	block *Block
+	err   error
+}
+
+// Cache tiers a block can be served from, as recorded in metrics and spans.
+const (
+	cacheTierMemory = "memory"
+	cacheTierDisk   = "disk"
+	cacheTierMiss   = "miss"
+)
+
+func (csa *CachingStorageAdapter) logger() Logger {
+	return LoggerOrDefault(csa.Logger)
+}
+
+func (csa *CachingStorageAdapter) metrics() metricsScope {
+	return metricsScope{metrics: csa.Metrics, labels: MetricLabels{"adapter": "cache"}}
+}
+
+func (csa *CachingStorageAdapter) tracer() trace.Tracer {
+	return tracerFrom(csa.TracerProvider)
+}
+
+func (csa *CachingStorageAdapter) cacheKey(partitionKey string, blockFilename string) string {
+	return blockObjectPath(partitionKey, csa.KeyColumn, blockFilename)
+}
+
+func (csa *CachingStorageAdapter) diskFilePath(key string) string {
+	return filepath.Join(csa.DiskPath, filepath.FromSlash(key))
+}
+
+func (csa *CachingStorageAdapter) recordCacheBytes() {
+	_, memoryBytes := csa.memory.size()
+	csa.metrics().setGauge(MetricCacheBytes, float64(memoryBytes), "tier", cacheTierMemory)
+
+	if csa.disk != nil {
+		_, diskBytes := csa.disk.size()
+		csa.metrics().setGauge(MetricCacheBytes, float64(diskBytes), "tier", cacheTierDisk)
+	}
+}
+
+// blockBytes is the size a block is cached at: the Avro binary size of its
+// rows, which their decoded form exceeds by a roughly constant factor.
+func blockBytes(block *Block) (size int64) {
+	for _, row := range block.Rows {
+		binary, err := block.Codec.BinaryFromNative(nil, row)
+		if err != nil {
+			continue
+		}
+
+		size += int64(len(binary))
+	}
+
+	return size
+}
+
+// indexDisk adds the block files left in DiskPath by an earlier run to the
+// disk tier, least recently written first, evicting any beyond DiskMaxBytes.
+func (csa *CachingStorageAdapter) indexDisk() (err error) {
+	if err = os.MkdirAll(csa.DiskPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	type diskFile struct {
+		key  string
+		info os.FileInfo
+	}
+
+	var files []diskFile
+
+	err = filepath.Walk(csa.DiskPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		// left by a write interrupted before its rename
+		if strings.HasSuffix(filePath, ".tmp") {
+			os.Remove(filePath)
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(csa.DiskPath, filePath)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, diskFile{key: filepath.ToSlash(relativePath), info: info})
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].info.ModTime().Before(files[j].info.ModTime())
+	})
+
+	for _, file := range files {
+		if !csa.disk.add(file.key, nil, file.info.Size()) {
+			csa.removeDiskFile(file.key)
+		}
+	}
+
+	return nil
+}
+
+func (csa *CachingStorageAdapter) removeDiskFile(key string) {
+	if err := os.Remove(csa.diskFilePath(key)); err != nil && !os.IsNotExist(err) {
+		csa.logger().Warn("Removing cached block file failed", "path", csa.diskFilePath(key), "error", err)
+	}
+}
+
+func (csa *CachingStorageAdapter) readDiskBlock(partitionKey string, blockFilename string, key string) (block *Block, err error) {
+	file, err := os.Open(csa.diskFilePath(key))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	block = newLoadedBlock(partitionKey, csa.KeyColumn, blockFilename, csa.Codec, csa.Logger)
+
+	rows := make(chan interface{})
+	readErrors := make(chan error, 1)
+	ReadOCFIntoChannel(file, rows, readErrors, csa.logger())
+
+	for row := range rows {
+		block.Rows = append(block.Rows, row)
+	}
+
+	select {
+	case err = <-readErrors:
+		return nil, err
+	default:
+		return block, nil
+	}
+}
+
+func (csa *CachingStorageAdapter) writeDiskBlock(key string, block *Block) {
+	filePath := csa.diskFilePath(key)
+
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		csa.logger().Warn("Caching block on disk failed", "path", filePath, "error", err)
+		return
+	}
+
+	size, err := writeOCFFile(filePath, block, block.Codec, "")
+	if err != nil {
+		csa.logger().Warn("Caching block on disk failed", "path", filePath, "error", err)
+		return
+	}
+
+	if !csa.disk.add(key, nil, size) {
+		csa.removeDiskFile(key)
+	}
+}
+
+// fetchBlock reads a block missing from memory from the disk tier, if it holds
+// it, or else from Adapter, and caches it.
+func (csa *CachingStorageAdapter) fetchBlock(ctx context.Context, partitionKey string, blockFilename string, key string) (block *Block, tier string, err error) {
+	if csa.disk != nil {
+		if _, ok := csa.disk.get(key); ok {
+			block, err = csa.readDiskBlock(partitionKey, blockFilename, key)
+			if err != nil {
+				csa.logger().Warn("Reading cached block file failed", "path", csa.diskFilePath(key), "error", err)
+				csa.disk.remove(key)
+				csa.removeDiskFile(key)
+			}
+		}
+	}
+
+	if block != nil {
+		tier = cacheTierDisk
+		csa.metrics().addCounter(MetricCacheHits, 1, "tier", cacheTierDisk)
+	} else {
+		block, err = readBlock(ctx, csa.store, partitionKey, blockFilename)
+		if err != nil {
+			return nil, cacheTierMiss, err
+		}
+
+		tier = cacheTierMiss
+		csa.metrics().addCounter(MetricCacheMisses, 1)
+
+		if csa.disk != nil {
+			csa.writeDiskBlock(key, block)
+		}
+	}
+
+	csa.memory.add(key, block, blockBytes(block))
+	csa.recordCacheBytes()
+
+	return block, tier, nil
+}
+
+// loadBlock returns a block from memory or fetches it, sharing the fetch with
+// any concurrent load of the same block.
+func (csa *CachingStorageAdapter) loadBlock(ctx context.Context, partitionKey string, blockFilename string) (block *Block, tier string, err error) {
+	key := csa.cacheKey(partitionKey, blockFilename)
+
+	if block, ok := csa.memory.get(key); ok {
+		csa.metrics().addCounter(MetricCacheHits, 1, "tier", cacheTierMemory)
+		return block, cacheTierMemory, nil
+	}
+
+	csa.loadingMutex.Lock()
+	load, loading := csa.loading[key]
+	if !loading {
+		load = &blockLoad{done: make(chan struct{})}
+		csa.loading[key] = load
+	}
+	csa.loadingMutex.Unlock()
+
+	if loading {
+		select {
+		case <-load.done:
+		case <-ctx.Done():
+			return nil, cacheTierMiss, ctx.Err()
+		}
+
+		// the load may have failed only because its own query was cancelled
+		if load.err == nil {
+			csa.metrics().addCounter(MetricCacheHits, 1, "tier", cacheTierMemory)
+			return load.block, cacheTierMemory, nil
+		}
+
+		return csa.fetchBlock(ctx, partitionKey, blockFilename, key)
+	}
+
+	load.block, tier, load.err = csa.fetchBlock(ctx, partitionKey, blockFilename, key)
+
+	csa.loadingMutex.Lock()
+	delete(csa.loading, key)
+	csa.loadingMutex.Unlock()
+	close(load.done)
+
+	return load.block, tier, load.err
+}
+
+func (csa *CachingStorageAdapter) Load(ctx context.Context, partitionKey string, blockFilename string, blocks chan *Block, errors chan error) {
+	ctx, span := startLoadSpan(ctx, csa.tracer(), "CachingStorageAdapter.Load", partitionKey, blockFilename)
+
+	block, tier, err := csa.loadBlock(ctx, partitionKey, blockFilename)
+	span.SetAttributes(attribute.String(attributeCacheTier, tier))
+
+	if err != nil {
+		endSpan(span, err)
+		errors <- err
+		return
+	}
+
+	span.SetAttributes(attribute.Int(attributeRows, len(block.Rows)))
+	span.End()
+
+	blocks <- block
+}
+
+func (csa *CachingStorageAdapter) LoadStatistics(ctx context.Context, partitionKey string, blockFilename string) (statistics *BlockStatistics, err error) {
+	return csa.store.LoadStatistics(ctx, partitionKey, blockFilename)
+}
+
+func (csa *CachingStorageAdapter) GetPartitionFileNames(ctx context.Context, partitionKey string) (partitionFileNames []string, err error) {
+	return csa.store.GetPartitionFileNames(ctx, partitionKey)
+}
+
+func (csa *CachingStorageAdapter) ListPartitions(ctx context.Context, prefix string) (partitionKeys []string, err error) {
+	return csa.store.ListPartitions(ctx, prefix)
+}
+
+func (csa *CachingStorageAdapter) ReplaceBlocks(ctx context.Context, partitionKey string, added []*Block, removedFilenames []string) (err error) {
+	return csa.store.ReplaceBlocks(ctx, partitionKey, added, removedFilenames)
+}
+
+func (csa *CachingStorageAdapter) Query(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}) (results []interface{}, err error) {
+	return csa.QueryWithOptions(ctx, partitionKey, startKey, endKey, nil)
+}
+
+func (csa *CachingStorageAdapter) QueryWithOptions(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, options *QueryOptions) (results []interface{}, err error) {
+	iter, err := csa.QueryIter(ctx, partitionKey, startKey, endKey, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return collectRows(iter)
+}
+
+func (csa *CachingStorageAdapter) QueryIter(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error) {
+	return csa.QueryPartitionsIter(ctx, []string{partitionKey}, startKey, endKey, options)
+}
+
+func (csa *CachingStorageAdapter) QueryPartitionsIter(ctx context.Context, partitionKeys []string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error) {
+	ctx, span := startQuerySpan(ctx, csa.tracer(), "CachingStorageAdapter.Query", partitionKeys)
+
+	startKey, endKey, err = normalizeKeyRange(csa.Codec, csa.KeyColumn, startKey, endKey)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	return newBlockRowIterator(ctx, csa, partitionKeys, startKey, endKey, options, csa.IdentityColumns, csa.metrics(), span)
+}
+
+func (csa *CachingStorageAdapter) QueryPrefixIter(ctx context.Context, prefix string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error) {
+	partitionKeys, err := csa.ListPartitions(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return csa.QueryPartitionsIter(ctx, partitionKeys, startKey, endKey, options)
+}
+
+// Delete removes rows through Adapter. The blocks it rewrites are renamed, so
+// their cached copies are simply never read again.
+func (csa *CachingStorageAdapter) Delete(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, predicates []Predicate) (removed int64, err error) {
+	return csa.Adapter.Delete(ctx, partitionKey, startKey, endKey, predicates)
+}
+
+func (csa *CachingStorageAdapter) SetInput(input chan *Block, errors chan error) {
+	csa.Adapter.SetInput(input, errors)
+}
+
+func (csa *CachingStorageAdapter) Start(ctx context.Context) (err error) {
+	if csa.Adapter == nil || csa.Codec == nil || len(csa.KeyColumn) == 0 {
+		return errors.New("CachingStorageAdapter not correctly configured with Adapter, Codec and KeyColumn")
+	}
+
+	store, ok := csa.Adapter.(BlockStore)
+	if !ok {
+		return fmt.Errorf("CachingStorageAdapter: %T is not a BlockStore", csa.Adapter)
+	}
+
+	maxBytes := csa.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultCacheMaxBytes
+	}
+
+	csa.store = store
+	csa.memory = newBlockCache(maxBytes, nil)
+	csa.loading = make(map[string]*blockLoad)
+
+	if len(csa.DiskPath) > 0 {
+		diskMaxBytes := csa.DiskMaxBytes
+		if diskMaxBytes == 0 {
+			diskMaxBytes = defaultCacheDiskMaxBytes
+		}
+
+		csa.disk = newBlockCache(diskMaxBytes, csa.removeDiskFile)
+		if err = csa.indexDisk(); err != nil {
+			return err
+		}
+	}
+
+	csa.recordCacheBytes()
+
+	return csa.Adapter.Start(ctx)
+}
+
+func (csa *CachingStorageAdapter) Done() <-chan struct{} {
+	return csa.Adapter.Done()
+}
+
+func (csa *CachingStorageAdapter) Stop(ctx context.Context) (err error) {
+	return csa.Adapter.Stop(ctx)
+}
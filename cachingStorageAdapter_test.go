@@ -0,0 +1,112 @@
+package core
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestBlockCacheEviction(t *testing.T) {
+	log.Println("Starting TestBlockCacheEviction")
+
+	evicted := []string{}
+	cache := newBlockCache(100, func(key string) {
+		evicted = append(evicted, key)
+	})
+
+	cache.add("a", &Block{}, 40)
+	cache.add("b", &Block{}, 40)
+
+	// reading a makes b the least recently used
+	if _, ok := cache.get("a"); !ok {
+		t.Errorf("blockCache missing a")
+	}
+
+	cache.add("c", &Block{}, 40)
+
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Errorf("blockCache evicted %v instead of [b]", evicted)
+	}
+
+	if _, ok := cache.get("b"); ok {
+		t.Errorf("blockCache still holds evicted b")
+	}
+
+	if cache.add("d", &Block{}, 101) {
+		t.Errorf("blockCache added an entry larger than its bound")
+	}
+
+	if entries, bytes := cache.size(); entries != 2 || bytes != 80 {
+		t.Errorf("blockCache holds %d entries of %d bytes instead of 2 of 80", entries, bytes)
+	}
+
+	log.Println("Finished TestBlockCacheEviction")
+}
+
+func TestCachingStorageAdapterQuery(t *testing.T) {
+	log.Println("Starting TestCachingStorageAdapterQuery")
+
+	fixtureMap := GetFixtureMap()
+	beforeTimestamp := fixtureMap["timestamp"].(int64) - 50
+	afterTimestamp := fixtureMap["timestamp"].(int64) + 50
+
+	basePath := "./test/cache-data"
+	diskPath := "./test/cache-disk"
+	os.RemoveAll(basePath)
+	os.RemoveAll(diskPath)
+	defer os.RemoveAll(basePath)
+	defer os.RemoveAll(diskPath)
+
+	input := make(chan *Block)
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath:        basePath,
+		Codec:           GetCodecFixture(),
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+	}
+
+	cachingStorageAdapter := &CachingStorageAdapter{
+		Adapter:   filesystemStorageAdapter,
+		Codec:     filesystemStorageAdapter.Codec,
+		KeyColumn: filesystemStorageAdapter.KeyColumn,
+		DiskPath:  diskPath,
+	}
+
+	cachingStorageAdapter.SetInput(input, nil)
+	if err := cachingStorageAdapter.Start(context.Background()); err != nil {
+		t.Fatalf("cachingStorageAdapter failed to start: %s", err)
+	}
+
+	block := NewBlock(fixtureMap["user_id"].(string), filesystemStorageAdapter.KeyColumn, filesystemStorageAdapter.Codec)
+	block.Write(GetNativeFixture())
+
+	input <- block
+	close(input)
+
+	if err := cachingStorageAdapter.Stop(context.Background()); err != nil {
+		t.Fatalf("cachingStorageAdapter failed to stop: %s", err)
+	}
+
+	for query := 0; query < 2; query++ {
+		results, err := cachingStorageAdapter.Query(context.Background(), fixtureMap["user_id"].(string), beforeTimestamp, afterTimestamp)
+		if err != nil {
+			t.Errorf("cachingStorageAdapter query failed with error: %s", err)
+		}
+
+		if len(results) != 1 {
+			t.Errorf("cachingStorageAdapter query results list wrong length %d vs. 1", len(results))
+		}
+	}
+
+	if entries, _ := cachingStorageAdapter.memory.size(); entries != 1 {
+		t.Errorf("cachingStorageAdapter holds %d blocks in memory instead of 1", entries)
+	}
+
+	diskFilePath := cachingStorageAdapter.diskFilePath(cachingStorageAdapter.cacheKey(block.PartitionKey, block.GetFilename()))
+	if _, err := os.Stat(diskFilePath); err != nil {
+		t.Errorf("cachingStorageAdapter did not keep block on disk: %s", err)
+	}
+
+	log.Println("Finished TestCachingStorageAdapterQuery")
+}
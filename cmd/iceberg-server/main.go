@@ -0,0 +1,124 @@
+// Command iceberg-server serves queries over a storage adapter's blocks via
+// HTTP so that readers need neither the adapter nor its credentials.
+//
+// Credentials for the azure and s3 adapters are read from the environment:
+// ICEBERG_STORAGE_ACCOUNT and ICEBERG_STORAGE_KEY, or
+// ICEBERG_S3_ENDPOINT, ICEBERG_S3_ACCESS_KEY and ICEBERG_S3_SECRET_KEY.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	goavro "github.com/linkedin/goavro/v2"
+	core "github.com/timfpark/iceberg-core"
+	"github.com/timfpark/iceberg-core/server"
+)
+
+func newAdapter(adapterType string, location string, codec *goavro.Codec, partitionColumn string, keyColumn string, metrics core.Metrics) (adapter core.StorageAdapter, err error) {
+	switch adapterType {
+	case "filesystem":
+		return &core.FilesystemStorageAdapter{
+			BasePath:        location,
+			Codec:           codec,
+			PartitionColumn: partitionColumn,
+			KeyColumn:       keyColumn,
+			Metrics:         metrics,
+		}, nil
+	case "azure":
+		return &core.AzureStorageAdapter{
+			StorageAccount:  os.Getenv("ICEBERG_STORAGE_ACCOUNT"),
+			AccessKey:       os.Getenv("ICEBERG_STORAGE_KEY"),
+			Container:       location,
+			Codec:           codec,
+			PartitionColumn: partitionColumn,
+			KeyColumn:       keyColumn,
+			Metrics:         metrics,
+		}, nil
+	case "s3":
+		return &core.S3StorageAdapter{
+			Endpoint:        os.Getenv("ICEBERG_S3_ENDPOINT"),
+			AccessKeyID:     os.Getenv("ICEBERG_S3_ACCESS_KEY"),
+			SecretAccessKey: os.Getenv("ICEBERG_S3_SECRET_KEY"),
+			Bucket:          location,
+			UseSSL:          true,
+			Codec:           codec,
+			PartitionColumn: partitionColumn,
+			KeyColumn:       keyColumn,
+			Metrics:         metrics,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown adapter %s", adapterType)
+}
+
+func main() {
+	address := flag.String("address", ":8080", "address to listen on")
+	adapterType := flag.String("adapter", "filesystem", "storage adapter: filesystem, azure or s3")
+	location := flag.String("location", "./data", "base path, container or bucket holding the blocks")
+	schemaPath := flag.String("schema", "", "path to the Avro schema of the rows")
+	partitionColumn := flag.String("partition-column", "", "column the rows are partitioned on")
+	keyColumn := flag.String("key-column", "", "column the rows are keyed on")
+	flag.Parse()
+
+	schema, err := ioutil.ReadFile(*schemaPath)
+	if err != nil {
+		log.Fatalf("Reading schema %s failed with %s\n", *schemaPath, err)
+	}
+
+	codec, err := goavro.NewCodec(string(schema))
+	if err != nil {
+		log.Fatalf("Parsing schema %s failed with %s\n", *schemaPath, err)
+	}
+
+	metrics := &core.PrometheusMetrics{}
+
+	adapter, err := newAdapter(*adapterType, *location, codec, *partitionColumn, *keyColumn, metrics)
+	if err != nil {
+		log.Fatalf("Creating adapter failed with %s\n", err)
+	}
+
+	// the server writes no blocks, so input is only closed to stop the adapter
+	input := make(chan *core.Block)
+	adapter.SetInput(input, nil)
+
+	if err = adapter.Start(context.Background()); err != nil {
+		log.Fatalf("Starting adapter failed with %s\n", err)
+	}
+
+	queryServer := &server.Server{
+		Address:   *address,
+		Adapter:   adapter,
+		Codec:     codec,
+		KeyColumn: *keyColumn,
+		Metrics:   metrics,
+	}
+
+	if err = queryServer.Start(); err != nil {
+		log.Fatalf("Starting server failed with %s\n", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	if err = queryServer.Stop(ctx); err != nil {
+		log.Printf("Stopping server failed with %s\n", err)
+	}
+
+	close(input)
+
+	if err = adapter.Stop(ctx); err != nil {
+		log.Printf("Stopping adapter failed with %s\n", err)
+	}
+}
@@ -0,0 +1,229 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	goavro "github.com/linkedin/goavro/v2"
+)
+
+// Compactor merges runs of adjacent small blocks in a partition into blocks
+// of TargetSize rows, so that partitions flushed on MaxAge by a quiet stream
+// do not leave Query opening hundreds of tiny files.
+type Compactor struct {
+	Store     BlockStore
+	Codec     *goavro.Codec
+	KeyColumn string
+
+	// IdentityColumns, if set, drop rows duplicating another row's identity
+	// from the blocks being merged. Blocks already at TargetSize are not
+	// merged, so duplicates held in them are left to Query to remove.
+	IdentityColumns []string
+
+	TargetSize      int    // in rows, blocks with fewer rows are merged
+	Interval        uint32 // between compaction passes in milliseconds, periodic passes are disabled if zero
+	PartitionPrefix string // limits periodic passes to partitions starting with this prefix
+
+	Logger Logger // defaults to slog.Default()
+
+	periodicRunner
+}
+
+type compactionCandidate struct {
+	filename    string
+	startingKey interface{}
+	rowCount    int
+}
+
+func (c *Compactor) blockRowCount(ctx context.Context, partitionKey string, blockFilename string) (rowCount int, err error) {
+	if statistics, err := c.Store.LoadStatistics(ctx, partitionKey, blockFilename); err == nil {
+		return int(statistics.RowCount), nil
+	}
+
+	// blocks written before statistics existed are counted by reading them
+	block, err := readBlock(ctx, c.Store, partitionKey, blockFilename)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(block.Rows), nil
+}
+
+// CompactPartition merges the small blocks of a partition, returning the
+// number of blocks replaced.
+func (c *Compactor) CompactPartition(ctx context.Context, partitionKey string) (compacted int, err error) {
+	if c.TargetSize <= 1 {
+		return 0, errors.New("Compactor not correctly configured with TargetSize")
+	}
+
+	keyType, err := KeyTypeFromCodec(c.Codec, c.KeyColumn)
+	if err != nil {
+		return 0, err
+	}
+
+	partitionFileNames, err := c.Store.GetPartitionFileNames(ctx, partitionKey)
+	if err != nil {
+		return 0, err
+	}
+
+	candidates := make([]*compactionCandidate, 0, len(partitionFileNames))
+	for _, blockFilename := range partitionFileNames {
+		startingKey, _, err := parseBlockFilenameKeyRange(blockFilename, keyType.template())
+		if err != nil {
+			return compacted, err
+		}
+
+		rowCount, err := c.blockRowCount(ctx, partitionKey, blockFilename)
+		if err != nil {
+			return compacted, err
+		}
+
+		candidates = append(candidates, &compactionCandidate{
+			filename:    blockFilename,
+			startingKey: startingKey,
+			rowCount:    rowCount,
+		})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return compareKeys(candidates[i].startingKey, candidates[j].startingKey) < 0
+	})
+
+	var run []*compactionCandidate
+	runRows := 0
+
+	flushRun := func() error {
+		defer func() {
+			run = nil
+			runRows = 0
+		}()
+
+		if len(run) < 2 {
+			return nil
+		}
+
+		if err := c.mergeBlocks(ctx, partitionKey, run); err != nil {
+			return err
+		}
+
+		compacted += len(run)
+		return nil
+	}
+
+	for _, candidate := range candidates {
+		// a block at or above the target size separates runs of small blocks
+		if candidate.rowCount >= c.TargetSize {
+			if err = flushRun(); err != nil {
+				return compacted, err
+			}
+			continue
+		}
+
+		run = append(run, candidate)
+		runRows += candidate.rowCount
+
+		if runRows >= c.TargetSize {
+			if err = flushRun(); err != nil {
+				return compacted, err
+			}
+		}
+	}
+
+	return compacted, flushRun()
+}
+
+func (c *Compactor) mergeBlocks(ctx context.Context, partitionKey string, run []*compactionCandidate) (err error) {
+	merged := NewBlock(partitionKey, c.KeyColumn, c.Codec)
+	merged.IdentityColumns = c.IdentityColumns
+	merged.Logger = c.Logger
+	removedFilenames := make([]string, 0, len(run))
+
+	for _, candidate := range run {
+		block, err := readBlock(ctx, c.Store, partitionKey, candidate.filename)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range block.Rows {
+			merged.Write(row)
+		}
+		removedFilenames = append(removedFilenames, candidate.filename)
+	}
+
+	sort.SliceStable(merged.Rows, func(i, j int) bool {
+		iKey, _ := merged.rowKey(merged.Rows[i])
+		jKey, _ := merged.rowKey(merged.Rows[j])
+		return compareKeys(iKey, jKey) < 0
+	})
+
+	added := []*Block{}
+	for start := 0; start < len(merged.Rows); start += c.TargetSize {
+		end := start + c.TargetSize
+		if end > len(merged.Rows) {
+			end = len(merged.Rows)
+		}
+
+		block := NewBlock(partitionKey, c.KeyColumn, c.Codec)
+		block.Logger = c.Logger
+		for _, row := range merged.Rows[start:end] {
+			block.Write(row)
+		}
+
+		added = append(added, block)
+	}
+
+	c.logger().Info("Compacting blocks", "partition_key", partitionKey, "blocks", len(run), "rows", len(merged.Rows), "compacted_blocks", len(added))
+
+	return c.Store.ReplaceBlocks(ctx, partitionKey, added, removedFilenames)
+}
+
+func (c *Compactor) logger() Logger {
+	return LoggerOrDefault(c.Logger)
+}
+
+// Compact runs a compaction pass over every partition starting with
+// PartitionPrefix, stopping early if ctx ends.
+func (c *Compactor) Compact(ctx context.Context) (err error) {
+	return forEachPartition(ctx, c.Store, c.PartitionPrefix, c.logger(), "Compacting partition failed", func(ctx context.Context, partitionKey string) error {
+		_, err := c.CompactPartition(ctx, partitionKey)
+		return err
+	})
+}
+
+// Start validates the configuration and, if Interval is set, runs a pass
+// every Interval until Stop is called or ctx ends, which also stops a pass.
+func (c *Compactor) Start(ctx context.Context) (err error) {
+	if c.Store == nil {
+		return errors.New("Compactor not correctly configured with Store")
+	}
+
+	if c.TargetSize <= 1 {
+		return errors.New("Compactor not correctly configured with TargetSize")
+	}
+
+	if c.Interval == 0 {
+		return nil
+	}
+
+	c.startPasses(ctx, time.Duration(c.Interval)*time.Millisecond, func(ctx context.Context) {
+		c.Compact(ctx)
+	})
+
+	return nil
+}
+
+// Stop ends periodic passes, waiting for a running pass to finish until ctx
+// ends, when the pass is cancelled and ctx's error returned. No pass runs once
+// Stop has returned.
+func (c *Compactor) Stop(ctx context.Context) (err error) {
+	c.logger().Info("Stopping Compactor")
+
+	if err = c.stopPasses(ctx); err != nil {
+		return fmt.Errorf("Compactor: compaction pass did not finish: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingBlockStore holds a pass in ListPartitions until the pass's ctx ends.
+type blockingBlockStore struct {
+	BlockStore
+	listing  chan struct{}
+	returned int32
+}
+
+func (bbs *blockingBlockStore) ListPartitions(ctx context.Context, prefix string) (partitionKeys []string, err error) {
+	select {
+	case bbs.listing <- struct{}{}:
+	default:
+	}
+
+	<-ctx.Done()
+	atomic.StoreInt32(&bbs.returned, 1)
+
+	return nil, ctx.Err()
+}
+
+func TestCompactorCompactPartition(t *testing.T) {
+	log.Println("Starting TestCompactorCompactPartition")
+
+	basePath := "./test/compaction"
+	os.RemoveAll(basePath)
+	defer os.RemoveAll(basePath)
+
+	partitionKey := "userid-compaction"
+	input := make(chan *Block)
+
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath:        basePath,
+		Codec:           GetCodecFixture(),
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		CompressionName: "snappy",
+		Input:           input,
+	}
+
+	if err := filesystemStorageAdapter.Start(context.Background()); err != nil {
+		t.Errorf("filesystemStorageAdapter failed to start: %s", err)
+	}
+
+	// three small blocks, written newest first
+	for _, timestamp := range []int64{300, 200, 100} {
+		block := NewBlock(partitionKey, filesystemStorageAdapter.KeyColumn, filesystemStorageAdapter.Codec)
+		native := GetNativeFixture().(map[string]interface{})
+		native["user_id"] = partitionKey
+		native["timestamp"] = timestamp
+		block.Write(native)
+
+		input <- block
+	}
+	close(input)
+
+	filesystemStorageAdapter.Stop(context.Background())
+
+	compactor := &Compactor{
+		Store:      filesystemStorageAdapter,
+		Codec:      filesystemStorageAdapter.Codec,
+		KeyColumn:  filesystemStorageAdapter.KeyColumn,
+		TargetSize: 10,
+	}
+
+	partitionKeys, err := filesystemStorageAdapter.ListPartitions(context.Background(), "")
+	if err != nil {
+		t.Errorf("ListPartitions failed with error: %s", err)
+	}
+
+	if len(partitionKeys) != 1 || partitionKeys[0] != partitionKey {
+		t.Errorf("ListPartitions returned wrong partitions: %v", partitionKeys)
+	}
+
+	compacted, err := compactor.CompactPartition(context.Background(), partitionKey)
+	if err != nil {
+		t.Errorf("CompactPartition failed with error: %s", err)
+	}
+
+	if compacted != 3 {
+		t.Errorf("CompactPartition replaced wrong number of blocks: %d", compacted)
+	}
+
+	partitionFileNames, err := filesystemStorageAdapter.GetPartitionFileNames(context.Background(), partitionKey)
+	if err != nil {
+		t.Errorf("GetPartitionFileNames failed with error: %s", err)
+	}
+
+	if len(partitionFileNames) != 1 {
+		t.Errorf("compacted partition has wrong number of blocks: %d", len(partitionFileNames))
+	}
+
+	results, err := filesystemStorageAdapter.Query(context.Background(), partitionKey, int64(0), int64(1000))
+	if err != nil {
+		t.Errorf("filesystemStorageAdapter query failed with error: %s", err)
+	}
+
+	if len(results) != 3 {
+		t.Errorf("compacted partition query returned wrong number of rows: %d", len(results))
+	}
+
+	log.Println("Finished TestCompactorCompactPartition")
+}
+
+func TestCompactorStopDeadline(t *testing.T) {
+	log.Println("Starting TestCompactorStopDeadline")
+
+	store := &blockingBlockStore{listing: make(chan struct{}, 1)}
+
+	compactor := &Compactor{
+		Store:      store,
+		Codec:      GetCodecFixture(),
+		KeyColumn:  "timestamp",
+		TargetSize: 10,
+		Interval:   10, // milliseconds
+	}
+
+	if err := compactor.Start(context.Background()); err != nil {
+		t.Fatalf("Compactor failed to start: %s", err)
+	}
+
+	select {
+	case <-store.listing:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Compactor did not start a pass")
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- compactor.Stop(stopCtx) }()
+
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Compactor stop returned wrong error for a stuck pass: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Compactor stop did not return once its deadline passed")
+	}
+
+	if atomic.LoadInt32(&store.returned) != 1 {
+		t.Errorf("Compactor stop returned before cancelling the running pass")
+	}
+
+	log.Println("Finished TestCompactorStopDeadline")
+}
@@ -1,11 +1,11 @@
 package core
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"os"
 
-	goavro "gopkg.in/linkedin/goavro.v2"
+	goavro "github.com/linkedin/goavro/v2"
 )
 
 type FileStreamAdapter struct {
@@ -15,6 +15,10 @@ type FileStreamAdapter struct {
 
 	Output chan interface{}
 	Errors chan error
+	Logger Logger // defaults to slog.Default()
+
+	stop chan bool
+	done chan struct{}
 }
 
 func (fsa *FileStreamAdapter) removeTypeMaps(native interface{}) (flattened map[string]interface{}) {
@@ -31,25 +35,99 @@ func (fsa *FileStreamAdapter) removeTypeMaps(native interface{}) (flattened map[
 		case nil:
 			flattened[key] = nil
 		default:
-			fmt.Printf("unsupported type: %T\n", t)
+			fsa.logger().Warn("Dropping column of unsupported type", "column", key, "type", fmt.Sprintf("%T", t))
 		}
 	}
 
 	return flattened
 }
 
-func (fsa *FileStreamAdapter) Start() (err error) {
+func (fsa *FileStreamAdapter) logger() Logger {
+	return LoggerOrDefault(fsa.Logger)
+}
+
+func (fsa *FileStreamAdapter) SetOutput(output chan interface{}, errors chan error) {
+	fsa.Output = output
+	fsa.Errors = errors
+}
+
+func (fsa *FileStreamAdapter) Start(ctx context.Context) (err error) {
 	file, err := os.Open(fsa.FilePath)
 	if err != nil {
-		log.Printf("FileStreamAdapter.Start failed with %s\n", err)
+		fsa.logger().Error("FileStreamAdapter failed to start", "path", fsa.FilePath, "error", err)
 		return err
 	}
 
-	ReadOCFIntoChannel(file, fsa.Output, fsa.Errors)
+	ocf, err := goavro.NewOCFReader(file)
+	if err != nil {
+		fsa.logger().Error("FileStreamAdapter failed to start", "path", fsa.FilePath, "error", err)
+		file.Close()
+		return err
+	}
+
+	stop := make(chan bool)
+	done := make(chan struct{})
+	fsa.stop = stop
+	fsa.done = done
+
+	go func() {
+		defer close(done)
+		defer file.Close()
+		defer close(fsa.Output)
+
+		rows := 0
+		for ocf.Scan() {
+			native, err := ocf.Read()
+			if err != nil {
+				break
+			}
+
+			select {
+			case fsa.Output <- native:
+				rows++
+			case <-stop:
+				fsa.logger().Info("FileStreamAdapter stopped before end of file", "path", fsa.FilePath, "rows", rows)
+				return
+			case <-ctx.Done():
+				fsa.logger().Info("FileStreamAdapter cancelled before end of file", "path", fsa.FilePath, "rows", rows)
+				return
+			}
+		}
+
+		// a truncated or corrupt block stops Scan as the end of the file does
+		if err := ocf.Err(); err != nil {
+			fsa.logger().Error("Reading OCF failed", "path", fsa.FilePath, "rows", rows, "error", err)
+			if fsa.Errors != nil {
+				fsa.Errors <- err
+			}
+			return
+		}
+
+		fsa.logger().Info("FileStreamAdapter finished reading", "path", fsa.FilePath, "rows", rows)
+	}()
 
 	return nil
 }
 
-func (fsa *FileStreamAdapter) Stop() (err error) {
-	return nil
+// Done is closed once the file has been read, or reading has stopped, and
+// Output has been closed.
+func (fsa *FileStreamAdapter) Done() <-chan struct{} {
+	return fsa.done
+}
+
+// Stop ends reading early and waits for Output to be closed.
+func (fsa *FileStreamAdapter) Stop(ctx context.Context) (err error) {
+	if fsa.stop == nil {
+		return nil
+	}
+
+	close(fsa.stop)
+	fsa.stop = nil
+
+	select {
+	case <-fsa.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
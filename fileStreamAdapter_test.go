@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"log"
 	"testing"
 )
@@ -16,7 +17,7 @@ func TestFileStreamAdapter(t *testing.T) {
 		Output:   output,
 	}
 
-	err := fileStreamAdapter.Start()
+	err := fileStreamAdapter.Start(context.Background())
 	if err != nil {
 		t.Errorf("fileStreamAdapter failed to start: %s", err)
 	}
@@ -35,7 +36,7 @@ func TestFileStreamAdapter(t *testing.T) {
 		t.Errorf("row count was not correct: %d vs. 1", rowCount)
 	}
 
-	fileStreamAdapter.Stop()
+	fileStreamAdapter.Stop(context.Background())
 
 	log.Println("Finishing TestFileStreamAdapter")
 }
@@ -1,34 +1,80 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
 	"os"
-	"strconv"
-	"time"
+	"path"
+	"path/filepath"
+	"strings"
 
-	goavro "gopkg.in/linkedin/goavro.v2"
+	goavro "github.com/linkedin/goavro/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type FilesystemStorageAdapter struct {
 	BasePath        string
 	Codec           *goavro.Codec
 	PartitionColumn string
+	PartitionSpec   *PartitionSpec // partitioning used by the BlockManager, defaults to identity on PartitionColumn
 	KeyColumn       string
+	IdentityColumns []string // rows sharing these column values are returned once by Query
 	CompressionName string
+	IcebergMetadata bool // maintain Iceberg table metadata under BasePath/metadata
 	Input           chan *Block
-	running         bool
+	Retry           *RetryPolicy         // defaults to 5 attempts backing off from 1s, with no dead letter directory
+	Errors          chan error           // reports blocks that could not be written; must be read if set
+	Metrics         Metrics              // defaults to recording nothing
+	Logger          Logger               // defaults to slog.Default()
+	TracerProvider  trace.TracerProvider // defaults to the global provider
+
+	table    *icebergTable
+	rewrites partitionLocks // serializes ReplaceBlocks per partition
+	done     chan struct{}
 }
 
 func (fsa *FilesystemStorageAdapter) getPartitionKeyPath(partitionKey string, keyColumn string) string {
 	return fmt.Sprintf("%s/%s/%s", fsa.BasePath, partitionKey, keyColumn)
 }
 
-func (fsa *FilesystemStorageAdapter) writeBlockFile(block *Block) (err error) {
-	log.Printf("Writing block PartitionKey: %s StartingKey: %d EndingKey: %d with %d rows\n", block.PartitionKey, block.StartingKey, block.EndingKey, len(block.Rows))
+func (fsa *FilesystemStorageAdapter) logger() Logger {
+	return LoggerOrDefault(fsa.Logger)
+}
+
+func (fsa *FilesystemStorageAdapter) metrics() metricsScope {
+	return metricsScope{metrics: fsa.Metrics, labels: MetricLabels{"adapter": "filesystem"}}
+}
+
+func (fsa *FilesystemStorageAdapter) tracer() trace.Tracer {
+	return tracerFrom(fsa.TracerProvider)
+}
+
+func (fsa *FilesystemStorageAdapter) writeBlockFile(ctx context.Context, block *Block) (err error) {
+	_, span := fsa.tracer().Start(block.traceContext(ctx), "FilesystemStorageAdapter.writeBlockFile", blockSpanAttributes(block))
+	defer func() { endSpan(span, err) }()
+
+	objectPath, blockFileSize, err := fsa.writeBlockObject(ctx, block)
+	if err != nil {
+		return err
+	}
+
+	fsa.metrics().addCounter(MetricBytesWritten, float64(blockFileSize))
+	span.SetAttributes(attribute.String(attributeBlock, path.Base(objectPath)), attribute.Int64(attributeBytes, blockFileSize))
+
+	if fsa.table != nil {
+		return fsa.table.appendBlock(ctx, block, objectPath, blockFileSize)
+	}
+
+	return nil
+}
+
+// writeBlockObject writes a block and its statistics, returning the block's
+// path relative to BasePath and its size.
+func (fsa *FilesystemStorageAdapter) writeBlockObject(ctx context.Context, block *Block) (objectPath string, blockFileSize int64, err error) {
+	fsa.logger().Info("Writing block", blockLogArgs(block)...)
 
 	partitionPath := fsa.getPartitionKeyPath(block.PartitionKey, block.KeyColumn)
 	blockFilename := block.GetFilename()
@@ -36,148 +82,315 @@ func (fsa *FilesystemStorageAdapter) writeBlockFile(block *Block) (err error) {
 
 	os.MkdirAll(partitionPath, os.ModePerm)
 
-	toFile, err := os.Create(blockFilePath)
+	blockFileSize, err = writeOCFFile(blockFilePath, block, fsa.Codec, fsa.CompressionName)
+	if err != nil {
+		return "", 0, err
+	}
+
+	objectPath = blockObjectPath(block.PartitionKey, block.KeyColumn, blockFilename)
+
+	if err = fsa.writeStatistics(ctx, block, objectPath); err != nil {
+		return "", 0, err
+	}
+
+	return objectPath, blockFileSize, nil
+}
+
+func (fsa *FilesystemStorageAdapter) writeStatistics(ctx context.Context, block *Block, objectPath string) (err error) {
+	if block.Statistics == nil {
+		return nil
+	}
+
+	statisticsBytes, err := block.Statistics.Marshal()
 	if err != nil {
 		return err
 	}
 
-	defer func(ioc io.Closer) {
-		if err := ioc.Close(); err != nil {
-			log.Printf("closing file failed with %s", err)
-		}
-	}(toFile)
+	return fsa.writeObject(ctx, statisticsFilename(objectPath), statisticsBytes)
+}
 
-	ocfWriter, err := goavro.NewOCFWriter(goavro.OCFConfig{
-		W:               toFile,
-		CompressionName: fsa.CompressionName,
-		Schema:          fsa.Codec.Schema(),
-	})
+func (fsa *FilesystemStorageAdapter) readObject(ctx context.Context, objectPath string) (data []byte, err error) {
+	data, err = ioutil.ReadFile(fmt.Sprintf("%s/%s", fsa.BasePath, objectPath))
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+
+	return data, err
+}
+
+func (fsa *FilesystemStorageAdapter) writeObject(ctx context.Context, objectPath string, data []byte) (err error) {
+	filePath := fmt.Sprintf("%s/%s", fsa.BasePath, objectPath)
+	os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+
+	// write then rename so that readers never see a partially written object
+	tempFilePath := filePath + ".tmp"
+	if err = ioutil.WriteFile(tempFilePath, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFilePath, filePath)
+}
 
+func (fsa *FilesystemStorageAdapter) deleteObject(ctx context.Context, objectPath string) (err error) {
+	err = os.Remove(fmt.Sprintf("%s/%s", fsa.BasePath, objectPath))
+	if os.IsNotExist(err) {
+		return errObjectNotFound
+	}
 	if err != nil {
 		return err
 	}
 
-	return ocfWriter.Append(block.Rows)
+	// prune directories left empty, as object stores have no empty prefixes;
+	// os.Remove fails on the first directory that still has entries
+	for dir := path.Dir(objectPath); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if os.Remove(fmt.Sprintf("%s/%s", fsa.BasePath, dir)) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (fsa *FilesystemStorageAdapter) objectURI(objectPath string) string {
+	basePath, err := filepath.Abs(fsa.BasePath)
+	if err != nil {
+		basePath = fsa.BasePath
+	}
+
+	return "file://" + path.Join(filepath.ToSlash(basePath), objectPath)
 }
 
-func (fsa *FilesystemStorageAdapter) processBlocks() {
+func (fsa *FilesystemStorageAdapter) processBlocks(ctx context.Context, done chan struct{}) {
 	go func() {
+		defer close(done)
+
 		for {
-			block, more := <-fsa.Input
+			var block *Block
+			var more bool
 
-			if !more {
-				fsa.running = false
-				break
+			select {
+			case block, more = <-fsa.Input:
+			case <-ctx.Done():
+				fsa.logger().Info("FilesystemStorageAdapter stopped taking blocks", "error", ctx.Err())
+				return
 			}
 
-			if err := fsa.writeBlockFile(block); err != nil {
-				log.Printf("Writing block PartitionKey: %s StartingKey: %d EndingKey: %d failed with %s. Retrying write.\n", block.PartitionKey, block.StartingKey, block.EndingKey, err)
-
-				fsa.Input <- block
+			if !more {
 				return
 			}
+
+			if err := fsa.Retry.writeBlock(ctx, block, fsa.writeBlockFile, fsa.metrics(), fsa.logger()); err != nil {
+				reportStorageError(ctx, fsa.logger(), fsa.Errors, err)
+			}
 		}
 	}()
 }
 
-func convertBlockKeyToType(key interface{}, blockKeyString string) (convertedKey interface{}, err error) {
-	switch t := key.(type) {
-	case int64:
-		convertedKey, err = strconv.ParseInt(blockKeyString, 10, 64)
-	case string:
-		convertedKey = blockKeyString
-	default:
-		fmt.Printf("unsupported type: %T", t)
-	}
+func (fsa *FilesystemStorageAdapter) Load(ctx context.Context, partitionKey string, blockFilename string, blocks chan *Block, errors chan error) {
+	_, span := startLoadSpan(ctx, fsa.tracer(), "FilesystemStorageAdapter.Load", partitionKey, blockFilename)
 
-	return
-}
+	if err := ctx.Err(); err != nil {
+		endSpan(span, err)
+		errors <- err
+		return
+	}
 
-func (fsa *FilesystemStorageAdapter) Load(partitionKey string, blockFilename string, blocks chan *Block, errors chan error) {
 	partitionPath := fsa.getPartitionKeyPath(partitionKey, fsa.KeyColumn)
 	blockFilePath := fmt.Sprintf("%s/%s", partitionPath, blockFilename)
 
 	file, err := os.Open(blockFilePath)
 	if err != nil {
+		endSpan(span, err)
 		errors <- err
 		return
 	}
+	defer file.Close()
 
-	block := &Block{
-		Codec:        fsa.Codec,
-		Rows:         []interface{}{},
-		PartitionKey: partitionKey,
-		KeyColumn:    fsa.KeyColumn,
-	}
+	block := newLoadedBlock(partitionKey, fsa.KeyColumn, blockFilename, fsa.Codec, fsa.Logger)
 
 	rows := make(chan interface{})
-	ReadOCFIntoChannel(file, rows, errors)
+	readErrors := make(chan error, 1)
+	ReadOCFIntoChannel(file, rows, readErrors, fsa.logger())
 
 	for {
 		row, more := <-rows
 		if !more {
 			break
 		}
-		block.Write(row)
+		block.Rows = append(block.Rows, row)
+	}
+
+	select {
+	case err := <-readErrors:
+		endSpan(span, err)
+		errors <- err
+		return
+	default:
 	}
 
+	span.SetAttributes(attribute.Int(attributeRows, len(block.Rows)))
+	span.End()
+
 	blocks <- block
+}
 
+func (fsa *FilesystemStorageAdapter) LoadStatistics(ctx context.Context, partitionKey string, blockFilename string) (statistics *BlockStatistics, err error) {
+	statisticsObjectPath := fmt.Sprintf("%s/%s/%s", partitionKey, fsa.KeyColumn, statisticsFilename(blockFilename))
+
+	statisticsBytes, err := fsa.readObject(ctx, statisticsObjectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return UnmarshalBlockStatistics(statisticsBytes, fsa.Codec)
 }
 
-func (fsa *FilesystemStorageAdapter) Query(partitionKey string, startKey interface{}, endKey interface{}) (results []interface{}, err error) {
+func (fsa *FilesystemStorageAdapter) GetPartitionFileNames(ctx context.Context, partitionKey string) (partitionFileNames []string, err error) {
 	partitionPath := fsa.getPartitionKeyPath(partitionKey, fsa.KeyColumn)
 
 	partitionFileInfos, err := ioutil.ReadDir(partitionPath)
+	if os.IsNotExist(err) {
+		// as with object stores, a partition with no blocks lists nothing
+		return []string{}, nil
+	}
 	if err != nil {
 		errorText := fmt.Sprintf("Partition path %s not found", partitionPath)
-		err = errors.New(errorText)
-		return
+		return nil, errors.New(errorText)
 	}
 
-	blockFilenames := make([]string, 0)
+	partitionFileNames = make([]string, 0)
 	for _, blockFileInfo := range partitionFileInfos {
-		blockFilenames = append(blockFilenames, blockFileInfo.Name())
+		if isBlockFilename(blockFileInfo.Name()) {
+			partitionFileNames = append(partitionFileNames, blockFileInfo.Name())
+		}
 	}
 
-	intersectingBlockFilenames := IntersectingBlockFilenames(blockFilenames, startKey, endKey)
+	return partitionFileNames, nil
+}
+
+// ListPartitions returns the partition keys under BasePath that start with
+// prefix. A directory is a partition if it holds a KeyColumn directory.
+func (fsa *FilesystemStorageAdapter) ListPartitions(ctx context.Context, prefix string) (partitionKeys []string, err error) {
+	partitionKeys = []string{}
 
-	blocks := make(chan *Block)
-	errors := make(chan error)
+	err = filepath.Walk(fsa.BasePath, func(walkPath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
 
-	results = make([]interface{}, 0)
-	for _, intersectingBlockFilename := range intersectingBlockFilenames {
-		go fsa.Load(partitionKey, intersectingBlockFilename, blocks, errors)
-	}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		if !fileInfo.IsDir() || fileInfo.Name() != fsa.KeyColumn || walkPath == fsa.BasePath {
+			return nil
+		}
+
+		partitionPath, err := filepath.Rel(fsa.BasePath, filepath.Dir(walkPath))
+		if err != nil {
+			return err
+		}
 
-	for i := 0; i < len(intersectingBlockFilenames); i++ {
-		select {
-		case block := <-blocks:
-			filteredRows := block.RowsForKeyRange(startKey, endKey)
-			results = append(results, filteredRows)
-		case err = <-errors:
+		partitionKey := filepath.ToSlash(partitionPath)
+		if partitionKey != "." && strings.HasPrefix(partitionKey, prefix) {
+			partitionKeys = append(partitionKeys, partitionKey)
 		}
+
+		return filepath.SkipDir
+	})
+
+	return partitionKeys, err
+}
+
+func (fsa *FilesystemStorageAdapter) lockPartition(partitionKey string) (unlock func()) {
+	return fsa.rewrites.lock(partitionKey)
+}
+
+func (fsa *FilesystemStorageAdapter) ReplaceBlocks(ctx context.Context, partitionKey string, added []*Block, removedFilenames []string) (err error) {
+	return replaceBlocks(ctx, fsa, fsa.table, fsa.KeyColumn, partitionKey, added, removedFilenames)
+}
+
+func (fsa *FilesystemStorageAdapter) Query(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}) (results []interface{}, err error) {
+	return fsa.QueryWithOptions(ctx, partitionKey, startKey, endKey, nil)
+}
+
+func (fsa *FilesystemStorageAdapter) QueryWithOptions(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, options *QueryOptions) (results []interface{}, err error) {
+	iter, err := fsa.QueryIter(ctx, partitionKey, startKey, endKey, options)
+	if err != nil {
+		return nil, err
 	}
 
-	return
+	return collectRows(iter)
+}
+
+func (fsa *FilesystemStorageAdapter) QueryIter(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error) {
+	return fsa.QueryPartitionsIter(ctx, []string{partitionKey}, startKey, endKey, options)
 }
 
-func (fsa *FilesystemStorageAdapter) Start() (err error) {
-	fsa.running = true
-	fsa.processBlocks()
+func (fsa *FilesystemStorageAdapter) QueryPartitionsIter(ctx context.Context, partitionKeys []string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error) {
+	ctx, span := startQuerySpan(ctx, fsa.tracer(), "FilesystemStorageAdapter.Query", partitionKeys)
+
+	startKey, endKey, err = normalizeKeyRange(fsa.Codec, fsa.KeyColumn, startKey, endKey)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	return newBlockRowIterator(ctx, fsa, partitionKeys, startKey, endKey, options, fsa.IdentityColumns, fsa.metrics(), span)
+}
+
+func (fsa *FilesystemStorageAdapter) QueryPrefixIter(ctx context.Context, prefix string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error) {
+	partitionKeys, err := fsa.ListPartitions(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsa.QueryPartitionsIter(ctx, partitionKeys, startKey, endKey, options)
+}
+
+func (fsa *FilesystemStorageAdapter) Delete(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, predicates []Predicate) (removed int64, err error) {
+	startKey, endKey, err = normalizeKeyRange(fsa.Codec, fsa.KeyColumn, startKey, endKey)
+	if err != nil {
+		return 0, err
+	}
+
+	return deleteRows(ctx, fsa, fsa.logger(), fsa.KeyColumn, partitionKey, startKey, endKey, predicates)
+}
+
+func (fsa *FilesystemStorageAdapter) SetInput(input chan *Block, errors chan error) {
+	fsa.Input = input
+	fsa.Errors = errors
+}
+
+func (fsa *FilesystemStorageAdapter) Start(ctx context.Context) (err error) {
+	if fsa.IcebergMetadata {
+		if fsa.table, err = newIcebergTable(ctx, fsa, fsa.Codec, resolvePartitionSpec(fsa.PartitionSpec, fsa.PartitionColumn)); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	fsa.done = done
+	fsa.processBlocks(ctx, done)
 
 	return nil
 }
 
-func (fsa *FilesystemStorageAdapter) Stop() (err error) {
-	log.Println("FilesystemStorageAdapter stopping")
+// Done is closed once the adapter has stopped taking blocks from Input.
+func (fsa *FilesystemStorageAdapter) Done() <-chan struct{} {
+	return fsa.done
+}
+
+func (fsa *FilesystemStorageAdapter) Stop(ctx context.Context) (err error) {
+	fsa.logger().Info("FilesystemStorageAdapter stopping")
 
-	// wait for completion
-	ttl := 100
-	for fsa.running && ttl > 0 {
-		ttl--
-		log.Printf("FilesystemStorageAdapter waiting for finish: ttl: %d\n", ttl)
-		time.Sleep(200 * time.Millisecond)
+	select {
+	case <-fsa.Done():
+	case <-ctx.Done():
+		return fmt.Errorf("FilesystemStorageAdapter: input did not finish: %w", ctx.Err())
 	}
 
 	if len(fsa.Input) > 0 {
@@ -1,7 +1,10 @@
 package core
 
 import (
+	"context"
+	"io/ioutil"
 	"log"
+	"os"
 	"testing"
 )
 
@@ -21,7 +24,7 @@ func TestFilesystemStorageAdapterWrite(t *testing.T) {
 		Input:           input,
 	}
 
-	err := filesystemStorageAdapter.Start()
+	err := filesystemStorageAdapter.Start(context.Background())
 	if err != nil {
 		t.Errorf("filesystemStorageAdapter failed to start: %s", err)
 	}
@@ -34,7 +37,7 @@ func TestFilesystemStorageAdapterWrite(t *testing.T) {
 	input <- block
 	close(input)
 
-	filesystemStorageAdapter.Stop()
+	filesystemStorageAdapter.Stop(context.Background())
 
 	log.Println("Finishing TestFilesystemStorageAdapterWrite")
 }
@@ -56,12 +59,12 @@ func TestFilesystemStorageAdapterQuery(t *testing.T) {
 		Input:           input,
 	}
 
-	err := filesystemStorageAdapter.Start()
+	err := filesystemStorageAdapter.Start(context.Background())
 	if err != nil {
 		t.Errorf("filesystemStorageAdapter failed to start: %s", err)
 	}
 
-	results, err := filesystemStorageAdapter.Query(fixtureMap["user_id"].(string), beforeTimestamp, afterTimestamp)
+	results, err := filesystemStorageAdapter.Query(context.Background(), fixtureMap["user_id"].(string), beforeTimestamp, afterTimestamp)
 
 	if err != nil {
 		t.Errorf("filesystemStorageAdapter query failed with error: %s", err)
@@ -73,3 +76,440 @@ func TestFilesystemStorageAdapterQuery(t *testing.T) {
 
 	log.Println("Finishing TestFilesystemStorageAdapterQuery")
 }
+
+func TestFilesystemStorageAdapterQueryIter(t *testing.T) {
+	log.Println("Starting TestFilesystemStorageAdapterQueryIter")
+
+	fixtureMap := GetFixtureMap()
+	beforeTimestamp := fixtureMap["timestamp"].(int64) - 50
+	afterTimestamp := fixtureMap["timestamp"].(int64) + 50
+
+	input := make(chan *Block)
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath:        "./test/data",
+		Codec:           GetCodecFixture(),
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		CompressionName: "snappy",
+		Input:           input,
+	}
+
+	err := filesystemStorageAdapter.Start(context.Background())
+	if err != nil {
+		t.Errorf("filesystemStorageAdapter failed to start: %s", err)
+	}
+
+	iter, err := filesystemStorageAdapter.QueryIter(context.Background(), fixtureMap["user_id"].(string), beforeTimestamp, afterTimestamp, nil)
+	if err != nil {
+		t.Fatalf("filesystemStorageAdapter query iterator failed with error: %s", err)
+	}
+
+	rowCount := 0
+	for iter.Next() {
+		rowMap := iter.Row().(map[string]interface{})
+		if rowMap["user_id"] != fixtureMap["user_id"] {
+			t.Errorf("filesystemStorageAdapter query iterator returned wrong row: %+v", rowMap)
+		}
+		rowCount++
+	}
+
+	if err := iter.Err(); err != nil {
+		t.Errorf("filesystemStorageAdapter query iterator failed with error: %s", err)
+	}
+
+	if err := iter.Close(); err != nil {
+		t.Errorf("filesystemStorageAdapter query iterator failed to close: %s", err)
+	}
+
+	if rowCount != 1 {
+		t.Errorf("filesystemStorageAdapter query iterator returned wrong row count %d vs. 1", rowCount)
+	}
+
+	log.Println("Finishing TestFilesystemStorageAdapterQueryIter")
+}
+
+func TestFilesystemStorageAdapterQueryOrdered(t *testing.T) {
+	log.Println("Starting TestFilesystemStorageAdapterQueryOrdered")
+
+	partitionKey := "userid-ordered"
+	input := make(chan *Block)
+
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath:        "./test/data",
+		Codec:           GetCodecFixture(),
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		CompressionName: "snappy",
+		Input:           input,
+	}
+
+	err := filesystemStorageAdapter.Start(context.Background())
+	if err != nil {
+		t.Errorf("filesystemStorageAdapter failed to start: %s", err)
+	}
+
+	// two overlapping blocks whose rows interleave by key
+	for _, timestamps := range [][]int64{{100, 300, 500}, {200, 400, 600}} {
+		block := NewBlock(partitionKey, filesystemStorageAdapter.KeyColumn, filesystemStorageAdapter.Codec)
+		for _, timestamp := range timestamps {
+			native := GetNativeFixture().(map[string]interface{})
+			native["user_id"] = partitionKey
+			native["timestamp"] = timestamp
+			block.Write(native)
+		}
+
+		input <- block
+	}
+	close(input)
+
+	filesystemStorageAdapter.Stop(context.Background())
+
+	results, err := filesystemStorageAdapter.QueryWithOptions(context.Background(), partitionKey, int64(150), int64(550), &QueryOptions{
+		Order: Descending,
+		Limit: 3,
+	})
+
+	if err != nil {
+		t.Errorf("filesystemStorageAdapter query failed with error: %s", err)
+	}
+
+	expected := []int64{500, 400, 300}
+	if len(results) != len(expected) {
+		t.Fatalf("filesystemStorageAdapter query results list wrong length %d vs. %d", len(results), len(expected))
+	}
+
+	for i, result := range results {
+		timestamp := result.(map[string]interface{})["timestamp"].(int64)
+		if timestamp != expected[i] {
+			t.Errorf("filesystemStorageAdapter query result %d out of order: %d vs. %d", i, timestamp, expected[i])
+		}
+	}
+
+	log.Println("Finishing TestFilesystemStorageAdapterQueryOrdered")
+}
+
+func TestFilesystemStorageAdapterQueryPrefix(t *testing.T) {
+	log.Println("Starting TestFilesystemStorageAdapterQueryPrefix")
+
+	basePath := "./test/prefix-data"
+	os.RemoveAll(basePath)
+	defer os.RemoveAll(basePath)
+
+	input := make(chan *Block)
+
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath:        basePath,
+		Codec:           GetCodecFixture(),
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		CompressionName: "snappy",
+		Input:           input,
+	}
+
+	err := filesystemStorageAdapter.Start(context.Background())
+	if err != nil {
+		t.Errorf("filesystemStorageAdapter failed to start: %s", err)
+	}
+
+	partitionTimestamps := map[string][]int64{
+		"tenant=acme/userid1":  {100, 400},
+		"tenant=acme/userid2":  {200, 300},
+		"tenant=other/userid3": {250},
+	}
+
+	for partitionKey, timestamps := range partitionTimestamps {
+		block := NewBlock(partitionKey, filesystemStorageAdapter.KeyColumn, filesystemStorageAdapter.Codec)
+		for _, timestamp := range timestamps {
+			native := GetNativeFixture().(map[string]interface{})
+			native["user_id"] = partitionKey
+			native["timestamp"] = timestamp
+			block.Write(native)
+		}
+
+		input <- block
+	}
+	close(input)
+
+	filesystemStorageAdapter.Stop(context.Background())
+
+	prefixExpected := map[string][]int64{
+		"tenant=acme/": {100, 200, 300, 400},
+		"":             {100, 200, 250, 300, 400},
+	}
+
+	for prefix, expected := range prefixExpected {
+		iter, err := filesystemStorageAdapter.QueryPrefixIter(context.Background(), prefix, int64(0), int64(1000), &QueryOptions{Concurrency: 1})
+		if err != nil {
+			t.Fatalf("filesystemStorageAdapter prefix %q query failed with error: %s", prefix, err)
+		}
+
+		results, err := collectRows(iter)
+		if err != nil {
+			t.Errorf("filesystemStorageAdapter prefix %q query failed with error: %s", prefix, err)
+		}
+
+		if len(results) != len(expected) {
+			t.Errorf("filesystemStorageAdapter prefix %q query results list wrong length %d vs. %d", prefix, len(results), len(expected))
+			continue
+		}
+
+		for i, result := range results {
+			timestamp := result.(map[string]interface{})["timestamp"].(int64)
+			if timestamp != expected[i] {
+				t.Errorf("filesystemStorageAdapter prefix %q query result %d out of order: %d vs. %d", prefix, i, timestamp, expected[i])
+			}
+		}
+	}
+
+	log.Println("Finishing TestFilesystemStorageAdapterQueryPrefix")
+}
+
+func TestFilesystemStorageAdapterQueryReleasesFiles(t *testing.T) {
+	log.Println("Starting TestFilesystemStorageAdapterQueryReleasesFiles")
+
+	openFiles := func() int {
+		descriptors, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skipf("open files cannot be counted: %s", err)
+		}
+		return len(descriptors)
+	}
+	openFiles()
+
+	basePath := "./test/release-data"
+	os.RemoveAll(basePath)
+	defer os.RemoveAll(basePath)
+
+	partitionKey := "userid-release"
+	input := make(chan *Block)
+
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath:        basePath,
+		Codec:           GetCodecFixture(),
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		Input:           input,
+	}
+
+	if err := filesystemStorageAdapter.Start(context.Background()); err != nil {
+		t.Fatalf("filesystemStorageAdapter failed to start: %s", err)
+	}
+
+	// many small blocks, so that a wide query opens many files
+	for timestamp := int64(100); timestamp < 5100; timestamp += 100 {
+		block := NewBlock(partitionKey, filesystemStorageAdapter.KeyColumn, filesystemStorageAdapter.Codec)
+		native := GetNativeFixture().(map[string]interface{})
+		native["user_id"] = partitionKey
+		native["timestamp"] = timestamp
+		block.Write(native)
+
+		input <- block
+	}
+	close(input)
+
+	filesystemStorageAdapter.Stop(context.Background())
+
+	before := openFiles()
+
+	for query := 0; query < 20; query++ {
+		results, err := filesystemStorageAdapter.Query(context.Background(), partitionKey, int64(0), int64(10000))
+		if err != nil {
+			t.Fatalf("filesystemStorageAdapter query failed with error: %s", err)
+		}
+
+		if len(results) != 50 {
+			t.Fatalf("filesystemStorageAdapter query results list wrong length %d vs. 50", len(results))
+		}
+	}
+
+	if after := openFiles(); after > before {
+		t.Errorf("filesystemStorageAdapter queries left %d files open", after-before)
+	}
+
+	log.Println("Finishing TestFilesystemStorageAdapterQueryReleasesFiles")
+}
+
+func TestFilesystemStorageAdapterQueryIdentity(t *testing.T) {
+	log.Println("Starting TestFilesystemStorageAdapterQueryIdentity")
+
+	partitionKey := "userid-identity"
+	os.RemoveAll("./test/data/" + partitionKey)
+
+	input := make(chan *Block)
+
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath:        "./test/data",
+		Codec:           GetCodecFixture(),
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		IdentityColumns: []string{"user_id", "timestamp"},
+		CompressionName: "snappy",
+		Input:           input,
+	}
+
+	err := filesystemStorageAdapter.Start(context.Background())
+	if err != nil {
+		t.Errorf("filesystemStorageAdapter failed to start: %s", err)
+	}
+
+	// a replayed source writes rows 200 and 300 into a second block
+	for _, timestamps := range [][]int64{{100, 200, 300}, {200, 300, 400}} {
+		block := NewBlock(partitionKey, filesystemStorageAdapter.KeyColumn, filesystemStorageAdapter.Codec)
+		for _, timestamp := range timestamps {
+			native := GetNativeFixture().(map[string]interface{})
+			native["user_id"] = partitionKey
+			native["timestamp"] = timestamp
+			block.Write(native)
+		}
+
+		input <- block
+	}
+	close(input)
+
+	filesystemStorageAdapter.Stop(context.Background())
+
+	results, err := filesystemStorageAdapter.Query(context.Background(), partitionKey, int64(0), int64(1000))
+	if err != nil {
+		t.Errorf("filesystemStorageAdapter query failed with error: %s", err)
+	}
+
+	expected := []int64{100, 200, 300, 400}
+	if len(results) != len(expected) {
+		t.Fatalf("filesystemStorageAdapter query returned wrong number of rows: %d vs. %d", len(results), len(expected))
+	}
+
+	for i, result := range results {
+		timestamp := result.(map[string]interface{})["timestamp"].(int64)
+		if timestamp != expected[i] {
+			t.Errorf("filesystemStorageAdapter query result %d wrong: %d vs. %d", i, timestamp, expected[i])
+		}
+	}
+
+	log.Println("Finishing TestFilesystemStorageAdapterQueryIdentity")
+}
+
+func TestFilesystemStorageAdapterDelete(t *testing.T) {
+	log.Println("Starting TestFilesystemStorageAdapterDelete")
+
+	partitionKey := "userid-delete"
+	os.RemoveAll("./test/data/" + partitionKey)
+
+	input := make(chan *Block)
+
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath:        "./test/data",
+		Codec:           GetCodecFixture(),
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		CompressionName: "snappy",
+		Input:           input,
+	}
+
+	err := filesystemStorageAdapter.Start(context.Background())
+	if err != nil {
+		t.Errorf("filesystemStorageAdapter failed to start: %s", err)
+	}
+
+	block := NewBlock(partitionKey, filesystemStorageAdapter.KeyColumn, filesystemStorageAdapter.Codec)
+	for _, timestamp := range []int64{100, 200, 300, 400} {
+		native := GetNativeFixture().(map[string]interface{})
+		native["user_id"] = partitionKey
+		native["timestamp"] = timestamp
+		block.Write(native)
+	}
+
+	input <- block
+	close(input)
+
+	filesystemStorageAdapter.Stop(context.Background())
+
+	removed, err := filesystemStorageAdapter.Delete(context.Background(), partitionKey, int64(150), int64(1000), []Predicate{
+		{Column: "timestamp", Operator: NotEqual, Value: int64(300)},
+	})
+
+	if err != nil {
+		t.Errorf("filesystemStorageAdapter delete failed with error: %s", err)
+	}
+
+	if removed != 2 {
+		t.Errorf("filesystemStorageAdapter delete removed wrong number of rows: %d", removed)
+	}
+
+	results, err := filesystemStorageAdapter.Query(context.Background(), partitionKey, int64(0), int64(1000))
+	if err != nil {
+		t.Errorf("filesystemStorageAdapter query failed with error: %s", err)
+	}
+
+	if len(results) != 2 {
+		t.Errorf("filesystemStorageAdapter query after delete returned wrong number of rows: %d", len(results))
+	}
+
+	log.Println("Finishing TestFilesystemStorageAdapterDelete")
+}
+
+func TestFilesystemStorageAdapterLoadTruncatedBlock(t *testing.T) {
+	log.Println("Starting TestFilesystemStorageAdapterLoadTruncatedBlock")
+
+	basePath := "./test/truncated"
+	partitionKey := "userid-truncated"
+	os.RemoveAll(basePath)
+	defer os.RemoveAll(basePath)
+
+	input := make(chan *Block)
+
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath:        basePath,
+		Codec:           GetCodecFixture(),
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		Input:           input,
+	}
+
+	if err := filesystemStorageAdapter.Start(context.Background()); err != nil {
+		t.Fatalf("filesystemStorageAdapter failed to start: %s", err)
+	}
+
+	block := NewBlock(partitionKey, filesystemStorageAdapter.KeyColumn, filesystemStorageAdapter.Codec)
+	for _, timestamp := range []int64{100, 200, 300, 400} {
+		native := GetNativeFixture().(map[string]interface{})
+		native["user_id"] = partitionKey
+		native["timestamp"] = timestamp
+		block.Write(native)
+	}
+
+	input <- block
+	close(input)
+
+	filesystemStorageAdapter.Stop(context.Background())
+
+	blockFilenames, err := filesystemStorageAdapter.GetPartitionFileNames(context.Background(), partitionKey)
+	if err != nil || len(blockFilenames) != 1 {
+		t.Fatalf("filesystemStorageAdapter listed wrong blocks: %v, %v", blockFilenames, err)
+	}
+
+	// cutting the end off the file leaves its header readable but not its rows
+	blockFilePath := filesystemStorageAdapter.getPartitionKeyPath(partitionKey, filesystemStorageAdapter.KeyColumn) + "/" + blockFilenames[0]
+	blockFileInfo, err := os.Stat(blockFilePath)
+	if err != nil {
+		t.Fatalf("filesystemStorageAdapter block file missing: %s", err)
+	}
+
+	if err = os.Truncate(blockFilePath, blockFileInfo.Size()-20); err != nil {
+		t.Fatalf("Truncating block file failed: %s", err)
+	}
+
+	if _, err = readBlock(context.Background(), filesystemStorageAdapter, partitionKey, blockFilenames[0]); err == nil {
+		t.Errorf("filesystemStorageAdapter loaded a truncated block without error")
+	}
+
+	// a delete must not rewrite what it could not read in full
+	if _, err = filesystemStorageAdapter.Delete(context.Background(), partitionKey, int64(0), int64(250), nil); err == nil {
+		t.Errorf("filesystemStorageAdapter deleted from a truncated block without error")
+	}
+
+	if _, err = os.Stat(blockFilePath); err != nil {
+		t.Errorf("filesystemStorageAdapter removed the truncated block: %s", err)
+	}
+
+	log.Println("Finishing TestFilesystemStorageAdapterLoadTruncatedBlock")
+}
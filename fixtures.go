@@ -3,7 +3,7 @@ package core
 import (
 	"fmt"
 
-	goavro "gopkg.in/linkedin/goavro.v2"
+	goavro "github.com/linkedin/goavro/v2"
 )
 
 func GetCodecFixture() (codec *goavro.Codec) {
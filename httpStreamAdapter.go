@@ -0,0 +1,426 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	goavro "github.com/linkedin/goavro/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultHTTPStreamMaxBodyBytes    = 32 * 1024 * 1024
+	defaultHTTPStreamShutdownTimeout = 30 * time.Second
+)
+
+// HTTPStreamAdapter accepts rows POSTed to Path as an Avro OCF (avro/binary),
+// Avro JSON records (application/json, one record or an array of them) or
+// newline delimited Avro JSON (application/x-ndjson). Every record in a
+// request is validated against Codec before any is emitted, and the response
+// is only sent once all of them have been handed to Output.
+//
+// A request carrying trace context, eg. a W3C traceparent header, has its rows
+// emitted as TrackedRows whose Context is the request's span, so that the
+// commits of the blocks holding them link back to it.
+type HTTPStreamAdapter struct {
+	Address      string // eg. ":8081"
+	Path         string // defaults to /rows
+	MaxBodyBytes int64  // defaults to 32MB
+
+	// ShutdownTimeout bounds waiting for requests in flight to hand over their
+	// rows once Start's ctx is cancelled, defaults to 30s, after which they are
+	// abandoned. Stop is bounded by its own ctx instead.
+	ShutdownTimeout time.Duration
+
+	Codec *goavro.Codec
+
+	Output         chan interface{}
+	Errors         chan error
+	Logger         Logger               // defaults to slog.Default()
+	TracerProvider trace.TracerProvider // defaults to the global provider
+
+	httpServer   *http.Server
+	inFlight     sync.WaitGroup // requests that may still emit rows
+	inFlightLock sync.Mutex     // guards stopping against inFlight.Add
+	stopping     bool           // no further requests are taken
+	abandoned    chan struct{}
+	done         chan struct{}
+	shutdownOnce sync.Once
+	shutdownErr  error
+	abandonOnce  sync.Once
+}
+
+type httpStreamError struct {
+	status  int
+	message string
+}
+
+func (e *httpStreamError) Error() string {
+	return e.message
+}
+
+func (hsa *HTTPStreamAdapter) respond(w http.ResponseWriter, status int, body map[string]interface{}) {
+	responseBytes, _ := json.Marshal(body)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseBytes)
+}
+
+// validate checks a decoded record against Codec, returning it as Codec's native form.
+func (hsa *HTTPStreamAdapter) validate(native interface{}, index int) (validated interface{}, err error) {
+	binary, err := hsa.Codec.BinaryFromNative(nil, native)
+	if err != nil {
+		return nil, &httpStreamError{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("record %d does not match schema: %s", index, err)}
+	}
+
+	validated, _, err = hsa.Codec.NativeFromBinary(binary)
+	return validated, err
+}
+
+func (hsa *HTTPStreamAdapter) decodeTextual(textual []byte, index int) (native interface{}, err error) {
+	native, remaining, err := hsa.Codec.NativeFromTextual(textual)
+	if err == nil && len(bytes.TrimSpace(remaining)) > 0 {
+		err = errors.New("trailing data after record")
+	}
+
+	if err != nil {
+		return nil, &httpStreamError{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("record %d does not match schema: %s", index, err)}
+	}
+
+	return native, nil
+}
+
+func (hsa *HTTPStreamAdapter) decodeOCF(body []byte) (rows []interface{}, err error) {
+	ocfReader, err := goavro.NewOCFReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, &httpStreamError{status: http.StatusBadRequest, message: fmt.Sprintf("body is not an Avro OCF: %s", err)}
+	}
+
+	for ocfReader.Scan() {
+		native, err := ocfReader.Read()
+		if err != nil {
+			return nil, &httpStreamError{status: http.StatusBadRequest, message: fmt.Sprintf("record %d could not be read: %s", len(rows), err)}
+		}
+
+		// the OCF carries its writer's schema, so records are checked against ours
+		row, err := hsa.validate(native, len(rows))
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, row)
+	}
+
+	if err = ocfReader.Err(); err != nil {
+		return nil, &httpStreamError{status: http.StatusBadRequest, message: fmt.Sprintf("body is not an Avro OCF: %s", err)}
+	}
+
+	return rows, nil
+}
+
+func (hsa *HTTPStreamAdapter) decodeJSON(body []byte) (rows []interface{}, err error) {
+	body = bytes.TrimSpace(body)
+
+	records := []json.RawMessage{body}
+	if len(body) > 0 && body[0] == '[' {
+		if err = json.Unmarshal(body, &records); err != nil {
+			return nil, &httpStreamError{status: http.StatusBadRequest, message: fmt.Sprintf("body is not a JSON array: %s", err)}
+		}
+	}
+
+	for index, record := range records {
+		row, err := hsa.decodeTextual(record, index)
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func (hsa *HTTPStreamAdapter) decodeNDJSON(body []byte) (rows []interface{}, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		row, err := hsa.decodeTextual(line, len(rows))
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, scanner.Err()
+}
+
+func (hsa *HTTPStreamAdapter) decodeBody(contentType string, body []byte) (rows []interface{}, err error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, &httpStreamError{status: http.StatusUnsupportedMediaType, message: fmt.Sprintf("Content-Type %s not supported", contentType)}
+	}
+
+	switch mediaType {
+	case "avro/binary", "application/avro":
+		return hsa.decodeOCF(body)
+	case "application/json":
+		return hsa.decodeJSON(body)
+	case "application/x-ndjson":
+		return hsa.decodeNDJSON(body)
+	}
+
+	return nil, &httpStreamError{status: http.StatusUnsupportedMediaType, message: fmt.Sprintf("Content-Type %s not supported", contentType)}
+}
+
+// beginRequest counts a request as in flight, unless the adapter is stopping
+// and no longer waits for new ones.
+func (hsa *HTTPStreamAdapter) beginRequest() bool {
+	hsa.inFlightLock.Lock()
+	defer hsa.inFlightLock.Unlock()
+
+	if hsa.stopping {
+		return false
+	}
+
+	hsa.inFlight.Add(1)
+	return true
+}
+
+func (hsa *HTTPStreamAdapter) handleRows(w http.ResponseWriter, r *http.Request) {
+	if !hsa.beginRequest() {
+		hsa.respond(w, http.StatusServiceUnavailable, map[string]interface{}{"error": "adapter stopping"})
+		return
+	}
+	defer hsa.inFlight.Done()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		hsa.respond(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": fmt.Sprintf("%s not allowed", r.Method)})
+		return
+	}
+
+	maxBodyBytes := hsa.MaxBodyBytes
+	if maxBodyBytes == 0 {
+		maxBodyBytes = defaultHTTPStreamMaxBodyBytes
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		hsa.respond(w, status, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	ctx, span := hsa.tracer().Start(extractTraceContext(r.Context(), propagation.HeaderCarrier(r.Header)), "HTTPStreamAdapter.handleRows", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	rows, err := hsa.decodeBody(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		status := http.StatusBadRequest
+		if streamErr, ok := err.(*httpStreamError); ok {
+			status = streamErr.status
+		}
+
+		span.SetStatus(codes.Error, err.Error())
+		hsa.respond(w, status, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	span.SetAttributes(attribute.Int(attributeRows, len(rows)))
+	traced := trace.SpanContextFromContext(ctx).IsValid()
+
+	for accepted, row := range rows {
+		if traced {
+			row = &TrackedRow{Row: row, Context: ctx}
+		}
+
+		select {
+		case hsa.Output <- row:
+		case <-r.Context().Done():
+			hsa.logger().Warn("HTTPStreamAdapter request cancelled", "accepted", accepted, "rows", len(rows))
+			hsa.respond(w, http.StatusServiceUnavailable, map[string]interface{}{"error": "request cancelled", "accepted": accepted})
+			return
+		case <-hsa.abandoned:
+			hsa.logger().Warn("HTTPStreamAdapter stopped during request", "accepted", accepted, "rows", len(rows))
+			hsa.respond(w, http.StatusServiceUnavailable, map[string]interface{}{"error": "adapter stopped", "accepted": accepted})
+			return
+		}
+	}
+
+	hsa.respond(w, http.StatusOK, map[string]interface{}{"accepted": len(rows)})
+}
+
+func (hsa *HTTPStreamAdapter) Handler() http.Handler {
+	path := hsa.Path
+	if len(path) == 0 {
+		path = "/rows"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, hsa.handleRows)
+
+	return mux
+}
+
+func (hsa *HTTPStreamAdapter) logger() Logger {
+	return LoggerOrDefault(hsa.Logger)
+}
+
+func (hsa *HTTPStreamAdapter) tracer() trace.Tracer {
+	return tracerFrom(hsa.TracerProvider)
+}
+
+func (hsa *HTTPStreamAdapter) SetOutput(output chan interface{}, errors chan error) {
+	hsa.Output = output
+	hsa.Errors = errors
+}
+
+// Start serves requests until Stop is called or ctx is cancelled. Requests in
+// flight when ctx is cancelled are not cancelled with it, but are given
+// ShutdownTimeout to hand over their rows.
+func (hsa *HTTPStreamAdapter) Start(ctx context.Context) (err error) {
+	if hsa.Codec == nil {
+		return errors.New("HTTPStreamAdapter not correctly configured with Codec")
+	}
+
+	listener, err := net.Listen("tcp", hsa.Address)
+	if err != nil {
+		hsa.logger().Error("HTTPStreamAdapter failed to start", "address", hsa.Address, "error", err)
+		return err
+	}
+
+	httpServer := &http.Server{
+		Handler: hsa.Handler(),
+		// requests outlive ctx so that the shutdown can wait for them
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithoutCancel(ctx)
+		},
+	}
+
+	done := make(chan struct{})
+	hsa.httpServer = httpServer
+	hsa.stopping = false
+	hsa.abandoned = make(chan struct{})
+	hsa.done = done
+	hsa.shutdownOnce = sync.Once{}
+	hsa.shutdownErr = nil
+	hsa.abandonOnce = sync.Once{}
+
+	go func() {
+		hsa.logger().Info("HTTPStreamAdapter listening", "address", listener.Addr().String())
+
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			hsa.logger().Error("HTTPStreamAdapter failed", "error", err)
+			if hsa.Errors != nil {
+				select {
+				case hsa.Errors <- err:
+				case <-ctx.Done():
+				}
+			}
+		}
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdownTimeout := hsa.ShutdownTimeout
+			if shutdownTimeout == 0 {
+				shutdownTimeout = defaultHTTPStreamShutdownTimeout
+			}
+
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			hsa.shutdown(shutdownCtx)
+			<-done
+			cancel()
+		case <-done:
+		}
+	}()
+
+	return nil
+}
+
+// shutdown begins, once, turning away new requests and waiting for as long as
+// ctx allows for requests in flight to hand over their rows. Requests still emitting after that are
+// abandoned, and then Output and done are closed.
+func (hsa *HTTPStreamAdapter) shutdown(ctx context.Context) {
+	hsa.shutdownOnce.Do(func() {
+		hsa.inFlightLock.Lock()
+		hsa.stopping = true
+		hsa.inFlightLock.Unlock()
+
+		go func() {
+			err := hsa.httpServer.Shutdown(ctx)
+			if err != nil {
+				hsa.abandonRequests()
+			}
+
+			hsa.inFlight.Wait()
+
+			hsa.shutdownErr = err
+			close(hsa.Output)
+			close(hsa.done)
+		}()
+	})
+}
+
+// abandonRequests makes requests in flight stop emitting rows and closes
+// their connections.
+func (hsa *HTTPStreamAdapter) abandonRequests() {
+	hsa.abandonOnce.Do(func() {
+		close(hsa.abandoned)
+		hsa.httpServer.Close()
+	})
+}
+
+// Done is closed once the server has shut down and Output has been closed.
+func (hsa *HTTPStreamAdapter) Done() <-chan struct{} {
+	return hsa.done
+}
+
+// Stop waits for in flight requests to hand over their rows, then closes
+// Output. If a shutdown is already in progress, as once Start's ctx is
+// cancelled, Stop waits for it. Requests still emitting when ctx ends are
+// abandoned and ctx's error is returned.
+func (hsa *HTTPStreamAdapter) Stop(ctx context.Context) (err error) {
+	hsa.logger().Info("HTTPStreamAdapter stopping")
+
+	if hsa.httpServer == nil {
+		return nil
+	}
+
+	hsa.shutdown(ctx)
+
+	select {
+	case <-hsa.done:
+		return hsa.shutdownErr
+	case <-ctx.Done():
+		hsa.abandonRequests()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,188 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestHTTPStreamAdapter(t *testing.T) {
+	log.Println("Starting TestHTTPStreamAdapter")
+
+	output := make(chan interface{}, 10)
+
+	httpStreamAdapter := &HTTPStreamAdapter{
+		Codec:  GetCodecFixture(),
+		Output: output,
+	}
+
+	textual, err := httpStreamAdapter.Codec.TextualFromNative(nil, GetNativeFixture())
+	if err != nil {
+		t.Fatalf("TextualFromNative failed with error: %s", err)
+	}
+
+	cases := []struct {
+		contentType    string
+		body           []byte
+		expectedStatus int
+		expectedRows   int
+	}{
+		{"application/x-ndjson", append(append(append([]byte{}, textual...), '\n'), textual...), http.StatusOK, 2},
+		{"application/json", append(append([]byte("["), textual...), ']'), http.StatusOK, 1},
+		{"application/json", []byte(`{"user_id": 1}`), http.StatusUnprocessableEntity, 0},
+		{"text/csv", textual, http.StatusUnsupportedMediaType, 0},
+	}
+
+	handler := httpStreamAdapter.Handler()
+
+	for _, c := range cases {
+		request := httptest.NewRequest(http.MethodPost, "/rows", bytes.NewReader(c.body))
+		request.Header.Set("Content-Type", c.contentType)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != c.expectedStatus {
+			t.Errorf("%s POST returned wrong status: %d vs. %d: %s", c.contentType, recorder.Code, c.expectedStatus, recorder.Body.String())
+		}
+
+		if len(output) != c.expectedRows {
+			t.Errorf("%s POST emitted wrong number of rows: %d vs. %d", c.contentType, len(output), c.expectedRows)
+		}
+
+		for len(output) > 0 {
+			<-output
+		}
+	}
+
+	log.Println("Finished TestHTTPStreamAdapter")
+}
+
+func TestHTTPStreamAdapterRequestErrors(t *testing.T) {
+	log.Println("Starting TestHTTPStreamAdapterRequestErrors")
+
+	httpStreamAdapter := &HTTPStreamAdapter{
+		Codec:        GetCodecFixture(),
+		Output:       make(chan interface{}, 10),
+		MaxBodyBytes: 16,
+	}
+
+	cases := []struct {
+		name           string
+		body           io.Reader
+		expectedStatus int
+	}{
+		{"oversized body", bytes.NewReader(make([]byte, 32)), http.StatusRequestEntityTooLarge},
+		{"unreadable body", iotest.ErrReader(errors.New("connection reset")), http.StatusBadRequest},
+	}
+
+	handler := httpStreamAdapter.Handler()
+
+	for _, c := range cases {
+		request := httptest.NewRequest(http.MethodPost, "/rows", c.body)
+		request.Header.Set("Content-Type", "application/x-ndjson")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != c.expectedStatus {
+			t.Errorf("%s returned wrong status: %d vs. %d: %s", c.name, recorder.Code, c.expectedStatus, recorder.Body.String())
+		}
+	}
+
+	log.Println("Finished TestHTTPStreamAdapterRequestErrors")
+}
+
+func TestHTTPStreamAdapterRejectsRequestsWhenStopped(t *testing.T) {
+	log.Println("Starting TestHTTPStreamAdapterRejectsRequestsWhenStopped")
+
+	httpStreamAdapter := &HTTPStreamAdapter{
+		Address: "127.0.0.1:0",
+		Codec:   GetCodecFixture(),
+		Output:  make(chan interface{}, 10),
+	}
+
+	if err := httpStreamAdapter.Start(context.Background()); err != nil {
+		t.Fatalf("HTTPStreamAdapter failed to start: %s", err)
+	}
+
+	if err := httpStreamAdapter.Stop(context.Background()); err != nil {
+		t.Fatalf("HTTPStreamAdapter failed to stop: %s", err)
+	}
+
+	// a request the server had already accepted reaches the handler after Stop
+	request := httptest.NewRequest(http.MethodPost, "/rows", bytes.NewReader([]byte("{}")))
+	request.Header.Set("Content-Type", "application/x-ndjson")
+
+	recorder := httptest.NewRecorder()
+	httpStreamAdapter.Handler().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("request after Stop returned wrong status: %d vs. %d: %s", recorder.Code, http.StatusServiceUnavailable, recorder.Body.String())
+	}
+
+	log.Println("Finished TestHTTPStreamAdapterRejectsRequestsWhenStopped")
+}
+
+func TestHTTPStreamAdapterStopDeadline(t *testing.T) {
+	log.Println("Starting TestHTTPStreamAdapterStopDeadline")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %s", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	httpStreamAdapter := &HTTPStreamAdapter{
+		Address:         address,
+		Codec:           GetCodecFixture(),
+		Output:          make(chan interface{}),
+		ShutdownTimeout: time.Minute,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := httpStreamAdapter.Start(ctx); err != nil {
+		t.Fatalf("HTTPStreamAdapter failed to start: %s", err)
+	}
+
+	// a request whose body never finishes keeps the shutdown waiting
+	body, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+
+	go http.Post("http://"+address+"/rows", "application/x-ndjson", body)
+	bodyWriter.Write([]byte("{"))
+	time.Sleep(100 * time.Millisecond)
+
+	cancel()
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer stopCancel()
+
+	started := time.Now()
+	if err := httpStreamAdapter.Stop(stopCtx); err != context.DeadlineExceeded {
+		t.Errorf("HTTPStreamAdapter Stop returned wrong error: %v vs. %s", err, context.DeadlineExceeded)
+	}
+
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("HTTPStreamAdapter Stop took %s despite its deadline", elapsed)
+	}
+
+	select {
+	case <-httpStreamAdapter.Done():
+	case <-time.After(5 * time.Second):
+		t.Errorf("HTTPStreamAdapter did not finish after abandoning requests")
+	}
+
+	log.Println("Finished TestHTTPStreamAdapterStopDeadline")
+}
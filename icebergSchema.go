@@ -0,0 +1,308 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+type icebergField struct {
+	ID       int         `json:"id"`
+	Name     string      `json:"name"`
+	Required bool        `json:"required"`
+	Type     interface{} `json:"type"`
+}
+
+type icebergSchema struct {
+	Type     string          `json:"type"`
+	SchemaID int             `json:"schema-id"`
+	Fields   []*icebergField `json:"fields"`
+}
+
+type icebergColumn struct {
+	ID   int
+	Type string
+}
+
+type icebergNameMapping struct {
+	FieldID int                   `json:"field-id"`
+	Names   []string              `json:"names"`
+	Fields  []*icebergNameMapping `json:"fields,omitempty"`
+}
+
+// icebergSchemaBuilder converts an Avro record schema into an Iceberg schema,
+// assigning field ids in the order Iceberg does: every field of a struct is
+// numbered before any of their nested types.
+type icebergSchemaBuilder struct {
+	lastID   int
+	columns  map[string]*icebergColumn // top level primitive columns by name
+	mappings []*icebergNameMapping
+}
+
+func newIcebergSchema(avroSchema string) (schema *icebergSchema, builder *icebergSchemaBuilder, err error) {
+	var parsed interface{}
+	if err = json.Unmarshal([]byte(avroSchema), &parsed); err != nil {
+		return nil, nil, err
+	}
+
+	record, ok := parsed.(map[string]interface{})
+	if !ok || record["type"] != "record" {
+		return nil, nil, errors.New("newIcebergSchema: top level Avro schema must be a record")
+	}
+
+	builder = &icebergSchemaBuilder{
+		columns: make(map[string]*icebergColumn),
+	}
+
+	fields, mappings, err := builder.convertRecord(record, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	builder.mappings = mappings
+
+	return &icebergSchema{
+		Type:   "struct",
+		Fields: fields,
+	}, builder, nil
+}
+
+func (b *icebergSchemaBuilder) convertRecord(record map[string]interface{}, topLevel bool) (fields []*icebergField, mappings []*icebergNameMapping, err error) {
+	avroFields, ok := record["fields"].([]interface{})
+	if !ok {
+		return nil, nil, errors.New("convertRecord: record has no fields")
+	}
+
+	fields = make([]*icebergField, len(avroFields))
+	mappings = make([]*icebergNameMapping, len(avroFields))
+
+	for i, avroField := range avroFields {
+		fieldMap := avroField.(map[string]interface{})
+		b.lastID++
+		fields[i] = &icebergField{
+			ID:   b.lastID,
+			Name: fieldMap["name"].(string),
+		}
+		mappings[i] = &icebergNameMapping{
+			FieldID: b.lastID,
+			Names:   []string{fields[i].Name},
+		}
+	}
+
+	for i, avroField := range avroFields {
+		fieldMap := avroField.(map[string]interface{})
+
+		fieldType, required, nestedMappings, err := b.convertType(fieldMap["type"])
+		if err != nil {
+			return nil, nil, fmt.Errorf("convertRecord: field %s: %s", fields[i].Name, err)
+		}
+
+		fields[i].Type = fieldType
+		fields[i].Required = required
+		mappings[i].Fields = nestedMappings
+
+		if primitiveType, isPrimitive := fieldType.(string); isPrimitive && topLevel {
+			b.columns[fields[i].Name] = &icebergColumn{
+				ID:   fields[i].ID,
+				Type: primitiveType,
+			}
+		}
+	}
+
+	return fields, mappings, nil
+}
+
+func (b *icebergSchemaBuilder) convertType(avroType interface{}) (icebergType interface{}, required bool, mappings []*icebergNameMapping, err error) {
+	switch t := avroType.(type) {
+	case string:
+		icebergType, err = icebergPrimitiveType(t, "")
+		return icebergType, true, nil, err
+	case []interface{}:
+		var nonNullTypes []interface{}
+		for _, unionType := range t {
+			if unionType != "null" {
+				nonNullTypes = append(nonNullTypes, unionType)
+			}
+		}
+
+		if len(nonNullTypes) != 1 {
+			return nil, false, nil, errors.New("convertType: only unions of null and one other type are supported")
+		}
+
+		icebergType, _, mappings, err = b.convertType(nonNullTypes[0])
+		return icebergType, len(nonNullTypes) == len(t), mappings, err
+	case map[string]interface{}:
+		switch t["type"] {
+		case "record":
+			fields, mappings, err := b.convertRecord(t, false)
+			if err != nil {
+				return nil, false, nil, err
+			}
+			return map[string]interface{}{"type": "struct", "fields": fields}, true, mappings, nil
+		case "array":
+			b.lastID++
+			elementID := b.lastID
+			elementType, elementRequired, elementMappings, err := b.convertType(t["items"])
+			if err != nil {
+				return nil, false, nil, err
+			}
+			return map[string]interface{}{
+				"type":             "list",
+				"element-id":       elementID,
+				"element":          elementType,
+				"element-required": elementRequired,
+			}, true, []*icebergNameMapping{
+				{FieldID: elementID, Names: []string{"element"}, Fields: elementMappings},
+			}, nil
+		case "map":
+			b.lastID += 2
+			keyID, valueID := b.lastID-1, b.lastID
+			valueType, valueRequired, valueMappings, err := b.convertType(t["values"])
+			if err != nil {
+				return nil, false, nil, err
+			}
+			return map[string]interface{}{
+				"type":           "map",
+				"key-id":         keyID,
+				"key":            "string",
+				"value-id":       valueID,
+				"value":          valueType,
+				"value-required": valueRequired,
+			}, true, []*icebergNameMapping{
+				{FieldID: keyID, Names: []string{"key"}},
+				{FieldID: valueID, Names: []string{"value"}, Fields: valueMappings},
+			}, nil
+		case "enum":
+			return "string", true, nil, nil
+		case "fixed":
+			return fmt.Sprintf("fixed[%v]", t["size"]), true, nil, nil
+		default:
+			// a primitive, possibly annotated with a logical type, or a wrapped type
+			logicalType, _ := t["logicalType"].(string)
+			if primitiveType, ok := t["type"].(string); ok {
+				icebergType, err = icebergPrimitiveType(primitiveType, logicalType)
+				return icebergType, true, nil, err
+			}
+			return b.convertType(t["type"])
+		}
+	}
+
+	return nil, false, nil, fmt.Errorf("convertType: unsupported Avro type %v", avroType)
+}
+
+func icebergPrimitiveType(avroType string, logicalType string) (icebergType string, err error) {
+	switch avroType {
+	case "boolean":
+		return "boolean", nil
+	case "int":
+		if logicalType == "date" {
+			return "date", nil
+		}
+		return "int", nil
+	case "long":
+		// Iceberg timestamps are microseconds, so timestamp-millis stays a long
+		if logicalType == "timestamp-micros" {
+			return "timestamp", nil
+		}
+		return "long", nil
+	case "float":
+		return "float", nil
+	case "double":
+		return "double", nil
+	case "string":
+		return "string", nil
+	case "bytes":
+		return "binary", nil
+	}
+
+	return "", fmt.Errorf("icebergPrimitiveType: unsupported Avro type %s", avroType)
+}
+
+// icebergAvroType is the Avro type used to store values of an Iceberg
+// primitive in manifests.
+func icebergAvroType(icebergType string) string {
+	switch icebergType {
+	case "boolean", "int", "long", "float", "double", "string":
+		return icebergType
+	case "date":
+		return "int"
+	case "timestamp":
+		return "long"
+	}
+
+	return "bytes"
+}
+
+// icebergDate is a date as the days since the epoch Iceberg stores it as,
+// or false if that does not fit its int.
+func icebergDate(date time.Time) (days int32, ok bool) {
+	ordinal := floorDiv(date.Unix(), 24*60*60)
+	if ordinal < math.MinInt32 || ordinal > math.MaxInt32 {
+		return 0, false
+	}
+
+	return int32(ordinal), true
+}
+
+// icebergSingleValue encodes a bound using Iceberg's single-value binary
+// serialization.
+func icebergSingleValue(icebergType string, value interface{}) (encoded []byte, ok bool) {
+	switch icebergType {
+	case "boolean":
+		if boolValue, isBool := value.(bool); isBool {
+			if boolValue {
+				return []byte{1}, true
+			}
+			return []byte{0}, true
+		}
+	case "int", "date":
+		intValue, isInt := value.(int32)
+		if date, isTime := value.(time.Time); isTime && icebergType == "date" {
+			intValue, isInt = icebergDate(date)
+		}
+		if isInt {
+			encoded = make([]byte, 4)
+			binary.LittleEndian.PutUint32(encoded, uint32(intValue))
+			return encoded, true
+		}
+	case "long", "timestamp":
+		var longValue int64
+		switch t := value.(type) {
+		case int64:
+			longValue = t
+		case time.Time:
+			// timestamp columns are microseconds; timestamp-millis columns remain longs
+			if icebergType == "timestamp" {
+				longValue = t.UnixNano() / int64(time.Microsecond)
+			} else {
+				longValue = t.UnixNano() / int64(time.Millisecond)
+			}
+		default:
+			return nil, false
+		}
+		encoded = make([]byte, 8)
+		binary.LittleEndian.PutUint64(encoded, uint64(longValue))
+		return encoded, true
+	case "float":
+		if floatValue, isFloat := value.(float32); isFloat {
+			encoded = make([]byte, 4)
+			binary.LittleEndian.PutUint32(encoded, math.Float32bits(floatValue))
+			return encoded, true
+		}
+	case "double":
+		if floatValue, isFloat := value.(float64); isFloat {
+			encoded = make([]byte, 8)
+			binary.LittleEndian.PutUint64(encoded, math.Float64bits(floatValue))
+			return encoded, true
+		}
+	case "string":
+		if stringValue, isString := value.(string); isString {
+			return []byte(stringValue), true
+		}
+	}
+
+	return nil, false
+}
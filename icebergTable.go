@@ -0,0 +1,986 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goavro "github.com/linkedin/goavro/v2"
+)
+
+const (
+	icebergMetadataPath    = "metadata"
+	icebergVersionHintPath = "metadata/version-hint.text"
+
+	icebergStatusExisting = 0
+	icebergStatusAdded    = 1
+	icebergStatusDeleted  = 2
+
+	icebergPartitionFieldIDStart = 1000
+
+	// a commit merges the current manifests into its own once there are
+	// icebergMaxManifests of them, keeping the manifest list bounded
+	icebergMaxManifests = 100
+
+	// snapshots and metadata versions older than these are expired, and their
+	// manifest lists and metadata files deleted, keeping metadata bounded
+	icebergMaxSnapshots        = 100
+	icebergMaxMetadataVersions = 100
+)
+
+var errObjectNotFound = errors.New("object not found")
+
+// objectStore is implemented by storage adapters so that table metadata can be
+// kept beside the blocks they write. Paths are relative to the table root.
+type objectStore interface {
+	readObject(ctx context.Context, objectPath string) (data []byte, err error)
+	writeObject(ctx context.Context, objectPath string, data []byte) (err error)
+	objectURI(objectPath string) string
+	deleteObject(ctx context.Context, objectPath string) (err error)
+	logger() Logger
+}
+
+type icebergPartitionField struct {
+	Name      string `json:"name"`
+	Transform string `json:"transform"`
+	SourceID  int    `json:"source-id"`
+	FieldID   int    `json:"field-id"`
+}
+
+type icebergPartitionSpec struct {
+	SpecID int                      `json:"spec-id"`
+	Fields []*icebergPartitionField `json:"fields"`
+}
+
+type icebergSnapshot struct {
+	SnapshotID       int64             `json:"snapshot-id"`
+	ParentSnapshotID *int64            `json:"parent-snapshot-id,omitempty"`
+	TimestampMs      int64             `json:"timestamp-ms"`
+	ManifestList     string            `json:"manifest-list"`
+	Summary          map[string]string `json:"summary"`
+	SchemaID         int               `json:"schema-id"`
+}
+
+type icebergSnapshotLogEntry struct {
+	TimestampMs int64 `json:"timestamp-ms"`
+	SnapshotID  int64 `json:"snapshot-id"`
+}
+
+type icebergMetadataLogEntry struct {
+	TimestampMs  int64  `json:"timestamp-ms"`
+	MetadataFile string `json:"metadata-file"`
+}
+
+type icebergTableMetadata struct {
+	FormatVersion     int                        `json:"format-version"`
+	TableUUID         string                     `json:"table-uuid"`
+	Location          string                     `json:"location"`
+	LastUpdatedMs     int64                      `json:"last-updated-ms"`
+	LastColumnID      int                        `json:"last-column-id"`
+	Schema            *icebergSchema             `json:"schema"`
+	Schemas           []*icebergSchema           `json:"schemas"`
+	CurrentSchemaID   int                        `json:"current-schema-id"`
+	PartitionSpec     []*icebergPartitionField   `json:"partition-spec"`
+	PartitionSpecs    []*icebergPartitionSpec    `json:"partition-specs"`
+	DefaultSpecID     int                        `json:"default-spec-id"`
+	LastPartitionID   int                        `json:"last-partition-id"`
+	Properties        map[string]string          `json:"properties"`
+	CurrentSnapshotID int64                      `json:"current-snapshot-id"`
+	Snapshots         []*icebergSnapshot         `json:"snapshots"`
+	SnapshotLog       []*icebergSnapshotLogEntry `json:"snapshot-log"`
+	MetadataLog       []*icebergMetadataLogEntry `json:"metadata-log"`
+}
+
+type icebergDataFile struct {
+	FilePath        string
+	Partition       map[string]interface{}
+	RecordCount     int64
+	FileSizeInBytes int64
+	ValueCounts     map[int]int64
+	NullValueCounts map[int]int64
+	LowerBounds     map[int][]byte
+	UpperBounds     map[int][]byte
+
+	SnapshotID   int64  // snapshot that added the file
+	ManifestPath string // URI of the manifest currently listing the file
+}
+
+// icebergTable maintains Apache Iceberg (format version 1) metadata for the
+// blocks a storage adapter writes, so that engines such as Spark and Trino can
+// read them as a table. Each commit writes a manifest, a manifest list and a
+// new metadata.json, then points version-hint.text at it. Manifest entries
+// keep the id of the snapshot that added their file, only the manifests
+// listing a removed file are rewritten, and old snapshots, the manifests only
+// they reference and old metadata versions are expired, so that neither a
+// commit's cost nor the table's files grow with the number of commits before
+// it. A table assumes it is the only writer.
+type icebergTable struct {
+	store           objectStore
+	schema          *icebergSchema
+	columns         map[string]*icebergColumn
+	partitionSpec   *PartitionSpec
+	partitionFields []*icebergPartitionField
+	partitionTypes  []string
+
+	manifestCodec     *goavro.Codec
+	manifestListCodec *goavro.Codec
+
+	metadata  *icebergTableMetadata
+	version   int
+	manifests []interface{}               // manifest list entries of the current snapshot
+	dataFiles map[string]*icebergDataFile // live data files by path
+
+	mutex sync.Mutex
+}
+
+func newIcebergTable(ctx context.Context, store objectStore, codec *goavro.Codec, partitionSpec *PartitionSpec) (table *icebergTable, err error) {
+	table = &icebergTable{
+		store:         store,
+		partitionSpec: partitionSpec,
+		dataFiles:     make(map[string]*icebergDataFile),
+	}
+
+	schema, builder, err := newIcebergSchema(codec.Schema())
+	if err != nil {
+		return nil, err
+	}
+
+	table.schema = schema
+	table.columns = builder.columns
+
+	for i := range partitionSpec.Fields {
+		field := &partitionSpec.Fields[i]
+
+		partitionSource, exists := table.columns[field.SourceColumn]
+		if !exists {
+			return nil, fmt.Errorf("newIcebergTable: partition column %s is not a primitive column", field.SourceColumn)
+		}
+
+		partitionType, err := icebergPartitionType(field, partitionSource.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		table.partitionFields = append(table.partitionFields, &icebergPartitionField{
+			Name:      field.name(),
+			Transform: field.icebergTransform(),
+			SourceID:  partitionSource.ID,
+			FieldID:   icebergPartitionFieldIDStart + i,
+		})
+		table.partitionTypes = append(table.partitionTypes, partitionType)
+	}
+
+	if table.manifestCodec, err = goavro.NewCodec(table.manifestSchema()); err != nil {
+		return nil, err
+	}
+
+	if table.manifestListCodec, err = goavro.NewCodec(icebergManifestListSchema); err != nil {
+		return nil, err
+	}
+
+	if err = table.load(ctx, builder); err != nil {
+		return nil, err
+	}
+
+	return table, nil
+}
+
+func (t *icebergTable) load(ctx context.Context, builder *icebergSchemaBuilder) (err error) {
+	versionHint, err := t.store.readObject(ctx, icebergVersionHintPath)
+	if err == errObjectNotFound {
+		return t.create(ctx, builder)
+	}
+	if err != nil {
+		return err
+	}
+
+	t.version, err = strconv.Atoi(strings.TrimSpace(string(versionHint)))
+	if err != nil {
+		return err
+	}
+
+	metadataBytes, err := t.store.readObject(ctx, t.metadataPath(t.version))
+	if err != nil {
+		return err
+	}
+
+	t.metadata = &icebergTableMetadata{}
+	if err = json.Unmarshal(metadataBytes, t.metadata); err != nil {
+		return err
+	}
+
+	snapshot := t.currentSnapshot()
+	if snapshot == nil {
+		return nil
+	}
+
+	if t.manifests, err = t.readAvroObject(ctx, snapshot.ManifestList); err != nil {
+		return err
+	}
+
+	for _, manifest := range t.manifests {
+		manifestPath := icebergManifestPath(manifest)
+
+		entries, err := t.readAvroObject(ctx, manifestPath)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			entryMap := entry.(map[string]interface{})
+			if entryMap["status"].(int32) == icebergStatusDeleted {
+				continue
+			}
+
+			dataFile := icebergDataFileFromNative(entryMap["data_file"].(map[string]interface{}))
+			dataFile.ManifestPath = manifestPath
+			dataFile.SnapshotID = snapshot.SnapshotID
+			if entrySnapshotID, ok := unwrapUnion(entryMap["snapshot_id"]).(int64); ok {
+				dataFile.SnapshotID = entrySnapshotID
+			}
+
+			t.dataFiles[dataFile.FilePath] = dataFile
+		}
+	}
+
+	return nil
+}
+
+func (t *icebergTable) create(ctx context.Context, builder *icebergSchemaBuilder) (err error) {
+	nameMapping, err := json.Marshal(builder.mappings)
+	if err != nil {
+		return err
+	}
+
+	t.metadata = &icebergTableMetadata{
+		FormatVersion:   1,
+		TableUUID:       newUUID(),
+		Location:        strings.TrimSuffix(t.store.objectURI(""), "/"),
+		LastUpdatedMs:   time.Now().UnixNano() / int64(time.Millisecond),
+		LastColumnID:    builder.lastID,
+		Schema:          t.schema,
+		Schemas:         []*icebergSchema{t.schema},
+		PartitionSpec:   t.partitionFields,
+		PartitionSpecs:  []*icebergPartitionSpec{{SpecID: 0, Fields: t.partitionFields}},
+		LastPartitionID: icebergPartitionFieldIDStart + len(t.partitionFields) - 1,
+		Properties: map[string]string{
+			// blocks are written without Iceberg field ids, so readers resolve columns by name
+			"schema.name-mapping.default": string(nameMapping),
+			"write.format.default":        "avro",
+
+			"write.metadata.previous-versions-max":       strconv.Itoa(icebergMaxMetadataVersions),
+			"write.metadata.delete-after-commit.enabled": "true",
+		},
+		CurrentSnapshotID: -1,
+		Snapshots:         []*icebergSnapshot{},
+		SnapshotLog:       []*icebergSnapshotLogEntry{},
+		MetadataLog:       []*icebergMetadataLogEntry{},
+	}
+
+	return t.writeMetadata(ctx, t.metadata, 1)
+}
+
+func (t *icebergTable) currentSnapshot() *icebergSnapshot {
+	for _, snapshot := range t.metadata.Snapshots {
+		if snapshot.SnapshotID == t.metadata.CurrentSnapshotID {
+			return snapshot
+		}
+	}
+
+	return nil
+}
+
+func (t *icebergTable) metadataPath(version int) string {
+	return fmt.Sprintf("%s/v%d.metadata.json", icebergMetadataPath, version)
+}
+
+// relativePath converts a URI written into metadata back into a store path.
+func (t *icebergTable) relativePath(uri string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(uri, t.metadata.Location), "/")
+}
+
+func (t *icebergTable) readAvroObject(ctx context.Context, uri string) (natives []interface{}, err error) {
+	data, err := t.store.readObject(ctx, t.relativePath(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	ocfReader, err := goavro.NewOCFReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	for ocfReader.Scan() {
+		native, err := ocfReader.Read()
+		if err != nil {
+			return nil, err
+		}
+		natives = append(natives, native)
+	}
+
+	return natives, ocfReader.Err()
+}
+
+func (t *icebergTable) writeAvroObject(ctx context.Context, objectPath string, codec *goavro.Codec, metadata map[string]string, natives []interface{}) (length int64, err error) {
+	avroBuffer := new(bytes.Buffer)
+
+	metaData := make(map[string][]byte, len(metadata))
+	for key, value := range metadata {
+		metaData[key] = []byte(value)
+	}
+
+	ocfWriter, err := goavro.NewOCFWriter(goavro.OCFConfig{
+		W:        avroBuffer,
+		Codec:    codec,
+		MetaData: metaData,
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err = ocfWriter.Append(natives); err != nil {
+		return 0, err
+	}
+
+	return int64(avroBuffer.Len()), t.store.writeObject(ctx, objectPath, avroBuffer.Bytes())
+}
+
+func (t *icebergTable) writeMetadata(ctx context.Context, metadata *icebergTableMetadata, version int) (err error) {
+	metadataBytes, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = t.store.writeObject(ctx, t.metadataPath(version), metadataBytes); err != nil {
+		return err
+	}
+
+	if err = t.store.writeObject(ctx, icebergVersionHintPath, []byte(strconv.Itoa(version))); err != nil {
+		return err
+	}
+
+	t.metadata = metadata
+	t.version = version
+
+	return nil
+}
+
+// newDataFile describes a written block for a manifest entry.
+func (t *icebergTable) newDataFile(block *Block, filePath string, fileSizeInBytes int64) (dataFile *icebergDataFile, err error) {
+	partition, err := t.partitionValues(block)
+	if err != nil {
+		return nil, err
+	}
+
+	dataFile = &icebergDataFile{
+		FilePath:        t.store.objectURI(filePath),
+		Partition:       partition,
+		RecordCount:     int64(len(block.Rows)),
+		FileSizeInBytes: fileSizeInBytes,
+		ValueCounts:     make(map[int]int64),
+		NullValueCounts: make(map[int]int64),
+		LowerBounds:     make(map[int][]byte),
+		UpperBounds:     make(map[int][]byte),
+	}
+
+	if block.Statistics == nil {
+		return dataFile, nil
+	}
+
+	for name, columnStatistics := range block.Statistics.Columns {
+		column, exists := t.columns[name]
+		if !exists {
+			continue
+		}
+
+		dataFile.ValueCounts[column.ID] = columnStatistics.ValueCount + columnStatistics.NullCount
+		dataFile.NullValueCounts[column.ID] = columnStatistics.NullCount
+
+		if lowerBound, ok := icebergSingleValue(column.Type, columnStatistics.Min); ok {
+			dataFile.LowerBounds[column.ID] = lowerBound
+		}
+
+		if upperBound, ok := icebergSingleValue(column.Type, columnStatistics.Max); ok {
+			dataFile.UpperBounds[column.ID] = upperBound
+		}
+	}
+
+	return dataFile, nil
+}
+
+func (t *icebergTable) partitionValues(block *Block) (partition map[string]interface{}, err error) {
+	partition = make(map[string]interface{})
+
+	if len(block.Rows) == 0 {
+		return nil, errors.New("partitionValues: block has no rows")
+	}
+
+	values, err := t.partitionSpec.PartitionValues(block.Rows[0])
+	if err != nil {
+		return nil, err
+	}
+
+	for i, partitionField := range t.partitionFields {
+		partition[partitionField.Name] = icebergPartitionValue(t.partitionTypes[i], values[i])
+	}
+
+	return partition, nil
+}
+
+// icebergPartitionType is the Iceberg type of a partition field's values. Day
+// and hour transforms over long columns, including timestamp-millis ones, are
+// rejected: Iceberg only applies them to timestamps, which it reads as
+// microseconds, so declaring a millisecond column one would misdate its rows.
+func icebergPartitionType(field *PartitionField, sourceType string) (partitionType string, err error) {
+	switch field.Transform {
+	case DayTransform, HourTransform:
+		if sourceType != "timestamp" && sourceType != "date" {
+			return "", fmt.Errorf("icebergPartitionType: Iceberg %s transforms need a timestamp-micros or date column, but %s is a %s column", field.icebergTransform(), field.SourceColumn, sourceType)
+		}
+		if field.Transform == DayTransform {
+			return "date", nil
+		}
+		return "int", nil
+	case BucketTransform:
+		return "int", nil
+	}
+
+	switch sourceType {
+	case "boolean", "int", "long", "float", "double", "string", "date", "timestamp":
+		return sourceType, nil
+	}
+
+	return "", fmt.Errorf("icebergPartitionType: partitions on %s columns are not supported", sourceType)
+}
+
+func icebergPartitionValue(icebergType string, value interface{}) interface{} {
+	timestamp, ok := value.(time.Time)
+	if !ok {
+		return value
+	}
+
+	// date columns are days, timestamp columns microseconds, and
+	// timestamp-millis columns remain longs
+	switch icebergType {
+	case "date":
+		if days, ok := icebergDate(timestamp); ok {
+			return days
+		}
+		return value
+	case "timestamp":
+		return timestamp.UnixNano() / int64(time.Microsecond)
+	}
+
+	return timestamp.UnixNano() / int64(time.Millisecond)
+}
+
+// appendBlock records a block written to filePath, relative to the table
+// root, as a new append snapshot.
+func (t *icebergTable) appendBlock(ctx context.Context, block *Block, filePath string, fileSizeInBytes int64) (err error) {
+	dataFile, err := t.newDataFile(block, filePath, fileSizeInBytes)
+	if err != nil {
+		return err
+	}
+
+	return t.commit(ctx, []*icebergDataFile{dataFile}, nil)
+}
+
+// commit writes a snapshot adding and removing data files. Appends reuse the
+// current manifests and add one more. The manifests listing removed files are
+// rewritten, along with every manifest once there are icebergMaxManifests of
+// them, into the new manifest, whose existing entries keep the snapshot ids
+// they were added with.
+func (t *icebergTable) commit(ctx context.Context, added []*icebergDataFile, removedPaths []string) (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var newlyAdded []*icebergDataFile
+	for _, dataFile := range added {
+		if _, exists := t.dataFiles[dataFile.FilePath]; !exists {
+			newlyAdded = append(newlyAdded, dataFile)
+		}
+	}
+
+	var removed []*icebergDataFile
+	for _, removedPath := range removedPaths {
+		if dataFile, exists := t.dataFiles[t.store.objectURI(removedPath)]; exists {
+			removed = append(removed, dataFile)
+		}
+	}
+
+	if len(newlyAdded) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	snapshotID := newSnapshotID()
+	nowMs := time.Now().UnixNano() / int64(time.Millisecond)
+
+	removedSet := make(map[string]bool)
+	rewrittenManifests := make(map[string]bool)
+	for _, dataFile := range removed {
+		removedSet[dataFile.FilePath] = true
+		rewrittenManifests[dataFile.ManifestPath] = true
+	}
+
+	if len(t.manifests) >= icebergMaxManifests {
+		for _, manifest := range t.manifests {
+			rewrittenManifests[icebergManifestPath(manifest)] = true
+		}
+	}
+
+	var manifests []interface{}
+	for _, manifest := range t.manifests {
+		if !rewrittenManifests[icebergManifestPath(manifest)] {
+			manifests = append(manifests, manifest)
+		}
+	}
+
+	var entries []interface{}
+	var existing []*icebergDataFile
+	for path, dataFile := range t.dataFiles {
+		if rewrittenManifests[dataFile.ManifestPath] && !removedSet[path] {
+			existing = append(existing, dataFile)
+			entries = append(entries, t.manifestEntry(icebergStatusExisting, dataFile.SnapshotID, dataFile))
+		}
+	}
+
+	for _, dataFile := range removed {
+		entries = append(entries, t.manifestEntry(icebergStatusDeleted, snapshotID, dataFile))
+	}
+
+	for _, dataFile := range newlyAdded {
+		entries = append(entries, t.manifestEntry(icebergStatusAdded, snapshotID, dataFile))
+	}
+
+	manifestPath := fmt.Sprintf("%s/%s-m0.avro", icebergMetadataPath, newUUID())
+	manifestLength, err := t.writeAvroObject(ctx, manifestPath, t.manifestCodec, t.manifestMetadata(), entries)
+	if err != nil {
+		return err
+	}
+
+	manifest := t.manifestListEntry(manifestPath, manifestLength, snapshotID, newlyAdded, existing, removed)
+	manifests = append(manifests, manifest)
+
+	manifestListPath := fmt.Sprintf("%s/snap-%d-1-%s.avro", icebergMetadataPath, snapshotID, newUUID())
+	manifestListMetadata := map[string]string{
+		"snapshot-id":    strconv.FormatInt(snapshotID, 10),
+		"format-version": "1",
+	}
+
+	var parentSnapshotID *int64
+	if t.metadata.CurrentSnapshotID != -1 {
+		parentID := t.metadata.CurrentSnapshotID
+		parentSnapshotID = &parentID
+		manifestListMetadata["parent-snapshot-id"] = strconv.FormatInt(parentID, 10)
+	}
+
+	if _, err = t.writeAvroObject(ctx, manifestListPath, t.manifestListCodec, manifestListMetadata, manifests); err != nil {
+		return err
+	}
+
+	operation := "append"
+	switch {
+	case len(removed) > 0 && len(newlyAdded) > 0:
+		operation = "overwrite"
+	case len(removed) > 0:
+		operation = "delete"
+	}
+
+	var addedRecords, removedRecords int64
+	for _, dataFile := range newlyAdded {
+		addedRecords += dataFile.RecordCount
+	}
+	for _, dataFile := range removed {
+		removedRecords += dataFile.RecordCount
+	}
+
+	metadata := *t.metadata
+	metadata.LastUpdatedMs = nowMs
+	metadata.CurrentSnapshotID = snapshotID
+	metadata.Snapshots = append(append([]*icebergSnapshot{}, t.metadata.Snapshots...), &icebergSnapshot{
+		SnapshotID:       snapshotID,
+		ParentSnapshotID: parentSnapshotID,
+		TimestampMs:      nowMs,
+		ManifestList:     t.store.objectURI(manifestListPath),
+		Summary: map[string]string{
+			"operation":          operation,
+			"added-data-files":   strconv.Itoa(len(newlyAdded)),
+			"deleted-data-files": strconv.Itoa(len(removed)),
+			"added-records":      strconv.FormatInt(addedRecords, 10),
+			"deleted-records":    strconv.FormatInt(removedRecords, 10),
+		},
+		SchemaID: t.metadata.CurrentSchemaID,
+	})
+	metadata.SnapshotLog = append(append([]*icebergSnapshotLogEntry{}, t.metadata.SnapshotLog...), &icebergSnapshotLogEntry{
+		TimestampMs: nowMs,
+		SnapshotID:  snapshotID,
+	})
+	metadata.MetadataLog = append(append([]*icebergMetadataLogEntry{}, t.metadata.MetadataLog...), &icebergMetadataLogEntry{
+		TimestampMs:  t.metadata.LastUpdatedMs,
+		MetadataFile: t.store.objectURI(t.metadataPath(t.version)),
+	})
+
+	var expiredSnapshots []*icebergSnapshot
+	if excess := len(metadata.Snapshots) - icebergMaxSnapshots; excess > 0 {
+		expiredSnapshots = metadata.Snapshots[:excess]
+		metadata.Snapshots = metadata.Snapshots[excess:]
+	}
+
+	if excess := len(metadata.SnapshotLog) - icebergMaxSnapshots; excess > 0 {
+		metadata.SnapshotLog = metadata.SnapshotLog[excess:]
+	}
+
+	var expiredMetadata []*icebergMetadataLogEntry
+	if excess := len(metadata.MetadataLog) - icebergMaxMetadataVersions; excess > 0 {
+		expiredMetadata = metadata.MetadataLog[:excess]
+		metadata.MetadataLog = metadata.MetadataLog[excess:]
+	}
+
+	if err = t.writeMetadata(ctx, &metadata, t.version+1); err != nil {
+		return err
+	}
+
+	manifestURI := t.store.objectURI(manifestPath)
+
+	t.manifests = manifests
+	for _, dataFile := range removed {
+		delete(t.dataFiles, dataFile.FilePath)
+	}
+	for _, dataFile := range existing {
+		dataFile.ManifestPath = manifestURI
+	}
+	for _, dataFile := range newlyAdded {
+		dataFile.SnapshotID = snapshotID
+		dataFile.ManifestPath = manifestURI
+		t.dataFiles[dataFile.FilePath] = dataFile
+	}
+
+	t.expire(ctx, expiredSnapshots, metadata.Snapshots[0], expiredMetadata)
+
+	return nil
+}
+
+// expire deletes the manifest lists of expired snapshots, the manifests no
+// retained snapshot references and the files of expired metadata versions.
+// A manifest stays listed from the snapshot that writes it until one rewrites
+// it, so a manifest of an expired snapshot that oldestRetained does not list
+// is not listed by any later snapshot either. Failures are only logged, as
+// they leave the table intact.
+func (t *icebergTable) expire(ctx context.Context, snapshots []*icebergSnapshot, oldestRetained *icebergSnapshot, metadataLog []*icebergMetadataLogEntry) {
+	var expiredPaths []string
+
+	if len(snapshots) > 0 {
+		expiredPaths = append(expiredPaths, t.unreferencedManifests(ctx, snapshots, oldestRetained)...)
+	}
+
+	for _, snapshot := range snapshots {
+		expiredPaths = append(expiredPaths, t.relativePath(snapshot.ManifestList))
+	}
+	for _, entry := range metadataLog {
+		expiredPaths = append(expiredPaths, t.relativePath(entry.MetadataFile))
+	}
+
+	for _, expiredPath := range expiredPaths {
+		if err := t.store.deleteObject(ctx, expiredPath); err != nil && err != errObjectNotFound {
+			t.store.logger().Warn("icebergTable failed to delete expired metadata", "path", expiredPath, "error", err)
+		}
+	}
+}
+
+// unreferencedManifests returns the paths of the manifests listed by expired
+// snapshots but not by oldestRetained.
+func (t *icebergTable) unreferencedManifests(ctx context.Context, snapshots []*icebergSnapshot, oldestRetained *icebergSnapshot) (manifestPaths []string) {
+	retainedManifests, err := t.readAvroObject(ctx, oldestRetained.ManifestList)
+	if err != nil {
+		t.store.logger().Warn("icebergTable failed to read retained manifest list", "path", oldestRetained.ManifestList, "error", err)
+		return nil
+	}
+
+	referenced := make(map[string]bool)
+	for _, manifest := range retainedManifests {
+		referenced[icebergManifestPath(manifest)] = true
+	}
+
+	for _, snapshot := range snapshots {
+		manifests, err := t.readAvroObject(ctx, snapshot.ManifestList)
+		if err != nil {
+			t.store.logger().Warn("icebergTable failed to read expired manifest list", "path", snapshot.ManifestList, "error", err)
+			continue
+		}
+
+		for _, manifest := range manifests {
+			// marking it referenced lists a manifest shared by several expired snapshots once
+			manifestPath := icebergManifestPath(manifest)
+			if !referenced[manifestPath] {
+				referenced[manifestPath] = true
+				manifestPaths = append(manifestPaths, t.relativePath(manifestPath))
+			}
+		}
+	}
+
+	return manifestPaths
+}
+
+func icebergManifestPath(manifest interface{}) string {
+	return manifest.(map[string]interface{})["manifest_path"].(string)
+}
+
+func (t *icebergTable) manifestMetadata() map[string]string {
+	schemaBytes, _ := json.Marshal(t.schema)
+	partitionSpecBytes, _ := json.Marshal(t.partitionFields)
+
+	return map[string]string{
+		"schema":            string(schemaBytes),
+		"partition-spec":    string(partitionSpecBytes),
+		"partition-spec-id": "0",
+		"format-version":    "1",
+	}
+}
+
+func (t *icebergTable) manifestEntry(status int32, snapshotID int64, dataFile *icebergDataFile) interface{} {
+	partition := make(map[string]interface{})
+	for i, partitionField := range t.partitionFields {
+		value := dataFile.Partition[partitionField.Name]
+		if value == nil {
+			partition[partitionField.Name] = nil
+		} else {
+			partition[partitionField.Name] = goavro.Union(icebergAvroType(t.partitionTypes[i]), value)
+		}
+	}
+
+	return map[string]interface{}{
+		"status":      status,
+		"snapshot_id": goavro.Union("long", snapshotID),
+		"data_file": map[string]interface{}{
+			"file_path":           dataFile.FilePath,
+			"file_format":         "AVRO",
+			"partition":           partition,
+			"record_count":        dataFile.RecordCount,
+			"file_size_in_bytes":  dataFile.FileSizeInBytes,
+			"block_size_in_bytes": int64(64 * 1024 * 1024),
+			"value_counts":        icebergCountsNative(dataFile.ValueCounts),
+			"null_value_counts":   icebergCountsNative(dataFile.NullValueCounts),
+			"lower_bounds":        icebergBoundsNative(dataFile.LowerBounds),
+			"upper_bounds":        icebergBoundsNative(dataFile.UpperBounds),
+		},
+	}
+}
+
+func (t *icebergTable) manifestListEntry(manifestPath string, manifestLength int64, snapshotID int64, added []*icebergDataFile, existing []*icebergDataFile, removed []*icebergDataFile) interface{} {
+	countRows := func(dataFiles []*icebergDataFile) (rows int64) {
+		for _, dataFile := range dataFiles {
+			rows += dataFile.RecordCount
+		}
+		return rows
+	}
+
+	return map[string]interface{}{
+		"manifest_path":             t.store.objectURI(manifestPath),
+		"manifest_length":           manifestLength,
+		"partition_spec_id":         int32(0),
+		"added_snapshot_id":         goavro.Union("long", snapshotID),
+		"added_data_files_count":    goavro.Union("int", int32(len(added))),
+		"existing_data_files_count": goavro.Union("int", int32(len(existing))),
+		"deleted_data_files_count":  goavro.Union("int", int32(len(removed))),
+		"partitions":                nil,
+		"added_rows_count":          goavro.Union("long", countRows(added)),
+		"existing_rows_count":       goavro.Union("long", countRows(existing)),
+		"deleted_rows_count":        goavro.Union("long", countRows(removed)),
+	}
+}
+
+func icebergCountsNative(counts map[int]int64) interface{} {
+	if len(counts) == 0 {
+		return nil
+	}
+
+	entries := make([]interface{}, 0, len(counts))
+	for id, count := range counts {
+		entries = append(entries, map[string]interface{}{"key": int32(id), "value": count})
+	}
+
+	return goavro.Union("array", entries)
+}
+
+func icebergBoundsNative(bounds map[int][]byte) interface{} {
+	if len(bounds) == 0 {
+		return nil
+	}
+
+	entries := make([]interface{}, 0, len(bounds))
+	for id, bound := range bounds {
+		entries = append(entries, map[string]interface{}{"key": int32(id), "value": bound})
+	}
+
+	return goavro.Union("array", entries)
+}
+
+func icebergDataFileFromNative(native map[string]interface{}) *icebergDataFile {
+	dataFile := &icebergDataFile{
+		FilePath:        native["file_path"].(string),
+		Partition:       make(map[string]interface{}),
+		RecordCount:     native["record_count"].(int64),
+		FileSizeInBytes: native["file_size_in_bytes"].(int64),
+		ValueCounts:     make(map[int]int64),
+		NullValueCounts: make(map[int]int64),
+		LowerBounds:     make(map[int][]byte),
+		UpperBounds:     make(map[int][]byte),
+	}
+
+	for name, value := range native["partition"].(map[string]interface{}) {
+		dataFile.Partition[name] = unwrapUnion(value)
+	}
+
+	keyValues := func(column string) []interface{} {
+		entries, _ := unwrapUnion(native[column]).([]interface{})
+		return entries
+	}
+
+	for _, entry := range keyValues("value_counts") {
+		entryMap := entry.(map[string]interface{})
+		dataFile.ValueCounts[int(entryMap["key"].(int32))] = entryMap["value"].(int64)
+	}
+
+	for _, entry := range keyValues("null_value_counts") {
+		entryMap := entry.(map[string]interface{})
+		dataFile.NullValueCounts[int(entryMap["key"].(int32))] = entryMap["value"].(int64)
+	}
+
+	for _, entry := range keyValues("lower_bounds") {
+		entryMap := entry.(map[string]interface{})
+		dataFile.LowerBounds[int(entryMap["key"].(int32))] = entryMap["value"].([]byte)
+	}
+
+	for _, entry := range keyValues("upper_bounds") {
+		entryMap := entry.(map[string]interface{})
+		dataFile.UpperBounds[int(entryMap["key"].(int32))] = entryMap["value"].([]byte)
+	}
+
+	return dataFile
+}
+
+func (t *icebergTable) manifestSchema() string {
+	partitionFields := make([]string, len(t.partitionFields))
+	for i, partitionField := range t.partitionFields {
+		partitionFields[i] = fmt.Sprintf(`{"name": "%s", "type": ["null", "%s"], "default": null, "field-id": %d}`,
+			partitionField.Name, icebergAvroType(t.partitionTypes[i]), partitionField.FieldID)
+	}
+
+	return fmt.Sprintf(icebergManifestSchemaTemplate, strings.Join(partitionFields, ", "))
+}
+
+const icebergManifestSchemaTemplate = `{
+	"type": "record",
+	"name": "manifest_entry",
+	"fields": [
+		{ "name": "status", "type": "int", "field-id": 0 },
+		{ "name": "snapshot_id", "type": ["null", "long"], "default": null, "field-id": 1 },
+		{
+			"name": "data_file",
+			"field-id": 2,
+			"type": {
+				"type": "record",
+				"name": "r2",
+				"fields": [
+					{ "name": "file_path", "type": "string", "field-id": 100 },
+					{ "name": "file_format", "type": "string", "field-id": 101 },
+					{ "name": "partition", "type": { "type": "record", "name": "r102", "fields": [%s] }, "field-id": 102 },
+					{ "name": "record_count", "type": "long", "field-id": 103 },
+					{ "name": "file_size_in_bytes", "type": "long", "field-id": 104 },
+					{ "name": "block_size_in_bytes", "type": "long", "field-id": 105 },
+					{
+						"name": "value_counts",
+						"type": ["null", { "type": "array", "logicalType": "map", "items": { "type": "record", "name": "k119_v120", "fields": [
+							{ "name": "key", "type": "int", "field-id": 119 },
+							{ "name": "value", "type": "long", "field-id": 120 }
+						] } }],
+						"default": null,
+						"field-id": 109
+					},
+					{
+						"name": "null_value_counts",
+						"type": ["null", { "type": "array", "logicalType": "map", "items": { "type": "record", "name": "k121_v122", "fields": [
+							{ "name": "key", "type": "int", "field-id": 121 },
+							{ "name": "value", "type": "long", "field-id": 122 }
+						] } }],
+						"default": null,
+						"field-id": 110
+					},
+					{
+						"name": "lower_bounds",
+						"type": ["null", { "type": "array", "logicalType": "map", "items": { "type": "record", "name": "k126_v127", "fields": [
+							{ "name": "key", "type": "int", "field-id": 126 },
+							{ "name": "value", "type": "bytes", "field-id": 127 }
+						] } }],
+						"default": null,
+						"field-id": 125
+					},
+					{
+						"name": "upper_bounds",
+						"type": ["null", { "type": "array", "logicalType": "map", "items": { "type": "record", "name": "k129_v130", "fields": [
+							{ "name": "key", "type": "int", "field-id": 129 },
+							{ "name": "value", "type": "bytes", "field-id": 130 }
+						] } }],
+						"default": null,
+						"field-id": 128
+					}
+				]
+			}
+		}
+	]
+}`
+
+const icebergManifestListSchema = `{
+	"type": "record",
+	"name": "manifest_file",
+	"fields": [
+		{ "name": "manifest_path", "type": "string", "field-id": 500 },
+		{ "name": "manifest_length", "type": "long", "field-id": 501 },
+		{ "name": "partition_spec_id", "type": "int", "field-id": 502 },
+		{ "name": "added_snapshot_id", "type": ["null", "long"], "default": null, "field-id": 503 },
+		{ "name": "added_data_files_count", "type": ["null", "int"], "default": null, "field-id": 504 },
+		{ "name": "existing_data_files_count", "type": ["null", "int"], "default": null, "field-id": 505 },
+		{ "name": "deleted_data_files_count", "type": ["null", "int"], "default": null, "field-id": 506 },
+		{
+			"name": "partitions",
+			"type": ["null", { "type": "array", "element-id": 508, "items": { "type": "record", "name": "r508", "fields": [
+				{ "name": "contains_null", "type": "boolean", "field-id": 509 },
+				{ "name": "lower_bound", "type": ["null", "bytes"], "default": null, "field-id": 510 },
+				{ "name": "upper_bound", "type": ["null", "bytes"], "default": null, "field-id": 511 }
+			] } }],
+			"default": null,
+			"field-id": 507
+		},
+		{ "name": "added_rows_count", "type": ["null", "long"], "default": null, "field-id": 512 },
+		{ "name": "existing_rows_count", "type": ["null", "long"], "default": null, "field-id": 513 },
+		{ "name": "deleted_rows_count", "type": ["null", "long"], "default": null, "field-id": 514 }
+	]
+}`
+
+func newUUID() string {
+	uuid := make([]byte, 16)
+	rand.Read(uuid)
+
+	uuid[6] = (uuid[6] & 0x0f) | 0x40 // version 4
+	uuid[8] = (uuid[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+func newSnapshotID() int64 {
+	snapshotID, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return time.Now().UnixNano()
+	}
+
+	return snapshotID.Int64() + 1
+}
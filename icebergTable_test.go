@@ -0,0 +1,312 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	goavro "github.com/linkedin/goavro/v2"
+)
+
+func TestIcebergSchemaFromAvro(t *testing.T) {
+	log.Println("Starting TestIcebergSchemaFromAvro")
+
+	schema, builder, err := newIcebergSchema(GetCodecFixture().Schema())
+	if err != nil {
+		t.Fatalf("newIcebergSchema failed with error: %s", err)
+	}
+
+	if len(schema.Fields) != 11 {
+		t.Errorf("Iceberg schema has wrong number of fields: %d vs. 11", len(schema.Fields))
+	}
+
+	if builder.lastID != 12 {
+		t.Errorf("Iceberg schema last column id incorrect: %d vs. 12", builder.lastID)
+	}
+
+	timestampColumn := builder.columns["timestamp"]
+	if timestampColumn == nil || timestampColumn.Type != "long" || timestampColumn.ID != 10 {
+		t.Errorf("Iceberg schema timestamp column incorrect: %+v", timestampColumn)
+	}
+
+	if schema.Fields[0].Required {
+		t.Errorf("Iceberg schema optional field accuracy marked required")
+	}
+
+	if _, isPrimitive := builder.columns["features"]; isPrimitive {
+		t.Errorf("Iceberg schema list field features reported as primitive column")
+	}
+
+	log.Println("Finished TestIcebergSchemaFromAvro")
+}
+
+func TestFilesystemStorageAdapterIcebergMetadata(t *testing.T) {
+	log.Println("Starting TestFilesystemStorageAdapterIcebergMetadata")
+
+	fixtureMap := GetFixtureMap()
+	input := make(chan *Block)
+
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath:        "./test/iceberg",
+		Codec:           GetCodecFixture(),
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		CompressionName: "snappy",
+		IcebergMetadata: true,
+		Input:           input,
+	}
+
+	err := filesystemStorageAdapter.Start(context.Background())
+	if err != nil {
+		t.Fatalf("filesystemStorageAdapter failed to start: %s", err)
+	}
+
+	block := NewBlock(fixtureMap["user_id"].(string), filesystemStorageAdapter.KeyColumn, filesystemStorageAdapter.Codec)
+	block.Write(GetNativeFixture())
+
+	input <- block
+	close(input)
+
+	filesystemStorageAdapter.Stop(context.Background())
+
+	versionHint, err := ioutil.ReadFile("./test/iceberg/metadata/version-hint.text")
+	if err != nil {
+		t.Fatalf("Iceberg version hint missing: %s", err)
+	}
+
+	metadataBytes, err := ioutil.ReadFile("./test/iceberg/metadata/v" + strings.TrimSpace(string(versionHint)) + ".metadata.json")
+	if err != nil {
+		t.Fatalf("Iceberg metadata missing: %s", err)
+	}
+
+	metadata := &icebergTableMetadata{}
+	if err = json.Unmarshal(metadataBytes, metadata); err != nil {
+		t.Fatalf("Iceberg metadata failed to parse: %s", err)
+	}
+
+	if metadata.CurrentSnapshotID == -1 || len(metadata.Snapshots) == 0 {
+		t.Errorf("Iceberg metadata has no current snapshot")
+	}
+
+	if filesystemStorageAdapter.table.dataFiles[filesystemStorageAdapter.objectURI("userid1/timestamp/"+block.GetFilename())] == nil {
+		t.Errorf("Iceberg table does not reference written block")
+	}
+
+	log.Println("Finished TestFilesystemStorageAdapterIcebergMetadata")
+}
+
+func TestIcebergMetadataRejectsLongDayPartitions(t *testing.T) {
+	log.Println("Starting TestIcebergMetadataRejectsLongDayPartitions")
+
+	basePath := "./test/iceberg-long-day"
+	os.RemoveAll(basePath)
+	defer os.RemoveAll(basePath)
+
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath: basePath,
+		Codec:    GetCodecFixture(),
+		PartitionSpec: &PartitionSpec{
+			Fields: []PartitionField{
+				{SourceColumn: "timestamp", Transform: DayTransform},
+			},
+		},
+		KeyColumn:       "timestamp",
+		IcebergMetadata: true,
+		Input:           make(chan *Block),
+	}
+
+	// timestamp holds milliseconds in a long, which Iceberg cannot partition by day
+	if err := filesystemStorageAdapter.Start(context.Background()); err == nil {
+		t.Fatalf("filesystemStorageAdapter started with a day transform over a long column")
+	}
+
+	if _, err := os.Stat(basePath + "/metadata"); !os.IsNotExist(err) {
+		t.Errorf("filesystemStorageAdapter wrote Iceberg metadata for a spec it rejected: %v", err)
+	}
+
+	log.Println("Finished TestIcebergMetadataRejectsLongDayPartitions")
+}
+
+func TestIcebergTableDatePartitions(t *testing.T) {
+	log.Println("Starting TestIcebergTableDatePartitions")
+
+	codec, err := goavro.NewCodec(`{
+		"type": "record",
+		"name": "visit",
+		"fields": [
+			{ "name": "visited", "type": { "type": "int", "logicalType": "date" } },
+			{ "name": "timestamp", "type": "long" }
+		]
+	}`)
+	if err != nil {
+		t.Fatalf("NewCodec failed with error: %s", err)
+	}
+
+	store := &failingObjectStore{objects: make(map[string][]byte)}
+	partitionSpec := resolvePartitionSpec(nil, "visited")
+
+	table, err := newIcebergTable(context.Background(), store, codec, partitionSpec)
+	if err != nil {
+		t.Fatalf("newIcebergTable failed with error: %s", err)
+	}
+
+	// 2021-03-04 is 18690 days after the epoch
+	visited := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	const visitedDays = int32(18690)
+
+	block := NewBlock("visited=2021-03-04", "timestamp", codec)
+	block.Write(map[string]interface{}{"visited": visited, "timestamp": int64(1614816000000)})
+
+	if err := table.appendBlock(context.Background(), block, "visited=2021-03-04/timestamp/block.avro", 100); err != nil {
+		t.Fatalf("appendBlock failed with error: %s", err)
+	}
+
+	// a reloaded table reads the partition back from the manifest
+	reloaded, err := newIcebergTable(context.Background(), store, codec, partitionSpec)
+	if err != nil {
+		t.Fatalf("newIcebergTable failed to reload with error: %s", err)
+	}
+
+	dataFile := reloaded.dataFiles[store.objectURI("visited=2021-03-04/timestamp/block.avro")]
+	if dataFile == nil {
+		t.Fatalf("Iceberg table does not reference the date partitioned block")
+	}
+
+	if days, ok := dataFile.Partition["visited"].(int32); !ok || days != visitedDays {
+		t.Errorf("Iceberg date partition is not days since the epoch: %#v vs. %d", dataFile.Partition["visited"], visitedDays)
+	}
+
+	expectedBound, _ := icebergSingleValue("int", visitedDays)
+	visitedID := reloaded.columns["visited"].ID
+	if !bytes.Equal(dataFile.LowerBounds[visitedID], expectedBound) || !bytes.Equal(dataFile.UpperBounds[visitedID], expectedBound) {
+		t.Errorf("Iceberg date bounds are wrong: %v, %v vs. %v", dataFile.LowerBounds[visitedID], dataFile.UpperBounds[visitedID], expectedBound)
+	}
+
+	log.Println("Finished TestIcebergTableDatePartitions")
+}
+
+func TestIcebergTableCommitsStayBounded(t *testing.T) {
+	log.Println("Starting TestIcebergTableCommitsStayBounded")
+
+	store := &failingObjectStore{objects: make(map[string][]byte)}
+
+	table, err := newIcebergTable(context.Background(), store, GetCodecFixture(), resolvePartitionSpec(nil, "user_id"))
+	if err != nil {
+		t.Fatalf("newIcebergTable failed with error: %s", err)
+	}
+
+	commits := icebergMaxSnapshots + icebergMaxManifests/2
+	var firstSnapshotID int64
+
+	for i := 0; i < commits; i++ {
+		dataFile := &icebergDataFile{
+			FilePath:    store.objectURI(fmt.Sprintf("userid1/timestamp/block-%d.avro", i)),
+			Partition:   map[string]interface{}{},
+			RecordCount: 1,
+		}
+
+		if err := table.commit(context.Background(), []*icebergDataFile{dataFile}, nil); err != nil {
+			t.Fatalf("commit %d failed with error: %s", i, err)
+		}
+
+		if i == 0 {
+			firstSnapshotID = table.metadata.CurrentSnapshotID
+		}
+	}
+
+	if len(table.metadata.Snapshots) != icebergMaxSnapshots {
+		t.Errorf("Iceberg table kept wrong number of snapshots: %d vs. %d", len(table.metadata.Snapshots), icebergMaxSnapshots)
+	}
+
+	if len(table.metadata.MetadataLog) != icebergMaxMetadataVersions {
+		t.Errorf("Iceberg table kept wrong number of metadata versions: %d vs. %d", len(table.metadata.MetadataLog), icebergMaxMetadataVersions)
+	}
+
+	if _, err := store.readObject(context.Background(), table.metadataPath(1)); err != errObjectNotFound {
+		t.Errorf("Iceberg table did not delete expired metadata version 1")
+	}
+
+	if len(table.manifests) > icebergMaxManifests {
+		t.Errorf("Iceberg table references too many manifests: %d vs. at most %d", len(table.manifests), icebergMaxManifests)
+	}
+
+	if err := table.commit(context.Background(), nil, []string{"userid1/timestamp/block-1.avro"}); err != nil {
+		t.Fatalf("commit removing a block failed with error: %s", err)
+	}
+
+	// a reloaded table sees the entries with the snapshot ids that added them
+	reloaded, err := newIcebergTable(context.Background(), store, GetCodecFixture(), resolvePartitionSpec(nil, "user_id"))
+	if err != nil {
+		t.Fatalf("newIcebergTable failed to reload with error: %s", err)
+	}
+
+	if len(reloaded.dataFiles) != commits-1 {
+		t.Errorf("Reloaded Iceberg table has wrong number of data files: %d vs. %d", len(reloaded.dataFiles), commits-1)
+	}
+
+	firstDataFile := reloaded.dataFiles[store.objectURI("userid1/timestamp/block-0.avro")]
+	if firstDataFile == nil || firstDataFile.SnapshotID != firstSnapshotID {
+		t.Errorf("Iceberg manifest entry lost the snapshot id that added it: %+v vs. %d", firstDataFile, firstSnapshotID)
+	}
+
+	log.Println("Finished TestIcebergTableCommitsStayBounded")
+}
+
+func TestIcebergTableExpiresManifests(t *testing.T) {
+	log.Println("Starting TestIcebergTableExpiresManifests")
+
+	store := &failingObjectStore{objects: make(map[string][]byte)}
+
+	table, err := newIcebergTable(context.Background(), store, GetCodecFixture(), resolvePartitionSpec(nil, "user_id"))
+	if err != nil {
+		t.Fatalf("newIcebergTable failed with error: %s", err)
+	}
+
+	// the manifests of the oldest retained snapshot and one per later commit
+	maxManifestFiles := icebergMaxManifests + icebergMaxSnapshots
+	commits := 3 * maxManifestFiles
+
+	for i := 0; i < commits; i++ {
+		dataFile := &icebergDataFile{
+			FilePath:    store.objectURI(fmt.Sprintf("userid1/timestamp/block-%d.avro", i)),
+			Partition:   map[string]interface{}{},
+			RecordCount: 1,
+		}
+
+		// every other commit replaces the previous block, rewriting the manifest listing it
+		var removedPaths []string
+		if i%2 == 1 {
+			removedPaths = []string{fmt.Sprintf("userid1/timestamp/block-%d.avro", i-1)}
+		}
+
+		if err := table.commit(context.Background(), []*icebergDataFile{dataFile}, removedPaths); err != nil {
+			t.Fatalf("commit %d failed with error: %s", i, err)
+		}
+	}
+
+	manifestFiles := 0
+	for objectPath := range store.objects {
+		if strings.HasSuffix(objectPath, "-m0.avro") {
+			manifestFiles++
+		}
+	}
+
+	if manifestFiles > maxManifestFiles {
+		t.Errorf("Iceberg table kept too many manifest files: %d vs. at most %d", manifestFiles, maxManifestFiles)
+	}
+
+	for _, manifest := range table.manifests {
+		if _, err := store.readObject(context.Background(), table.relativePath(icebergManifestPath(manifest))); err != nil {
+			t.Errorf("Iceberg table deleted a current manifest: %s", err)
+		}
+	}
+
+	log.Println("Finished TestIcebergTableExpiresManifests")
+}
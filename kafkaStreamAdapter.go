@@ -0,0 +1,455 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	goavro "github.com/linkedin/goavro/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	confluentMagicByte    = 0
+	confluentHeaderLength = 5 // magic byte and 4 byte schema id
+)
+
+// KafkaStreamAdapter consumes Avro encoded messages from every partition of
+// Topic, or those listed in Partitions, and emits them as TrackedRows. A
+// message's offset is only committed for GroupID once the block holding its
+// row has been durably written, and never past an offset whose row is still
+// pending, which gives at-least-once delivery from Kafka to storage.
+//
+// Trace context carried in a message's headers is the parent of the span
+// consuming it, which the commit of the block holding its row links to.
+//
+// Partitions are assigned statically rather than through group rebalancing,
+// so each adapter sharing a GroupID should be given disjoint Partitions.
+type KafkaStreamAdapter struct {
+	Brokers    []string
+	Topic      string
+	GroupID    string
+	Partitions []int32 // defaults to all partitions of Topic
+
+	InitialOffset       int64          // sarama.OffsetOldest (the default) or sarama.OffsetNewest, used if GroupID has no committed offset
+	ConfluentWireFormat bool           // messages carry the Confluent schema registry header before the Avro binary
+	Config              *sarama.Config // defaults to sarama.NewConfig() at Kafka 1.0; set Version to 0.11 or later for trace context in headers
+
+	Codec *goavro.Codec
+
+	Output         chan interface{}
+	Errors         chan error
+	Logger         Logger               // defaults to slog.Default()
+	TracerProvider trace.TracerProvider // defaults to the global provider
+
+	client                  sarama.Client
+	consumer                sarama.Consumer
+	offsetManager           sarama.OffsetManager
+	partitionOffsetManagers []sarama.PartitionOffsetManager
+	partitionConsumers      []sarama.PartitionConsumer
+	offsetTrackers          []*offsetTracker
+	consumers               sync.WaitGroup
+	done                    chan struct{}
+	closeOutputOnce         sync.Once
+}
+
+// kafkaHeaderCarrier reads and writes trace context in a message's headers.
+type kafkaHeaderCarrier []*sarama.RecordHeader
+
+func (c kafkaHeaderCarrier) Get(key string) string {
+	for _, header := range c {
+		if header != nil && string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+
+	return ""
+}
+
+// Set is unused when consuming, as a message's headers are not written back.
+func (c kafkaHeaderCarrier) Set(key string, value string) {}
+
+func (c kafkaHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for _, header := range c {
+		if header != nil {
+			keys = append(keys, string(header.Key))
+		}
+	}
+
+	return keys
+}
+
+// offsetMarker is the part of sarama.PartitionOffsetManager an offsetTracker uses.
+type offsetMarker interface {
+	MarkOffset(offset int64, metadata string)
+}
+
+// offsetTracker marks the offset following the longest run of consumed
+// messages whose rows are all durable.
+type offsetTracker struct {
+	marker  offsetMarker
+	pending []int64 // consumed offsets not yet marked, in order
+	durable map[int64]bool
+	mutex   sync.Mutex
+}
+
+func newOffsetTracker(marker offsetMarker) *offsetTracker {
+	return &offsetTracker{
+		marker:  marker,
+		durable: make(map[int64]bool),
+	}
+}
+
+func (ot *offsetTracker) track(offset int64) {
+	ot.mutex.Lock()
+	ot.pending = append(ot.pending, offset)
+	ot.mutex.Unlock()
+}
+
+// untrack forgets the offset tracked last, for a message that was never
+// emitted; it stays uncommitted and is consumed again on the next Start.
+func (ot *offsetTracker) untrack(offset int64) {
+	ot.mutex.Lock()
+	defer ot.mutex.Unlock()
+
+	if last := len(ot.pending) - 1; last >= 0 && ot.pending[last] == offset {
+		ot.pending = ot.pending[:last]
+	}
+}
+
+func (ot *offsetTracker) markDurable(offset int64) {
+	ot.mutex.Lock()
+	defer ot.mutex.Unlock()
+
+	ot.durable[offset] = true
+
+	marked := 0
+	for marked < len(ot.pending) && ot.durable[ot.pending[marked]] {
+		delete(ot.durable, ot.pending[marked])
+		marked++
+	}
+
+	if marked == 0 {
+		return
+	}
+
+	// Kafka commits the offset of the next message to consume
+	ot.marker.MarkOffset(ot.pending[marked-1]+1, "")
+	ot.pending = ot.pending[marked:]
+}
+
+func (ot *offsetTracker) outstanding() int {
+	ot.mutex.Lock()
+	defer ot.mutex.Unlock()
+
+	return len(ot.pending)
+}
+
+// reportError logs err and sends it to Errors, unless ctx ends first, as once
+// the Pipeline has stopped reading Errors.
+func (ksa *KafkaStreamAdapter) reportError(ctx context.Context, err error) {
+	ksa.logger().Error("KafkaStreamAdapter error", "topic", ksa.Topic, "error", err)
+
+	if ksa.Errors == nil {
+		return
+	}
+
+	select {
+	case ksa.Errors <- err:
+	case <-ctx.Done():
+		return
+	}
+}
+
+// decode returns the native form of a message's Avro binary value.
+func (ksa *KafkaStreamAdapter) decode(value []byte) (native interface{}, err error) {
+	if ksa.ConfluentWireFormat {
+		if len(value) < confluentHeaderLength || value[0] != confluentMagicByte {
+			return nil, errors.New("decode: message is not in Confluent wire format")
+		}
+
+		// the schema id in value[1:5] is not resolved against a registry;
+		// every message is read with Codec
+		value = value[confluentHeaderLength:]
+	}
+
+	native, remaining, err := ksa.Codec.NativeFromBinary(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(remaining) > 0 {
+		return nil, fmt.Errorf("decode: %d bytes remain after record", len(remaining))
+	}
+
+	return native, nil
+}
+
+func (ksa *KafkaStreamAdapter) consumePartition(ctx context.Context, partitionConsumer sarama.PartitionConsumer, tracker *offsetTracker) {
+	defer ksa.consumers.Done()
+
+	// keeps draining Errors after ctx ends, so the consumer can close
+	go func() {
+		for consumerError := range partitionConsumer.Errors() {
+			ksa.reportError(ctx, consumerError.Err)
+		}
+	}()
+
+	for message := range partitionConsumer.Messages() {
+		// once ctx ends nothing more is emitted or marked, so no offset after
+		// one dropped here can be committed; the rest are only drained so
+		// that the consumer can close
+		if ctx.Err() != nil {
+			continue
+		}
+
+		offset := message.Offset
+		tracker.track(offset)
+
+		native, err := ksa.decode(message.Value)
+		if err != nil {
+			// an undecodable message is skipped rather than stalling commits
+			ksa.reportError(ctx, fmt.Errorf("KafkaStreamAdapter: message %s/%d/%d: %s", message.Topic, message.Partition, offset, err))
+			tracker.markDurable(offset)
+			continue
+		}
+
+		messageContext, span := ksa.tracer().Start(extractTraceContext(ctx, kafkaHeaderCarrier(message.Headers)), "KafkaStreamAdapter.consume",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				attribute.String("messaging.destination.name", message.Topic),
+				attribute.Int("messaging.kafka.destination.partition", int(message.Partition)),
+				attribute.Int64("messaging.kafka.message.offset", offset),
+			),
+		)
+
+		trackedRow := &TrackedRow{
+			Row: native,
+			OnDurable: func() {
+				tracker.markDurable(offset)
+			},
+			Context: messageContext,
+		}
+
+		select {
+		case ksa.Output <- trackedRow:
+		case <-ctx.Done():
+			tracker.untrack(offset)
+		}
+
+		span.End()
+	}
+}
+
+func (ksa *KafkaStreamAdapter) logger() Logger {
+	return LoggerOrDefault(ksa.Logger)
+}
+
+func (ksa *KafkaStreamAdapter) tracer() trace.Tracer {
+	return tracerFrom(ksa.TracerProvider)
+}
+
+func (ksa *KafkaStreamAdapter) SetOutput(output chan interface{}, errors chan error) {
+	ksa.Output = output
+	ksa.Errors = errors
+}
+
+// Start begins consuming every partition until Stop is called or ctx is
+// cancelled. If it fails, whatever it had started is closed again and nothing
+// is emitted.
+func (ksa *KafkaStreamAdapter) Start(ctx context.Context) (err error) {
+	if len(ksa.Brokers) == 0 || len(ksa.Topic) == 0 || len(ksa.GroupID) == 0 {
+		return errors.New("KafkaStreamAdapter not correctly configured with Brokers, Topic and GroupID")
+	}
+
+	defer func() {
+		if err != nil {
+			ksa.stopConsuming()
+			ksa.close()
+		}
+	}()
+
+	// a caller's Config is copied rather than modified, as it may be shared
+	var config *sarama.Config
+	if ksa.Config != nil {
+		copied := *ksa.Config
+		config = &copied
+	} else {
+		// message headers, and so trace context, need Kafka 0.11 or later
+		config = sarama.NewConfig()
+		config.Version = sarama.V1_0_0_0
+	}
+	config.Consumer.Return.Errors = true
+
+	if ksa.client, err = sarama.NewClient(ksa.Brokers, config); err != nil {
+		return err
+	}
+
+	partitions := ksa.Partitions
+	if len(partitions) == 0 {
+		if partitions, err = ksa.client.Partitions(ksa.Topic); err != nil {
+			return err
+		}
+	}
+
+	if ksa.consumer, err = sarama.NewConsumerFromClient(ksa.client); err != nil {
+		return err
+	}
+
+	if ksa.offsetManager, err = sarama.NewOffsetManagerFromClient(ksa.GroupID, ksa.client); err != nil {
+		return err
+	}
+
+	initialOffset := ksa.InitialOffset
+	if initialOffset == 0 {
+		initialOffset = sarama.OffsetOldest
+	}
+
+	for _, partition := range partitions {
+		partitionOffsetManager, err := ksa.offsetManager.ManagePartition(ksa.Topic, partition)
+		if err != nil {
+			return err
+		}
+		ksa.partitionOffsetManagers = append(ksa.partitionOffsetManagers, partitionOffsetManager)
+
+		offset, _ := partitionOffsetManager.NextOffset()
+		if offset < 0 {
+			offset = initialOffset
+		}
+
+		partitionConsumer, err := ksa.consumer.ConsumePartition(ksa.Topic, partition, offset)
+		if err != nil {
+			return err
+		}
+
+		ksa.logger().Info("KafkaStreamAdapter consuming", "topic", ksa.Topic, "partition", partition, "offset", offset)
+
+		tracker := newOffsetTracker(partitionOffsetManager)
+		ksa.partitionConsumers = append(ksa.partitionConsumers, partitionConsumer)
+		ksa.offsetTrackers = append(ksa.offsetTrackers, tracker)
+
+		ksa.consumers.Add(1)
+		go ksa.consumePartition(ctx, partitionConsumer, tracker)
+	}
+
+	done := make(chan struct{})
+	ksa.done = done
+	ksa.closeOutputOnce = sync.Once{}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			ksa.closeOutput()
+		case <-done:
+		}
+	}()
+
+	return nil
+}
+
+// closeOutput stops consuming and closes Output once every message consumed
+// has been emitted.
+func (ksa *KafkaStreamAdapter) closeOutput() {
+	ksa.closeOutputOnce.Do(func() {
+		ksa.stopConsuming()
+		close(ksa.Output)
+		close(ksa.done)
+	})
+}
+
+// Done is closed once consuming has stopped and Output has been closed.
+func (ksa *KafkaStreamAdapter) Done() <-chan struct{} {
+	return ksa.done
+}
+
+// Stop stops consuming and closes Output, then waits, for as long as ctx
+// allows, for the rows already emitted to become durable so that their
+// offsets can be committed. Offsets of rows still pending when the wait ends
+// are left uncommitted, and those messages are consumed again on the next
+// Start.
+func (ksa *KafkaStreamAdapter) Stop(ctx context.Context) (err error) {
+	ksa.logger().Info("KafkaStreamAdapter stopping")
+
+	if ksa.done == nil {
+		return nil
+	}
+
+	ksa.closeOutput()
+
+	durableTicker := time.NewTicker(50 * time.Millisecond)
+	defer durableTicker.Stop()
+
+	for outstanding := ksa.outstanding(); outstanding > 0; outstanding = ksa.outstanding() {
+		select {
+		case <-durableTicker.C:
+		case <-ctx.Done():
+			ksa.logger().Warn("KafkaStreamAdapter stopped with rows not yet durable", "rows", outstanding, "error", ctx.Err())
+			err = ctx.Err()
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if closeErr := ksa.close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// stopConsuming closes every partition consumer and waits for its messages
+// to have been emitted.
+func (ksa *KafkaStreamAdapter) stopConsuming() {
+	for _, partitionConsumer := range ksa.partitionConsumers {
+		partitionConsumer.AsyncClose()
+	}
+
+	ksa.consumers.Wait()
+	ksa.partitionConsumers = nil
+}
+
+func (ksa *KafkaStreamAdapter) close() (err error) {
+	// closing a partition's offset manager commits the offset marked last
+	for _, partitionOffsetManager := range ksa.partitionOffsetManagers {
+		if closeErr := partitionOffsetManager.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	ksa.partitionOffsetManagers = nil
+
+	if ksa.offsetManager != nil {
+		if closeErr := ksa.offsetManager.Close(); closeErr != nil {
+			err = closeErr
+		}
+		ksa.offsetManager = nil
+	}
+
+	if ksa.consumer != nil {
+		ksa.consumer.Close()
+		ksa.consumer = nil
+	}
+
+	if ksa.client != nil {
+		ksa.client.Close()
+		ksa.client = nil
+	}
+
+	ksa.offsetTrackers = nil
+
+	return err
+}
+
+func (ksa *KafkaStreamAdapter) outstanding() (outstanding int) {
+	for _, tracker := range ksa.offsetTrackers {
+		outstanding += tracker.outstanding()
+	}
+
+	return outstanding
+}
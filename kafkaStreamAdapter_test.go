@@ -0,0 +1,321 @@
+package core
+
+import (
+	"context"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type fakeOffsetMarker struct {
+	marked []int64
+}
+
+func (m *fakeOffsetMarker) MarkOffset(offset int64, metadata string) {
+	m.marked = append(m.marked, offset)
+}
+
+func TestOffsetTracker(t *testing.T) {
+	log.Println("Starting TestOffsetTracker")
+
+	marker := &fakeOffsetMarker{}
+	tracker := newOffsetTracker(marker)
+
+	for offset := int64(10); offset < 14; offset++ {
+		tracker.track(offset)
+	}
+
+	// offsets 11 and 12 are durable first but must wait for 10
+	tracker.markDurable(12)
+	tracker.markDurable(11)
+
+	if len(marker.marked) != 0 {
+		t.Errorf("offset marked past a pending row: %v", marker.marked)
+	}
+
+	tracker.markDurable(10)
+
+	if len(marker.marked) != 1 || marker.marked[0] != 13 {
+		t.Errorf("wrong offsets marked: %v vs. [13]", marker.marked)
+	}
+
+	if tracker.outstanding() != 1 {
+		t.Errorf("wrong outstanding count: %d vs. 1", tracker.outstanding())
+	}
+
+	tracker.markDurable(13)
+
+	if len(marker.marked) != 2 || marker.marked[1] != 14 {
+		t.Errorf("wrong offsets marked: %v vs. [13 14]", marker.marked)
+	}
+
+	// a message dropped on cancellation is never waited for
+	tracker.track(14)
+	tracker.untrack(14)
+
+	if tracker.outstanding() != 0 {
+		t.Errorf("untracked offset still outstanding: %d vs. 0", tracker.outstanding())
+	}
+
+	log.Println("Finished TestOffsetTracker")
+}
+
+func TestOffsetTrackerRejectedRow(t *testing.T) {
+	log.Println("Starting TestOffsetTrackerRejectedRow")
+
+	marker := &fakeOffsetMarker{}
+	tracker := newOffsetTracker(marker)
+
+	input := make(chan interface{})
+	output := make(chan *Block, 1)
+
+	blockManager := &BlockManager{
+		MaxAge:  60000, // milliseconds
+		MaxSize: 2,     // rows
+		PartitionSpec: &PartitionSpec{
+			Fields: []PartitionField{
+				{SourceColumn: "timestamp", Transform: DayTransform},
+			},
+		},
+		KeyColumn: "timestamp",
+		Input:     input,
+		Output:    output,
+		Errors:    make(chan error, 1),
+		Codec:     GetCodecFixture(),
+	}
+
+	if err := blockManager.Start(context.Background()); err != nil {
+		t.Fatalf("Block Manager start failed with error: %s", err)
+	}
+
+	// the row at offset 1 cannot be partitioned, between two that can
+	rows := []interface{}{
+		GetNativeFixture(),
+		map[string]interface{}{"user_id": "userid1", "timestamp": "yesterday"},
+		GetNativeFixture(),
+	}
+
+	for offset, row := range rows {
+		offset := int64(offset)
+		tracker.track(offset)
+		input <- &TrackedRow{
+			Row:       row,
+			OnDurable: func() { tracker.markDurable(offset) },
+		}
+	}
+
+	select {
+	case block := <-output:
+		block.MarkDurable()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Block Manager did not commit the partitionable rows")
+	}
+
+	if tracker.outstanding() != 0 {
+		t.Errorf("offsets still outstanding after the block was durable: %d", tracker.outstanding())
+	}
+
+	if last := len(marker.marked) - 1; last < 0 || marker.marked[last] != 3 {
+		t.Errorf("wrong offsets marked: %v, want the last to be 3", marker.marked)
+	}
+
+	log.Println("Finished TestOffsetTrackerRejectedRow")
+}
+
+// fakePartitionConsumer hands consumePartition messages from a channel.
+type fakePartitionConsumer struct {
+	messages chan *sarama.ConsumerMessage
+	errors   chan *sarama.ConsumerError
+}
+
+func (pc *fakePartitionConsumer) AsyncClose()                              {}
+func (pc *fakePartitionConsumer) Close() error                             { return nil }
+func (pc *fakePartitionConsumer) Messages() <-chan *sarama.ConsumerMessage { return pc.messages }
+func (pc *fakePartitionConsumer) Errors() <-chan *sarama.ConsumerError     { return pc.errors }
+func (pc *fakePartitionConsumer) HighWaterMarkOffset() int64               { return 0 }
+
+func TestKafkaStreamAdapterStopsMarkingAfterCancel(t *testing.T) {
+	log.Println("Starting TestKafkaStreamAdapterStopsMarkingAfterCancel")
+
+	codec := GetCodecFixture()
+	message, err := codec.BinaryFromNative(nil, GetNativeFixture())
+	if err != nil {
+		t.Fatalf("BinaryFromNative failed with error: %s", err)
+	}
+
+	marker := &fakeOffsetMarker{}
+	tracker := newOffsetTracker(marker)
+
+	// Output is never read, so nothing can be emitted once ctx ends
+	kafkaStreamAdapter := &KafkaStreamAdapter{
+		Topic:  "locations",
+		Codec:  codec,
+		Output: make(chan interface{}),
+	}
+
+	// a row the pipeline drops on cancellation, then an undecodable message
+	// and another row behind it
+	partitionConsumer := &fakePartitionConsumer{
+		messages: make(chan *sarama.ConsumerMessage, 3),
+		errors:   make(chan *sarama.ConsumerError),
+	}
+	partitionConsumer.messages <- &sarama.ConsumerMessage{Topic: "locations", Offset: 0, Value: message}
+	partitionConsumer.messages <- &sarama.ConsumerMessage{Topic: "locations", Offset: 1, Value: []byte{0xff}}
+	partitionConsumer.messages <- &sarama.ConsumerMessage{Topic: "locations", Offset: 2, Value: message}
+	close(partitionConsumer.messages)
+	close(partitionConsumer.errors)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	kafkaStreamAdapter.consumers.Add(1)
+	kafkaStreamAdapter.consumePartition(ctx, partitionConsumer, tracker)
+
+	if len(marker.marked) != 0 {
+		t.Errorf("offsets marked after ctx ended: %v", marker.marked)
+	}
+
+	if tracker.outstanding() != 0 {
+		t.Errorf("offsets tracked after ctx ended: %d", tracker.outstanding())
+	}
+
+	log.Println("Finished TestKafkaStreamAdapterStopsMarkingAfterCancel")
+}
+
+func offsetCommitCount(broker *sarama.MockBroker) (commits int) {
+	for _, requestResponse := range broker.History() {
+		if _, ok := requestResponse.Request.(*sarama.OffsetCommitRequest); ok {
+			commits++
+		}
+	}
+
+	return commits
+}
+
+func TestKafkaStreamAdapter(t *testing.T) {
+	log.Println("Starting TestKafkaStreamAdapter")
+
+	const topic = "locations"
+	const groupID = "iceberg"
+
+	codec := GetCodecFixture()
+	message, err := codec.BinaryFromNative(nil, GetNativeFixture())
+	if err != nil {
+		t.Fatalf("BinaryFromNative failed with error: %s", err)
+	}
+
+	// the same row in Confluent wire format, with schema id 1
+	confluentMessage := append([]byte{0, 0, 0, 0, 1}, message...)
+
+	// the first message carries the producer's trace context in its headers
+	const traceParent = "00-0102030405060708090a0b0c0d0e0f10-0102030405060708-01"
+
+	fetchResponse := &sarama.FetchResponse{Version: 4}
+	fetchResponse.AddRecord(topic, 0, nil, sarama.ByteEncoder(message), 0)
+	fetchResponse.AddRecord(topic, 0, nil, sarama.ByteEncoder(message), 1)
+	fetchResponse.SetLastOffsetDelta(topic, 0, 1)
+	fetchResponse.GetBlock(topic, 0).HighWaterMarkOffset = 2
+	fetchResponse.GetBlock(topic, 0).RecordsSet[0].RecordBatch.Records[0].Headers = []*sarama.RecordHeader{
+		{Key: []byte("traceparent"), Value: []byte(traceParent)},
+	}
+
+	previousPropagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(previousPropagator)
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetVersion(1).
+			SetOffset(topic, 0, sarama.OffsetOldest, 0).
+			SetOffset(topic, 0, sarama.OffsetNewest, 2),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, groupID, broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset(groupID, topic, 0, -1, "", sarama.ErrNoError),
+		"FetchRequest":        sarama.NewMockWrapper(fetchResponse),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+	})
+
+	// the mock responses above are at the versions sarama requests for V1_0_0_0
+	config := sarama.NewConfig()
+	config.Version = sarama.V1_0_0_0
+	config.Consumer.Offsets.CommitInterval = 50 * time.Millisecond
+
+	output := make(chan interface{}, 10)
+
+	kafkaStreamAdapter := &KafkaStreamAdapter{
+		Brokers: []string{broker.Addr()},
+		Topic:   topic,
+		GroupID: groupID,
+		Config:  config,
+		Codec:   codec,
+		Output:  output,
+	}
+
+	if err = kafkaStreamAdapter.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed with error: %s", err)
+	}
+
+	trackedRows := []*TrackedRow{}
+	for len(trackedRows) < 2 {
+		select {
+		case row := <-output:
+			trackedRow, ok := row.(*TrackedRow)
+			if !ok {
+				t.Fatalf("emitted row is not a TrackedRow: %T", row)
+			}
+			trackedRows = append(trackedRows, trackedRow)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for rows, got %d", len(trackedRows))
+		}
+	}
+
+	if config.Consumer.Return.Errors {
+		t.Errorf("Start modified the caller's Config")
+	}
+
+	spanContext := trace.SpanContextFromContext(trackedRows[0].Context)
+	if spanContext.TraceID().String() != "0102030405060708090a0b0c0d0e0f10" {
+		t.Errorf("row did not carry the message's trace context: %s", spanContext.TraceID())
+	}
+
+	// nothing is durable yet, so no offsets should have been committed
+	time.Sleep(200 * time.Millisecond)
+	if commits := offsetCommitCount(broker); commits != 0 {
+		t.Errorf("offsets committed before rows were durable: %d commits", commits)
+	}
+
+	for _, trackedRow := range trackedRows {
+		trackedRow.OnDurable()
+	}
+
+	if err = kafkaStreamAdapter.Stop(context.Background()); err != nil {
+		t.Errorf("Stop failed with error: %s", err)
+	}
+
+	if offsetCommitCount(broker) == 0 {
+		t.Errorf("offsets not committed once rows were durable")
+	}
+
+	wireFormatAdapter := &KafkaStreamAdapter{Codec: codec, ConfluentWireFormat: true}
+	if _, err = wireFormatAdapter.decode(confluentMessage); err != nil {
+		t.Errorf("decode of Confluent wire format failed with error: %s", err)
+	}
+
+	if _, err = wireFormatAdapter.decode([]byte{1, 0, 0}); err == nil {
+		t.Errorf("decode of message without Confluent header did not fail")
+	}
+
+	log.Println("Finished TestKafkaStreamAdapter")
+}
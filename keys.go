@@ -0,0 +1,304 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goavro "github.com/linkedin/goavro/v2"
+)
+
+type KeyType int
+
+const (
+	UnknownKey KeyType = iota
+	Int32Key
+	Int64Key
+	Float32Key
+	Float64Key
+	StringKey
+	TimestampMillisKey
+	TimestampMicrosKey
+)
+
+type keyTypeCacheKey struct {
+	codec     *goavro.Codec
+	keyColumn string
+}
+
+var keyTypeCache sync.Map // keyTypeCacheKey -> KeyType
+
+// KeyTypeFromCodec derives the type of a key column from the codec's schema.
+func KeyTypeFromCodec(codec *goavro.Codec, keyColumn string) (keyType KeyType, err error) {
+	cacheKey := keyTypeCacheKey{codec: codec, keyColumn: keyColumn}
+	if cached, ok := keyTypeCache.Load(cacheKey); ok {
+		return cached.(KeyType), nil
+	}
+
+	var schema map[string]interface{}
+	if err = json.Unmarshal([]byte(codec.Schema()), &schema); err != nil {
+		return UnknownKey, err
+	}
+
+	fields, _ := schema["fields"].([]interface{})
+	for _, field := range fields {
+		fieldMap := field.(map[string]interface{})
+		if fieldMap["name"] != keyColumn {
+			continue
+		}
+
+		keyType, err = keyTypeFromAvroType(fieldMap["type"])
+		if err != nil {
+			return UnknownKey, fmt.Errorf("KeyTypeFromCodec: key column %s: %s", keyColumn, err)
+		}
+
+		keyTypeCache.Store(cacheKey, keyType)
+		return keyType, nil
+	}
+
+	return UnknownKey, fmt.Errorf("KeyTypeFromCodec: key column %s not found in schema", keyColumn)
+}
+
+func keyTypeFromAvroType(avroType interface{}) (keyType KeyType, err error) {
+	switch t := avroType.(type) {
+	case string:
+		switch t {
+		case "int":
+			return Int32Key, nil
+		case "long":
+			return Int64Key, nil
+		case "float":
+			return Float32Key, nil
+		case "double":
+			return Float64Key, nil
+		case "string":
+			return StringKey, nil
+		}
+	case map[string]interface{}:
+		switch t["logicalType"] {
+		case "timestamp-millis":
+			return TimestampMillisKey, nil
+		case "timestamp-micros":
+			return TimestampMicrosKey, nil
+		}
+		return keyTypeFromAvroType(t["type"])
+	}
+
+	return UnknownKey, fmt.Errorf("type %v not supported as a key", avroType)
+}
+
+// keyTypeOf infers a key type from a value when no schema is available.
+func keyTypeOf(value interface{}) KeyType {
+	switch value.(type) {
+	case int32:
+		return Int32Key
+	case int64:
+		return Int64Key
+	case float32:
+		return Float32Key
+	case float64:
+		return Float64Key
+	case string:
+		return StringKey
+	case time.Time:
+		return TimestampMicrosKey
+	}
+
+	return UnknownKey
+}
+
+// Normalize converts a key, whether read from a row or supplied to a query,
+// to the canonical Go type for the key type: int32, int64, float32, float64,
+// string, or time.Time for timestamps.
+func (kt KeyType) Normalize(key interface{}) (normalized interface{}, err error) {
+	switch kt {
+	case Int32Key, Int64Key:
+		var intKey int64
+		switch t := key.(type) {
+		case int:
+			intKey = int64(t)
+		case int32:
+			intKey = int64(t)
+		case int64:
+			intKey = t
+		default:
+			return nil, fmt.Errorf("Normalize: %T is not an integer key", key)
+		}
+		if kt == Int32Key {
+			if intKey < math.MinInt32 || intKey > math.MaxInt32 {
+				return nil, fmt.Errorf("Normalize: %d is out of range for an int key", intKey)
+			}
+			return int32(intKey), nil
+		}
+		return intKey, nil
+	case Float32Key, Float64Key:
+		floatKey, ok := toFloat64(key)
+		if !ok {
+			return nil, fmt.Errorf("Normalize: %T is not a floating point key", key)
+		}
+		if kt == Float32Key {
+			return float32(floatKey), nil
+		}
+		return floatKey, nil
+	case StringKey:
+		stringKey, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("Normalize: %T is not a string key", key)
+		}
+		return stringKey, nil
+	case TimestampMillisKey, TimestampMicrosKey:
+		switch t := key.(type) {
+		case time.Time:
+			return t.UTC(), nil
+		case int64:
+			// goavro versions without logical type support decode the raw long
+			unit := int64(time.Microsecond)
+			if kt == TimestampMillisKey {
+				unit = int64(time.Millisecond)
+			}
+			if t > math.MaxInt64/unit || t < math.MinInt64/unit {
+				return nil, fmt.Errorf("Normalize: timestamp %d is out of range", t)
+			}
+			return time.Unix(0, t*unit).UTC(), nil
+		}
+		return nil, fmt.Errorf("Normalize: %T is not a timestamp key", key)
+	}
+
+	return nil, errors.New("Normalize: unknown key type")
+}
+
+// Parse reads a key from text, eg. a query string parameter. Timestamps may
+// be given as RFC 3339 or as an integer in the column's unit.
+func (kt KeyType) Parse(text string) (key interface{}, err error) {
+	switch kt {
+	case Int32Key:
+		intKey, err := strconv.ParseInt(text, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		return int32(intKey), nil
+	case Int64Key:
+		return strconv.ParseInt(text, 10, 64)
+	case Float32Key:
+		floatKey, err := strconv.ParseFloat(text, 32)
+		return float32(floatKey), err
+	case Float64Key:
+		return strconv.ParseFloat(text, 64)
+	case StringKey:
+		return text, nil
+	case TimestampMillisKey, TimestampMicrosKey:
+		if intKey, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return kt.Normalize(intKey)
+		}
+		timeKey, err := time.Parse(time.RFC3339Nano, text)
+		return timeKey.UTC(), err
+	}
+
+	return nil, errors.New("Parse: unknown key type")
+}
+
+// template returns a zero key of the key type, for decoding block filenames.
+func (kt KeyType) template() interface{} {
+	switch kt {
+	case Int32Key:
+		return int32(0)
+	case Int64Key:
+		return int64(0)
+	case Float32Key:
+		return float32(0)
+	case Float64Key:
+		return float64(0)
+	case StringKey:
+		return ""
+	case TimestampMillisKey, TimestampMicrosKey:
+		return time.Time{}
+	}
+
+	return nil
+}
+
+// normalizeKeyRange converts query bounds to the key column's type.
+func normalizeKeyRange(codec *goavro.Codec, keyColumn string, startKey interface{}, endKey interface{}) (normalizedStartKey interface{}, normalizedEndKey interface{}, err error) {
+	keyType, err := KeyTypeFromCodec(codec, keyColumn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if normalizedStartKey, err = keyType.Normalize(startKey); err != nil {
+		return nil, nil, fmt.Errorf("%w: start key: %w", ErrInvalidQuery, err)
+	}
+
+	if normalizedEndKey, err = keyType.Normalize(endKey); err != nil {
+		return nil, nil, fmt.Errorf("%w: end key: %w", ErrInvalidQuery, err)
+	}
+
+	return normalizedStartKey, normalizedEndKey, nil
+}
+
+// compareKeys orders two keys. Keys that cannot be compared with each other,
+// which a table whose key column has one type never holds, are ordered by
+// their type names, nil first, so that sorts and merges stay consistent.
+func compareKeys(a interface{}, b interface{}) int {
+	if comparison, ok := compareValues(a, b); ok {
+		return comparison
+	}
+
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	return strings.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b))
+}
+
+// encodeKey renders a key for use in a block filename.
+func encodeKey(key interface{}) (encoded string, err error) {
+	switch t := key.(type) {
+	case string:
+		return t, nil
+	case int32:
+		return strconv.FormatInt(int64(t), 10), nil
+	case int64:
+		return strconv.FormatInt(t, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(t), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64), nil
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano), nil
+	}
+
+	return "", fmt.Errorf("encodeKey: type %T not supported", key)
+}
+
+// convertBlockKeyToType decodes a key encoded by encodeKey into the type of
+// the key template.
+func convertBlockKeyToType(key interface{}, blockKeyString string) (convertedKey interface{}, err error) {
+	switch t := key.(type) {
+	case int32:
+		int32Key, err := strconv.ParseInt(blockKeyString, 10, 32)
+		return int32(int32Key), err
+	case int64:
+		return strconv.ParseInt(blockKeyString, 10, 64)
+	case float32:
+		float32Key, err := strconv.ParseFloat(blockKeyString, 32)
+		return float32(float32Key), err
+	case float64:
+		return strconv.ParseFloat(blockKeyString, 64)
+	case string:
+		return blockKeyString, nil
+	case time.Time:
+		return time.Parse(time.RFC3339Nano, blockKeyString)
+	default:
+		return nil, fmt.Errorf("convertBlockKeyToType: unsupported type: %T", t)
+	}
+}
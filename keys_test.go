@@ -0,0 +1,162 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"math"
+	"testing"
+	"time"
+
+	goavro "github.com/linkedin/goavro/v2"
+)
+
+func TestKeyTypeFromCodec(t *testing.T) {
+	log.Println("Starting TestKeyTypeFromCodec")
+
+	codec := GetCodecFixture()
+
+	cases := map[string]KeyType{
+		"timestamp": Int64Key,
+		"user_id":   StringKey,
+		"latitude":  Float64Key,
+	}
+
+	for keyColumn, expectedKeyType := range cases {
+		keyType, err := KeyTypeFromCodec(codec, keyColumn)
+		if err != nil {
+			t.Errorf("KeyTypeFromCodec failed for %s with error: %s", keyColumn, err)
+		}
+
+		if keyType != expectedKeyType {
+			t.Errorf("KeyTypeFromCodec returned wrong type for %s: %d vs. %d", keyColumn, keyType, expectedKeyType)
+		}
+	}
+
+	if _, err := KeyTypeFromCodec(codec, "features"); err == nil {
+		t.Errorf("KeyTypeFromCodec should reject array column features")
+	}
+
+	log.Println("Finished TestKeyTypeFromCodec")
+}
+
+func TestKeyEncodingRoundTrip(t *testing.T) {
+	log.Println("Starting TestKeyEncodingRoundTrip")
+
+	keys := []interface{}{
+		int32(-42),
+		int64(1528000000000),
+		float32(1.5),
+		float64(-121.0125),
+		"userid1",
+		time.Date(2018, 6, 1, 12, 30, 0, 500, time.UTC),
+	}
+
+	for _, key := range keys {
+		encoded, err := encodeKey(key)
+		if err != nil {
+			t.Errorf("encodeKey failed for %T with error: %s", key, err)
+			continue
+		}
+
+		decoded, err := convertBlockKeyToType(key, encoded)
+		if err != nil {
+			t.Errorf("convertBlockKeyToType failed for %T with error: %s", key, err)
+			continue
+		}
+
+		if compareKeys(key, decoded) != 0 {
+			t.Errorf("Key did not round trip: %v vs. %v", key, decoded)
+		}
+	}
+
+	log.Println("Finished TestKeyEncodingRoundTrip")
+}
+
+func TestTimestampKeyNormalize(t *testing.T) {
+	log.Println("Starting TestTimestampKeyNormalize")
+
+	expected := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	normalized, err := TimestampMillisKey.Normalize(expected.UnixNano() / int64(time.Millisecond))
+	if err != nil {
+		t.Fatalf("Normalize failed with error: %s", err)
+	}
+
+	if !normalized.(time.Time).Equal(expected) {
+		t.Errorf("Normalize returned wrong timestamp: %v vs. %v", normalized, expected)
+	}
+
+	log.Println("Finished TestTimestampKeyNormalize")
+}
+
+func TestKeyOutOfRange(t *testing.T) {
+	log.Println("Starting TestKeyOutOfRange")
+
+	cases := []struct {
+		keyType KeyType
+		key     interface{}
+	}{
+		{Int32Key, int64(math.MaxInt32 + 1)},
+		{Int32Key, math.MinInt32 - 1},
+		{TimestampMillisKey, int64(math.MaxInt64/int64(time.Millisecond) + 1)},
+		{TimestampMicrosKey, int64(math.MinInt64/int64(time.Microsecond) - 1)},
+	}
+
+	for _, c := range cases {
+		if normalized, err := c.keyType.Normalize(c.key); err == nil {
+			t.Errorf("Normalize of %v as key type %d did not fail: %v", c.key, c.keyType, normalized)
+		}
+	}
+
+	for keyType, text := range map[KeyType]string{
+		Int32Key:           "2147483648",
+		TimestampMillisKey: "9223372036854775807",
+	} {
+		if parsed, err := keyType.Parse(text); err == nil {
+			t.Errorf("Parse of %s as key type %d did not fail: %v", text, keyType, parsed)
+		}
+	}
+
+	codec, err := goavro.NewCodec(`{
+		"type": "record",
+		"name": "event",
+		"fields": [
+			{ "name": "occurred", "type": { "type": "long", "logicalType": "timestamp-millis" } }
+		]
+	}`)
+	if err != nil {
+		t.Fatalf("NewCodec failed with error: %s", err)
+	}
+
+	// a query bound out of range is the caller's mistake
+	if _, _, err := normalizeKeyRange(codec, "occurred", int64(0), int64(math.MaxInt64)); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("normalizeKeyRange did not fail with ErrInvalidQuery: %v", err)
+	}
+
+	log.Println("Finished TestKeyOutOfRange")
+}
+
+func TestCompareKeysMixedTypes(t *testing.T) {
+	log.Println("Starting TestCompareKeysMixedTypes")
+
+	// incomparable keys are ordered by type, consistently in both directions
+	cases := []struct {
+		a, b     interface{}
+		expected int
+	}{
+		{int64(1), int64(2), -1},
+		{nil, "a", -1},
+		{"a", nil, 1},
+		{nil, nil, 0},
+		{int64(5), "a", -1},
+		{"a", int64(5), 1},
+	}
+
+	for _, c := range cases {
+		if comparison := compareKeys(c.a, c.b); comparison != c.expected {
+			t.Errorf("compareKeys(%v, %v) returned %d vs. %d", c.a, c.b, comparison, c.expected)
+		}
+	}
+
+	log.Println("Finished TestCompareKeysMixedTypes")
+}
@@ -0,0 +1,37 @@
+package core
+
+import "log/slog"
+
+// Logger receives leveled, structured records. The arguments after a message
+// are alternating keys and values, as with log/slog, whose *slog.Logger
+// satisfies it. Components given no Logger use slog.Default(); per block
+// records are logged at Info and per row or per tick ones at Debug, so a
+// handler's level can silence them in production:
+//
+//	blockManager.Logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// LoggerOrDefault returns logger, or slog.Default() if it is nil, for
+// packages building on core that take a Logger the same way.
+func LoggerOrDefault(logger Logger) Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+
+	return logger
+}
+
+// blockLogArgs are the fields identifying a block in log records.
+func blockLogArgs(block *Block) []any {
+	return []any{
+		"partition_key", block.PartitionKey,
+		"starting_key", block.StartingKey,
+		"ending_key", block.EndingKey,
+		"rows", len(block.Rows),
+	}
+}
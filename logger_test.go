@@ -0,0 +1,41 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoggerInjection(t *testing.T) {
+	log.Println("Starting TestLoggerInjection")
+
+	walPath := "./test/logger-wal"
+	os.RemoveAll(walPath)
+	os.MkdirAll(walPath, os.ModePerm)
+	defer os.RemoveAll(walPath)
+
+	// a record length with the record cut short, as after a crash mid-append
+	walFilePath := walPath + "/truncated.wal"
+	if err := ioutil.WriteFile(walFilePath, []byte{5, 1}, 0644); err != nil {
+		t.Fatalf("Writing write-ahead log failed with %s", err)
+	}
+
+	output := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(output, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	rows, err := readWALRows(walFilePath, nil, logger)
+	if err != nil || len(rows) != 0 {
+		t.Errorf("Reading truncated write-ahead log returned %d rows and %v", len(rows), err)
+	}
+
+	record := output.String()
+	if !strings.Contains(record, "level=WARN") || !strings.Contains(record, "path="+walFilePath) {
+		t.Errorf("Truncated record not logged to injected logger: %q", record)
+	}
+
+	log.Println("Finished TestLoggerInjection")
+}
@@ -0,0 +1,393 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type PartitionTransform int
+
+// maxRangeSegments bounds the day or hour partitions a single key range may
+// expand to, about eleven years of hours.
+const maxRangeSegments = 100000
+
+const (
+	IdentityTransform PartitionTransform = iota
+	DayTransform
+	HourTransform
+	BucketTransform
+	TruncateTransform
+)
+
+// PartitionField derives one level of a partition path from a source column.
+// Day and hour transforms accept timestamp columns, or long columns holding
+// milliseconds since the epoch. Iceberg can only express them over
+// timestamp-micros and date columns, so a storage adapter keeping Iceberg
+// metadata refuses to start with one over a long column.
+type PartitionField struct {
+	SourceColumn string
+	Transform    PartitionTransform
+	Width        int    // number of buckets for BucketTransform, width for TruncateTransform
+	Name         string // defaults to SourceColumn, suffixed with the transform
+}
+
+// PartitionSpec describes multi-level partitioning. Partition keys are paths
+// of Hive style name=value segments, one per field, eg.
+// tenant=acme/timestamp_day=2018-06-01.
+type PartitionSpec struct {
+	Fields []PartitionField
+}
+
+func (pf *PartitionField) name() string {
+	if len(pf.Name) > 0 {
+		return pf.Name
+	}
+
+	switch pf.Transform {
+	case DayTransform:
+		return pf.SourceColumn + "_day"
+	case HourTransform:
+		return pf.SourceColumn + "_hour"
+	case BucketTransform:
+		return pf.SourceColumn + "_bucket"
+	case TruncateTransform:
+		return pf.SourceColumn + "_trunc"
+	}
+
+	return pf.SourceColumn
+}
+
+// icebergTransform is the transform's name in Iceberg partition specs.
+func (pf *PartitionField) icebergTransform() string {
+	switch pf.Transform {
+	case DayTransform:
+		return "day"
+	case HourTransform:
+		return "hour"
+	case BucketTransform:
+		return fmt.Sprintf("bucket[%d]", pf.Width)
+	case TruncateTransform:
+		return fmt.Sprintf("truncate[%d]", pf.Width)
+	}
+
+	return "identity"
+}
+
+func partitionTime(value interface{}) (timestamp time.Time, err error) {
+	switch t := value.(type) {
+	case time.Time:
+		return t.UTC(), nil
+	case int64:
+		return time.Unix(t/1000, (t%1000)*int64(time.Millisecond)).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("partitionTime: %T is not a timestamp", value)
+}
+
+// floorDiv divides rounding toward negative infinity, so that a time before
+// the epoch falls in the day or hour it is in rather than the one after.
+func floorDiv(a int64, b int64) int64 {
+	quotient := a / b
+	if a%b < 0 {
+		quotient--
+	}
+
+	return quotient
+}
+
+// toPartitionOrdinal narrows a day or hour since the epoch to the int32 Iceberg
+// stores it as.
+func toPartitionOrdinal(ordinal int64) (result interface{}, err error) {
+	if ordinal < math.MinInt32 || ordinal > math.MaxInt32 {
+		return nil, fmt.Errorf("toPartitionOrdinal: %d is out of range", ordinal)
+	}
+
+	return int32(ordinal), nil
+}
+
+// apply transforms a source value into the partition value, typed as Iceberg
+// stores it: days and hours since the epoch and buckets are int32.
+func (pf *PartitionField) apply(value interface{}) (result interface{}, err error) {
+	value = unwrapUnion(value)
+	if value == nil {
+		return nil, nil
+	}
+
+	switch pf.Transform {
+	case IdentityTransform:
+		return value, nil
+	case DayTransform:
+		timestamp, err := partitionTime(value)
+		if err != nil {
+			return nil, err
+		}
+		return toPartitionOrdinal(floorDiv(timestamp.Unix(), 24*60*60))
+	case HourTransform:
+		timestamp, err := partitionTime(value)
+		if err != nil {
+			return nil, err
+		}
+		return toPartitionOrdinal(floorDiv(timestamp.Unix(), 60*60))
+	case BucketTransform:
+		if pf.Width <= 0 {
+			return nil, errors.New("apply: bucket transform requires a positive Width")
+		}
+		hash, err := icebergBucketHash(value)
+		if err != nil {
+			return nil, err
+		}
+		return int32((hash & 0x7fffffff) % int32(pf.Width)), nil
+	case TruncateTransform:
+		if pf.Width <= 0 {
+			return nil, errors.New("apply: truncate transform requires a positive Width")
+		}
+		return truncateValue(value, pf.Width)
+	}
+
+	return nil, fmt.Errorf("apply: unknown transform %d", pf.Transform)
+}
+
+// pathValue renders a partition value for a path segment.
+func (pf *PartitionField) pathValue(result interface{}) string {
+	if result == nil {
+		return "null"
+	}
+
+	var rendered string
+	switch pf.Transform {
+	case DayTransform:
+		rendered = time.Unix(int64(result.(int32))*24*60*60, 0).UTC().Format("2006-01-02")
+	case HourTransform:
+		rendered = time.Unix(int64(result.(int32))*60*60, 0).UTC().Format("2006-01-02-15")
+	default:
+		if encoded, err := encodeKey(result); err == nil {
+			rendered = encoded
+		} else {
+			rendered = fmt.Sprintf("%v", result)
+		}
+	}
+
+	return url.PathEscape(rendered)
+}
+
+func truncateValue(value interface{}, width int) (truncated interface{}, err error) {
+	switch t := value.(type) {
+	case int32:
+		w := int32(width)
+		return t - (((t % w) + w) % w), nil
+	case int64:
+		w := int64(width)
+		return t - (((t % w) + w) % w), nil
+	case string:
+		if utf8.RuneCountInString(t) <= width {
+			return t, nil
+		}
+		return string([]rune(t)[:width]), nil
+	}
+
+	return nil, fmt.Errorf("truncateValue: %T cannot be truncated", value)
+}
+
+// icebergBucketHash is the 32 bit Murmur3 hash Iceberg buckets values with.
+func icebergBucketHash(value interface{}) (hash int32, err error) {
+	var data []byte
+
+	switch t := value.(type) {
+	case int32:
+		data = make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, uint64(int64(t)))
+	case int64:
+		data = make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, uint64(t))
+	case time.Time:
+		data = make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, uint64(t.UnixNano()/int64(time.Microsecond)))
+	case string:
+		data = []byte(t)
+	case []byte:
+		data = t
+	default:
+		return 0, fmt.Errorf("icebergBucketHash: %T cannot be bucketed", value)
+	}
+
+	return int32(murmur3x86_32(data, 0)), nil
+}
+
+func murmur3x86_32(data []byte, seed uint32) uint32 {
+	const c1 = 0xcc9e2d51
+	const c2 = 0x1b873593
+
+	hash := seed
+	length := len(data)
+	blocks := length / 4
+
+	for i := 0; i < blocks; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+
+		hash ^= k
+		hash = bits.RotateLeft32(hash, 13)
+		hash = hash*5 + 0xe6546b64
+	}
+
+	tail := data[blocks*4:]
+	var k uint32
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		hash ^= k
+	}
+
+	hash ^= uint32(length)
+	hash ^= hash >> 16
+	hash *= 0x85ebca6b
+	hash ^= hash >> 13
+	hash *= 0xc2b2ae35
+	hash ^= hash >> 16
+
+	return hash
+}
+
+func IdentityPartitionSpec(partitionColumn string) *PartitionSpec {
+	return &PartitionSpec{
+		Fields: []PartitionField{
+			{SourceColumn: partitionColumn, Transform: IdentityTransform},
+		},
+	}
+}
+
+// resolvePartitionSpec falls back to identity partitioning on partitionColumn
+// for components configured before partition specs existed.
+func resolvePartitionSpec(partitionSpec *PartitionSpec, partitionColumn string) *PartitionSpec {
+	if partitionSpec != nil {
+		return partitionSpec
+	}
+
+	return IdentityPartitionSpec(partitionColumn)
+}
+
+// PartitionValues applies each field's transform to a row.
+func (ps *PartitionSpec) PartitionValues(row interface{}) (values []interface{}, err error) {
+	rowMap, ok := row.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("PartitionValues: row is not a record: %T", row)
+	}
+
+	values = make([]interface{}, len(ps.Fields))
+	for i := range ps.Fields {
+		if values[i], err = ps.Fields[i].apply(rowMap[ps.Fields[i].SourceColumn]); err != nil {
+			return nil, fmt.Errorf("PartitionValues: %s: %s", ps.Fields[i].name(), err)
+		}
+	}
+
+	return values, nil
+}
+
+// PartitionKey returns the partition path for a row.
+func (ps *PartitionSpec) PartitionKey(row interface{}) (partitionKey string, err error) {
+	values, err := ps.PartitionValues(row)
+	if err != nil {
+		return "", err
+	}
+
+	segments := make([]string, len(ps.Fields))
+	for i := range ps.Fields {
+		segments[i] = fmt.Sprintf("%s=%s", ps.Fields[i].name(), ps.Fields[i].pathValue(values[i]))
+	}
+
+	return strings.Join(segments, "/"), nil
+}
+
+// PartitionKeys returns every partition a query over [startKey, endKey] of
+// keyColumn must read. Day and hour fields over the key column are expanded
+// across the range; every other field needs its source column's value.
+func (ps *PartitionSpec) PartitionKeys(values map[string]interface{}, keyColumn string, startKey interface{}, endKey interface{}) (partitionKeys []string, err error) {
+	partitionKeys = []string{""}
+
+	for i := range ps.Fields {
+		field := &ps.Fields[i]
+
+		var segments []string
+		if field.SourceColumn == keyColumn && (field.Transform == DayTransform || field.Transform == HourTransform) {
+			if segments, err = field.rangeSegments(startKey, endKey); err != nil {
+				return nil, err
+			}
+		} else {
+			value, exists := values[field.SourceColumn]
+			if !exists {
+				return nil, fmt.Errorf("PartitionKeys: a value for %s is required", field.SourceColumn)
+			}
+
+			result, err := field.apply(value)
+			if err != nil {
+				return nil, err
+			}
+
+			segments = []string{fmt.Sprintf("%s=%s", field.name(), field.pathValue(result))}
+		}
+
+		expanded := make([]string, 0, len(partitionKeys)*len(segments))
+		for _, partitionKey := range partitionKeys {
+			for _, segment := range segments {
+				if len(partitionKey) == 0 {
+					expanded = append(expanded, segment)
+				} else {
+					expanded = append(expanded, partitionKey+"/"+segment)
+				}
+			}
+		}
+		partitionKeys = expanded
+	}
+
+	return partitionKeys, nil
+}
+
+func (pf *PartitionField) rangeSegments(startKey interface{}, endKey interface{}) (segments []string, err error) {
+	if startKey == nil || endKey == nil {
+		return nil, fmt.Errorf("rangeSegments: %s partitions need both a start and an end key", pf.name())
+	}
+
+	startResult, err := pf.apply(startKey)
+	if err != nil {
+		return nil, err
+	}
+
+	endResult, err := pf.apply(endKey)
+	if err != nil {
+		return nil, err
+	}
+
+	start, startOk := startResult.(int32)
+	end, endOk := endResult.(int32)
+	if !startOk || !endOk {
+		return nil, fmt.Errorf("rangeSegments: %s partitions cannot be derived from %T and %T keys", pf.name(), startKey, endKey)
+	}
+
+	if count := int64(end) - int64(start) + 1; count > maxRangeSegments {
+		return nil, fmt.Errorf("rangeSegments: range spans %d %s partitions, more than the %d allowed", count, pf.name(), maxRangeSegments)
+	}
+
+	for result := int64(start); result <= int64(end); result++ {
+		segments = append(segments, fmt.Sprintf("%s=%s", pf.name(), pf.pathValue(int32(result))))
+	}
+
+	return segments, nil
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"log"
+	"math"
+	"testing"
+)
+
+func TestPartitionSpecPartitionKey(t *testing.T) {
+	log.Println("Starting TestPartitionSpecPartitionKey")
+
+	partitionSpec := &PartitionSpec{
+		Fields: []PartitionField{
+			{SourceColumn: "user_id", Transform: IdentityTransform},
+			{SourceColumn: "timestamp", Transform: DayTransform},
+		},
+	}
+
+	// 2018-06-01T13:00:00Z in milliseconds
+	row := map[string]interface{}{
+		"user_id":   "user/1",
+		"timestamp": int64(1527858000000),
+	}
+
+	partitionKey, err := partitionSpec.PartitionKey(row)
+	if err != nil {
+		t.Errorf("PartitionKey failed with error: %s", err)
+	}
+
+	if partitionKey != "user_id=user%2F1/timestamp_day=2018-06-01" {
+		t.Errorf("PartitionKey returned wrong key: %s", partitionKey)
+	}
+
+	partitionKeys, err := partitionSpec.PartitionKeys(map[string]interface{}{"user_id": "user/1"}, "timestamp", int64(1527858000000), int64(1528030800000))
+	if err != nil {
+		t.Errorf("PartitionKeys failed with error: %s", err)
+	}
+
+	if len(partitionKeys) != 3 || partitionKeys[2] != "user_id=user%2F1/timestamp_day=2018-06-03" {
+		t.Errorf("PartitionKeys returned wrong keys: %v", partitionKeys)
+	}
+
+	if _, err := partitionSpec.PartitionKeys(map[string]interface{}{}, "timestamp", int64(0), int64(0)); err == nil {
+		t.Errorf("PartitionKeys should require a value for user_id")
+	}
+
+	log.Println("Finished TestPartitionSpecPartitionKey")
+}
+
+func TestPartitionSpecPartitionKeysBounds(t *testing.T) {
+	log.Println("Starting TestPartitionSpecPartitionKeysBounds")
+
+	partitionSpec := &PartitionSpec{
+		Fields: []PartitionField{
+			{SourceColumn: "timestamp", Transform: HourTransform},
+		},
+	}
+
+	if _, err := partitionSpec.PartitionKeys(nil, "timestamp", nil, int64(1527858000000)); err == nil {
+		t.Errorf("PartitionKeys should reject a range without a start key")
+	}
+
+	if _, err := partitionSpec.PartitionKeys(nil, "timestamp", int64(0), nil); err == nil {
+		t.Errorf("PartitionKeys should reject a range without an end key")
+	}
+
+	if _, err := partitionSpec.PartitionKeys(nil, "timestamp", int64(0), int64(1527858000000)); err == nil {
+		t.Errorf("PartitionKeys should reject a range spanning too many partitions")
+	}
+
+	if _, err := partitionSpec.PartitionKeys(nil, "timestamp", int64(0), int64(math.MaxInt64)); err == nil {
+		t.Errorf("PartitionKeys should reject an hour beyond int32")
+	}
+
+	// the last hour an int32 can number must not loop forever
+	lastHour := int64(math.MaxInt32) * 60 * 60 * 1000
+	partitionKeys, err := partitionSpec.PartitionKeys(nil, "timestamp", lastHour, lastHour)
+	if err != nil || len(partitionKeys) != 1 {
+		t.Errorf("PartitionKeys over the last hour returned %v, %v", partitionKeys, err)
+	}
+
+	// milliseconds far beyond 2262 must not overflow as nanoseconds
+	timestamp, err := partitionTime(int64(math.MaxInt64))
+	if err != nil || timestamp.Year() < 292000000 {
+		t.Errorf("partitionTime overflowed: %s, %v", timestamp, err)
+	}
+
+	log.Println("Finished TestPartitionSpecPartitionKeysBounds")
+}
+
+func TestPartitionTransforms(t *testing.T) {
+	log.Println("Starting TestPartitionTransforms")
+
+	// reference hashes from the Iceberg specification
+	if hash, _ := icebergBucketHash(int64(34)); hash != 2017239379 {
+		t.Errorf("icebergBucketHash returned wrong hash for 34: %d", hash)
+	}
+
+	if hash, _ := icebergBucketHash("iceberg"); hash != 1210000089 {
+		t.Errorf("icebergBucketHash returned wrong hash for iceberg: %d", hash)
+	}
+
+	truncateField := &PartitionField{SourceColumn: "timestamp", Transform: TruncateTransform, Width: 10}
+	if truncated, _ := truncateField.apply(int64(-1)); truncated != int64(-10) {
+		t.Errorf("truncate returned wrong value for -1: %v", truncated)
+	}
+
+	truncateField.Width = 3
+	if truncated, _ := truncateField.apply("iceberg"); truncated != "ice" {
+		t.Errorf("truncate returned wrong value for iceberg: %v", truncated)
+	}
+
+	hourField := &PartitionField{SourceColumn: "timestamp", Transform: HourTransform}
+	if hour, _ := hourField.apply(int64(1527858000000)); hourField.pathValue(hour) != "2018-06-01-13" {
+		t.Errorf("hour returned wrong value: %v", hour)
+	}
+
+	// times before the epoch fall in the day and hour they are in
+	if hour, _ := hourField.apply(int64(-1)); hour != int32(-1) || hourField.pathValue(hour) != "1969-12-31-23" {
+		t.Errorf("hour returned wrong value before the epoch: %v", hour)
+	}
+
+	dayField := &PartitionField{SourceColumn: "timestamp", Transform: DayTransform}
+	if day, _ := dayField.apply(int64(-1)); day != int32(-1) || dayField.pathValue(day) != "1969-12-31" {
+		t.Errorf("day returned wrong value before the epoch: %v", day)
+	}
+
+	if day, _ := dayField.apply(int64(-24 * 60 * 60 * 1000)); day != int32(-1) {
+		t.Errorf("day returned wrong value for the day before the epoch: %v", day)
+	}
+
+	log.Println("Finished TestPartitionTransforms")
+}
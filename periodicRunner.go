@@ -0,0 +1,92 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// periodicRunner runs a pass on an interval for the background services, such
+// as Compactor, that embed it.
+type periodicRunner struct {
+	stop    chan struct{}
+	cancel  context.CancelFunc
+	running sync.WaitGroup // the pass loop
+}
+
+// startPasses runs pass every interval until stopPasses is called or ctx
+// ends, which also cancels a running pass.
+func (pr *periodicRunner) startPasses(ctx context.Context, interval time.Duration, pass func(ctx context.Context)) {
+	ctx, pr.cancel = context.WithCancel(ctx)
+	stop := make(chan struct{})
+	pr.stop = stop
+	ticker := time.NewTicker(interval)
+
+	pr.running.Add(1)
+	go func() {
+		defer pr.running.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				pass(ctx)
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stopPasses ends the passes started by startPasses, waiting for a running
+// pass to finish until ctx ends, when the pass is cancelled and ctx's error
+// returned. No pass runs once it has returned.
+func (pr *periodicRunner) stopPasses(ctx context.Context) (err error) {
+	if pr.stop == nil {
+		return nil
+	}
+
+	close(pr.stop)
+	pr.stop = nil
+	defer pr.cancel()
+
+	finished := make(chan struct{})
+	go func() {
+		pr.running.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		pr.cancel()
+		<-finished
+		return ctx.Err()
+	}
+}
+
+// forEachPartition calls pass for every partition of store starting with
+// prefix, stopping early if ctx ends. A failing partition is logged with
+// message but does not hold back the rest; the last failure is returned.
+func forEachPartition(ctx context.Context, store BlockStore, prefix string, logger Logger, message string, pass func(ctx context.Context, partitionKey string) error) (err error) {
+	partitionKeys, err := store.ListPartitions(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, partitionKey := range partitionKeys {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		if partitionErr := pass(ctx, partitionKey); partitionErr != nil {
+			logger.Error(message, "partition_key", partitionKey, "error", partitionErr)
+			err = partitionErr
+		}
+	}
+
+	return err
+}
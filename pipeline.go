@@ -0,0 +1,199 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPipelineRowBufferSize = 1024
+	maxPipelineErrors            = 100
+)
+
+// Pipeline runs rows from a StreamAdapter through a BlockManager into a
+// StorageAdapter, creating the channels that connect them:
+//
+//	pipeline := &Pipeline{
+//		Stream:       &KafkaStreamAdapter{...},
+//		BlockManager: &BlockManager{PartitionColumn: "user_id", KeyColumn: "timestamp", MaxAge: 60000, MaxSize: 8192, Codec: codec},
+//		Storage:      &S3StorageAdapter{...},
+//	}
+//	err := pipeline.Run(ctx)
+//
+// Run returns once the stream has ended or ctx is cancelled and every row
+// emitted has been written.
+type Pipeline struct {
+	Stream       StreamAdapter
+	BlockManager *BlockManager // its Input, Output and Errors channels are created by Run
+	Storage      StorageAdapter
+
+	RowBufferSize int           // rows buffered between Stream and BlockManager, defaults to 1024
+	DrainTimeout  time.Duration // bounds draining once the stream has ended or ctx is cancelled, unbounded if zero
+	Logger        Logger        // defaults to slog.Default()
+}
+
+// PipelineError aggregates the errors reported by a Pipeline's stages while
+// it ran. Only the first hundred are kept; the rest are counted in Dropped.
+type PipelineError struct {
+	Errors  []error
+	Dropped int
+}
+
+func (pe *PipelineError) Error() string {
+	messages := make([]string, 0, len(pe.Errors))
+	for _, err := range pe.Errors {
+		messages = append(messages, err.Error())
+	}
+
+	message := fmt.Sprintf("pipeline: %d errors: %s", len(pe.Errors)+pe.Dropped, strings.Join(messages, "; "))
+	if pe.Dropped > 0 {
+		message += fmt.Sprintf("; and %d more", pe.Dropped)
+	}
+
+	return message
+}
+
+type pipelineErrors struct {
+	pipelineError PipelineError
+	mutex         sync.Mutex
+}
+
+func (pe *pipelineErrors) add(err error) {
+	if err == nil {
+		return
+	}
+
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	if len(pe.pipelineError.Errors) < maxPipelineErrors {
+		pe.pipelineError.Errors = append(pe.pipelineError.Errors, err)
+	} else {
+		pe.pipelineError.Dropped++
+	}
+}
+
+func (pe *pipelineErrors) err() error {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	if len(pe.pipelineError.Errors) == 0 {
+		return nil
+	}
+
+	pipelineError := pe.pipelineError
+	return &pipelineError
+}
+
+// Run starts the stages from storage upwards, so that nothing is emitted
+// before the stage consuming it is running, then waits for the stream to end
+// or ctx to be cancelled. It drains in the same order rows flow: the stream is
+// stopped, the BlockManager commits the rows it holds, and the StorageAdapter
+// writes every block before Run returns the errors the stages reported,
+// including a BlockWriteError for each block the StorageAdapter gave up on.
+//
+// Only the stream is started with ctx; the BlockManager and StorageAdapter
+// keep running after it is cancelled so that the rows already emitted are
+// written, within DrainTimeout if one is set.
+func (p *Pipeline) Run(ctx context.Context) (err error) {
+	if p.Stream == nil || p.BlockManager == nil || p.Storage == nil {
+		return errors.New("Pipeline not correctly configured with Stream, BlockManager and Storage")
+	}
+
+	rowBufferSize := p.RowBufferSize
+	if rowBufferSize == 0 {
+		rowBufferSize = defaultPipelineRowBufferSize
+	}
+
+	rows := make(chan interface{}, rowBufferSize)
+	stageErrors := make(chan error)
+	blocks := make(chan *Block)
+
+	p.Stream.SetOutput(rows, stageErrors)
+	p.BlockManager.Input = rows
+	p.BlockManager.Output = blocks
+	p.BlockManager.Errors = stageErrors
+	p.Storage.SetInput(blocks, stageErrors)
+
+	reported := &pipelineErrors{}
+
+	collected := make(chan bool)
+	collectorDone := make(chan bool)
+	go func() {
+		defer close(collectorDone)
+
+		for {
+			select {
+			case stageErr := <-stageErrors:
+				reported.add(stageErr)
+			case <-collected:
+				return
+			}
+		}
+	}()
+
+	// collectedErr stops collecting once every stage has stopped reporting
+	collectedErr := func() error {
+		close(collected)
+		<-collectorDone
+		return reported.err()
+	}
+
+	stagesCtx, cancelStages := context.WithCancel(context.Background())
+	defer cancelStages()
+
+	if err = p.Storage.Start(stagesCtx); err != nil {
+		collectedErr()
+		return err
+	}
+
+	if err = p.BlockManager.Start(stagesCtx); err != nil {
+		close(blocks)
+		reported.add(err)
+		reported.add(p.Storage.Stop(stagesCtx))
+		return collectedErr()
+	}
+
+	streamStopped := make(chan error, 1)
+	drainCtx := stagesCtx
+
+	if err = p.Stream.Start(ctx); err != nil {
+		// a stream that failed to start emits nothing, so its output is closed here
+		reported.add(err)
+		close(rows)
+		streamStopped <- nil
+	} else {
+		select {
+		case <-ctx.Done():
+			LoggerOrDefault(p.Logger).Info("Pipeline cancelled, draining")
+		case <-p.BlockManager.Done():
+		}
+
+		if p.DrainTimeout > 0 {
+			var cancelDrain context.CancelFunc
+			drainCtx, cancelDrain = context.WithTimeout(stagesCtx, p.DrainTimeout)
+			defer cancelDrain()
+		}
+
+		// stream adapters such as KafkaStreamAdapter wait in Stop for their rows
+		// to be durable, which needs the stages below to keep draining
+		go func() {
+			streamStopped <- p.Stream.Stop(drainCtx)
+		}()
+	}
+
+	// the BlockManager sends nothing once Stop has returned, even if the drain
+	// ran out of time, in which case the storage is cancelled on return
+	reported.add(p.BlockManager.Stop(drainCtx))
+	close(blocks)
+
+	reported.add(p.Storage.Stop(drainCtx))
+
+	reported.add(<-streamStopped)
+
+	return collectedErr()
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	log.Println("Starting TestPipeline")
+
+	basePath := "./test/pipeline"
+	os.RemoveAll(basePath)
+	defer os.RemoveAll(basePath)
+
+	codec := GetCodecFixture()
+
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath:        basePath,
+		Codec:           codec,
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		CompressionName: "snappy",
+	}
+
+	pipeline := &Pipeline{
+		Stream: &FileStreamAdapter{
+			FilePath: "./test/data/userid1/timestamp/GEYDAMBQGA======-GEYDAMBQGA======-22MRRBB6WNL63Q4JX6Y7BN3MDEIY7EH3",
+			Codec:    codec,
+		},
+		BlockManager: &BlockManager{
+			MaxAge:          60000, // milliseconds
+			MaxSize:         8192,  // rows
+			PartitionColumn: "user_id",
+			KeyColumn:       "timestamp",
+			Codec:           codec,
+		},
+		Storage: filesystemStorageAdapter,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// the stream ends with the file, and Run returns once its row is written
+	if err := pipeline.Run(ctx); err != nil {
+		t.Errorf("Pipeline run failed with error: %s", err)
+	}
+
+	results, err := filesystemStorageAdapter.Query(context.Background(), "userid1", int64(0), int64(200000))
+	if err != nil {
+		t.Errorf("filesystemStorageAdapter query failed with error: %s", err)
+	}
+
+	if len(results) != 1 {
+		t.Errorf("Pipeline wrote wrong number of rows: %d vs. 1", len(results))
+	}
+
+	log.Println("Finished TestPipeline")
+}
+
+// rowStreamAdapter emits rows and then ends.
+type rowStreamAdapter struct {
+	rows   []interface{}
+	output chan interface{}
+	done   chan struct{}
+}
+
+func (rsa *rowStreamAdapter) SetOutput(output chan interface{}, errors chan error) {
+	rsa.output = output
+}
+
+func (rsa *rowStreamAdapter) Start(ctx context.Context) (err error) {
+	rsa.done = make(chan struct{})
+
+	go func() {
+		defer close(rsa.done)
+		defer close(rsa.output)
+
+		for _, row := range rsa.rows {
+			rsa.output <- row
+		}
+	}()
+
+	return nil
+}
+
+func (rsa *rowStreamAdapter) Stop(ctx context.Context) (err error) {
+	return nil
+}
+
+func (rsa *rowStreamAdapter) Done() <-chan struct{} {
+	return rsa.done
+}
+
+// stuckStorageAdapter never takes a block from its input, as a storage
+// adapter retrying a write forever.
+type stuckStorageAdapter struct {
+	StorageAdapter
+
+	done chan struct{}
+}
+
+func (ssa *stuckStorageAdapter) SetInput(input chan *Block, errors chan error) {}
+
+func (ssa *stuckStorageAdapter) Start(ctx context.Context) (err error) {
+	ssa.done = make(chan struct{})
+	return nil
+}
+
+func (ssa *stuckStorageAdapter) Stop(ctx context.Context) (err error) {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (ssa *stuckStorageAdapter) Done() <-chan struct{} {
+	return ssa.done
+}
+
+func TestPipelineDrainTimeout(t *testing.T) {
+	log.Println("Starting TestPipelineDrainTimeout")
+
+	pipeline := &Pipeline{
+		Stream: &rowStreamAdapter{
+			rows: []interface{}{map[string]interface{}{"user_id": "userid1", "timestamp": int64(100000)}},
+		},
+		BlockManager: &BlockManager{
+			MaxAge:          1,    // milliseconds
+			MaxSize:         8192, // rows
+			PartitionColumn: "user_id",
+			KeyColumn:       "timestamp",
+			Codec:           GetCodecFixture(),
+		},
+		Storage:      &stuckStorageAdapter{},
+		DrainTimeout: 1500 * time.Millisecond, // long enough for an age check to get stuck
+	}
+
+	finished := make(chan error, 1)
+	go func() {
+		finished <- pipeline.Run(context.Background())
+	}()
+
+	select {
+	case err := <-finished:
+		if err == nil {
+			t.Errorf("Pipeline run did not report running out of time to drain")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Pipeline run did not return after its drain timeout")
+	}
+
+	log.Println("Finished TestPipelineDrainTimeout")
+}
@@ -0,0 +1,216 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+type PredicateOperator int
+
+const (
+	Equal PredicateOperator = iota
+	NotEqual
+	LessThan
+	LessThanOrEqual
+	GreaterThan
+	GreaterThanOrEqual
+	In
+	IsNull
+	IsNotNull
+)
+
+// Predicate filters rows on a single column. Union values such as
+// ["null", "double"] are compared on the value they wrap, so a Predicate on
+// accuracy can be written against a plain float64.
+type Predicate struct {
+	Column   string
+	Operator PredicateOperator
+	Value    interface{}   // operand for Equal through GreaterThanOrEqual
+	Values   []interface{} // candidate set for In
+}
+
+// unwrapUnion returns the value wrapped by a goavro union, or the value
+// itself if it is not a union.
+func unwrapUnion(value interface{}) interface{} {
+	if unionMap, ok := value.(map[string]interface{}); ok && len(unionMap) == 1 {
+		for _, unionValue := range unionMap {
+			return unionValue
+		}
+	}
+
+	return value
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch t := value.(type) {
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case float32:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+
+	return 0, false
+}
+
+// compareValues orders two primitive values, returning false if they cannot
+// be compared with each other. Numeric types compare across widths. NaN is
+// unordered, so compares with nothing.
+func compareValues(a interface{}, b interface{}) (comparison int, ok bool) {
+	if aInt, aOk := a.(int64); aOk {
+		if bInt, bOk := b.(int64); bOk {
+			switch {
+			case aInt < bInt:
+				return -1, true
+			case aInt > bInt:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	if aFloat, aOk := toFloat64(a); aOk {
+		bFloat, bOk := toFloat64(b)
+		if !bOk || math.IsNaN(aFloat) || math.IsNaN(bFloat) {
+			return 0, false
+		}
+		switch {
+		case aFloat < bFloat:
+			return -1, true
+		case aFloat > bFloat:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch t := a.(type) {
+	case time.Time:
+		bTime, bOk := b.(time.Time)
+		if !bOk {
+			return 0, false
+		}
+		switch {
+		case t.Before(bTime):
+			return -1, true
+		case t.After(bTime):
+			return 1, true
+		}
+		return 0, true
+	case string:
+		bString, bOk := b.(string)
+		if !bOk {
+			return 0, false
+		}
+		return strings.Compare(t, bString), true
+	case bool:
+		bBool, bOk := b.(bool)
+		if !bOk {
+			return 0, false
+		}
+		switch {
+		case t == bBool:
+			return 0, true
+		case !t:
+			return -1, true
+		}
+		return 1, true
+	}
+
+	return 0, false
+}
+
+func (p *Predicate) Matches(row interface{}) bool {
+	rowMap, ok := row.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	value := unwrapUnion(rowMap[p.Column])
+
+	switch p.Operator {
+	case IsNull:
+		return value == nil
+	case IsNotNull:
+		return value != nil
+	case In:
+		for _, candidate := range p.Values {
+			if comparison, ok := compareValues(value, candidate); ok && comparison == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	if value == nil {
+		return false
+	}
+
+	comparison, ok := compareValues(value, p.Value)
+	if !ok {
+		return false
+	}
+
+	switch p.Operator {
+	case Equal:
+		return comparison == 0
+	case NotEqual:
+		return comparison != 0
+	case LessThan:
+		return comparison < 0
+	case LessThanOrEqual:
+		return comparison <= 0
+	case GreaterThan:
+		return comparison > 0
+	case GreaterThanOrEqual:
+		return comparison >= 0
+	}
+
+	// operators validatePredicates rejects match nothing
+	return false
+}
+
+// validatePredicates rejects predicates with an operator Matches does not
+// support, so that a query using one fails rather than returning no rows.
+func validatePredicates(predicates []Predicate) (err error) {
+	for _, predicate := range predicates {
+		if predicate.Operator < Equal || predicate.Operator > IsNotNull {
+			return fmt.Errorf("%w: predicate on %s: operator %d not supported", ErrInvalidQuery, predicate.Column, predicate.Operator)
+		}
+	}
+
+	return nil
+}
+
+func matchesAllPredicates(row interface{}, predicates []Predicate) bool {
+	for i := range predicates {
+		if !predicates[i].Matches(row) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func projectRow(row interface{}, columns []string) interface{} {
+	if len(columns) == 0 {
+		return row
+	}
+
+	rowMap := row.(map[string]interface{})
+	projected := make(map[string]interface{}, len(columns))
+
+	for _, column := range columns {
+		if value, exists := rowMap[column]; exists {
+			projected[column] = value
+		}
+	}
+
+	return projected
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"log"
+	"math"
+	"testing"
+)
+
+func TestPredicateMatches(t *testing.T) {
+	log.Println("Starting TestPredicateMatches")
+
+	native := GetNativeFixture()
+
+	cases := []struct {
+		predicate Predicate
+		matches   bool
+	}{
+		{Predicate{Column: "user_id", Operator: Equal, Value: "userid1"}, true},
+		{Predicate{Column: "user_id", Operator: NotEqual, Value: "userid1"}, false},
+		{Predicate{Column: "latitude", Operator: LessThan, Value: 40.0}, true},
+		{Predicate{Column: "latitude", Operator: GreaterThan, Value: 40.0}, false},
+		{Predicate{Column: "timestamp", Operator: GreaterThanOrEqual, Value: int64(100000)}, true},
+		{Predicate{Column: "timestamp", Operator: LessThanOrEqual, Value: 99999}, false},
+		{Predicate{Column: "source", Operator: In, Values: []interface{}{"gps", "device"}}, true},
+		{Predicate{Column: "accuracy", Operator: IsNull}, true},
+		{Predicate{Column: "accuracy", Operator: IsNotNull}, false},
+		{Predicate{Column: "accuracy", Operator: LessThan, Value: 10.0}, false},
+	}
+
+	for _, c := range cases {
+		if c.predicate.Matches(native) != c.matches {
+			t.Errorf("Predicate %+v should have matched: %t", c.predicate, c.matches)
+		}
+	}
+
+	unionRow := map[string]interface{}{
+		"accuracy": map[string]interface{}{"double": 5.0},
+	}
+
+	unionPredicate := Predicate{Column: "accuracy", Operator: LessThan, Value: 10.0}
+	if !unionPredicate.Matches(unionRow) {
+		t.Errorf("Predicate %+v should have matched union value", unionPredicate)
+	}
+
+	if err := validatePredicates([]Predicate{unionPredicate, {Column: "accuracy", Operator: PredicateOperator(99)}}); err == nil {
+		t.Errorf("validatePredicates should reject an unsupported operator")
+	}
+
+	log.Println("Finished TestPredicateMatches")
+}
+
+func TestPredicateNaN(t *testing.T) {
+	log.Println("Starting TestPredicateNaN")
+
+	for _, pair := range [][2]interface{}{
+		{math.NaN(), 1.0},
+		{1.0, math.NaN()},
+		{math.NaN(), math.NaN()},
+		{float32(math.NaN()), int64(1)},
+	} {
+		if comparison, ok := compareValues(pair[0], pair[1]); ok {
+			t.Errorf("compareValues(%v, %v) ordered NaN: %d", pair[0], pair[1], comparison)
+		}
+	}
+
+	row := map[string]interface{}{"latitude": math.NaN()}
+	for _, operator := range []PredicateOperator{Equal, LessThan, LessThanOrEqual, GreaterThan, GreaterThanOrEqual} {
+		predicate := Predicate{Column: "latitude", Operator: operator, Value: 40.0}
+		if predicate.Matches(row) {
+			t.Errorf("Predicate %+v matched NaN", predicate)
+		}
+	}
+
+	log.Println("Finished TestPredicateNaN")
+}
+
+func TestProjectRow(t *testing.T) {
+	log.Println("Starting TestProjectRow")
+
+	projected := projectRow(GetNativeFixture(), []string{"latitude", "longitude", "timestamp"}).(map[string]interface{})
+
+	if len(projected) != 3 {
+		t.Errorf("Projected row has wrong number of columns: %d vs. 3", len(projected))
+	}
+
+	if _, exists := projected["user_id"]; exists {
+		t.Errorf("Projected row should not include user_id")
+	}
+
+	log.Println("Finished TestProjectRow")
+}
@@ -0,0 +1,217 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultMetricBuckets are the histogram buckets, in seconds, used for
+// durations unless PrometheusMetrics.Buckets says otherwise.
+var DefaultMetricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var defaultMetricBuckets = map[string][]float64{
+	MetricBlockAge: {1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+}
+
+// PrometheusMetrics keeps Metrics in memory and serves them in the Prometheus
+// text exposition format:
+//
+//	metrics := &PrometheusMetrics{}
+//	blockManager.Metrics = metrics
+//	storageAdapter.Metrics = metrics
+//	http.Handle("/metrics", metrics)
+type PrometheusMetrics struct {
+	Buckets map[string][]float64 // histogram buckets by metric name
+
+	families map[string]*prometheusFamily
+	mutex    sync.Mutex
+}
+
+type prometheusFamily struct {
+	metricType string // counter, gauge or histogram
+	series     map[string]*prometheusSeries
+}
+
+type prometheusSeries struct {
+	labels string // formatted, eg. {adapter="s3"}
+	value  float64
+
+	// histograms only
+	buckets      []float64
+	bucketCounts []uint64
+	count        uint64
+}
+
+func (pm *PrometheusMetrics) AddCounter(name string, labels MetricLabels, delta float64) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.series(name, "counter", labels).value += delta
+}
+
+func (pm *PrometheusMetrics) SetGauge(name string, labels MetricLabels, value float64) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.series(name, "gauge", labels).value = value
+}
+
+func (pm *PrometheusMetrics) Observe(name string, labels MetricLabels, value float64) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	series := pm.series(name, "histogram", labels)
+	if series.buckets == nil {
+		series.buckets = pm.bucketsFor(name)
+		series.bucketCounts = make([]uint64, len(series.buckets))
+	}
+
+	for index, upperBound := range series.buckets {
+		if value <= upperBound {
+			series.bucketCounts[index]++
+		}
+	}
+
+	series.value += value
+	series.count++
+}
+
+func (pm *PrometheusMetrics) bucketsFor(name string) []float64 {
+	if buckets, ok := pm.Buckets[name]; ok {
+		return buckets
+	}
+
+	if buckets, ok := defaultMetricBuckets[name]; ok {
+		return buckets
+	}
+
+	return DefaultMetricBuckets
+}
+
+// series returns the series of a metric with the given labels, creating it
+// if need be. The caller holds the mutex.
+func (pm *PrometheusMetrics) series(name string, metricType string, labels MetricLabels) *prometheusSeries {
+	if pm.families == nil {
+		pm.families = make(map[string]*prometheusFamily)
+	}
+
+	family, ok := pm.families[name]
+	if !ok {
+		family = &prometheusFamily{
+			metricType: metricType,
+			series:     make(map[string]*prometheusSeries),
+		}
+		pm.families[name] = family
+	}
+
+	formattedLabels := formatPrometheusLabels(labels)
+	series, ok := family.series[formattedLabels]
+	if !ok {
+		series = &prometheusSeries{labels: formattedLabels}
+		family.series[formattedLabels] = series
+	}
+
+	return series
+}
+
+func formatPrometheusLabels(labels MetricLabels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, quotePrometheusLabelValue(labels[name])))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func quotePrometheusLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+
+	return `"` + value + `"`
+}
+
+// withPrometheusLabel adds a label to a series' formatted labels.
+func withPrometheusLabel(formattedLabels string, name string, value string) string {
+	pair := fmt.Sprintf("%s=%s", name, quotePrometheusLabelValue(value))
+	if len(formattedLabels) == 0 {
+		return "{" + pair + "}"
+	}
+
+	return formattedLabels[:len(formattedLabels)-1] + "," + pair + "}"
+}
+
+func formatPrometheusValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// writeExposition writes every metric in the Prometheus text exposition format.
+func (pm *PrometheusMetrics) writeExposition(buffer *bytes.Buffer) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	names := make([]string, 0, len(pm.families))
+	for name := range pm.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := pm.families[name]
+
+		if help, ok := metricHelp[name]; ok {
+			fmt.Fprintf(buffer, "# HELP %s %s\n", name, help)
+		}
+		fmt.Fprintf(buffer, "# TYPE %s %s\n", name, family.metricType)
+
+		seriesKeys := make([]string, 0, len(family.series))
+		for seriesKey := range family.series {
+			seriesKeys = append(seriesKeys, seriesKey)
+		}
+		sort.Strings(seriesKeys)
+
+		for _, seriesKey := range seriesKeys {
+			series := family.series[seriesKey]
+
+			if family.metricType != "histogram" {
+				fmt.Fprintf(buffer, "%s%s %s\n", name, series.labels, formatPrometheusValue(series.value))
+				continue
+			}
+
+			for index, upperBound := range series.buckets {
+				fmt.Fprintf(buffer, "%s_bucket%s %d\n", name, withPrometheusLabel(series.labels, "le", formatPrometheusValue(upperBound)), series.bucketCounts[index])
+			}
+			fmt.Fprintf(buffer, "%s_bucket%s %d\n", name, withPrometheusLabel(series.labels, "le", "+Inf"), series.count)
+			fmt.Fprintf(buffer, "%s_sum%s %s\n", name, series.labels, formatPrometheusValue(series.value))
+			fmt.Fprintf(buffer, "%s_count%s %d\n", name, series.labels, series.count)
+		}
+	}
+}
+
+func (pm *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buffer := &bytes.Buffer{}
+	pm.writeExposition(buffer)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buffer.Bytes())
+}
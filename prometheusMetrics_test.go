@@ -0,0 +1,50 @@
+package core
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	log.Println("Starting TestPrometheusMetrics")
+
+	metrics := &PrometheusMetrics{
+		Buckets: map[string][]float64{MetricQueryDuration: {0.1, 1}},
+	}
+
+	scope := metricsScope{metrics: metrics, labels: MetricLabels{"adapter": "s3"}}
+	scope.addCounter(MetricBytesWritten, 100)
+	scope.addCounter(MetricBytesWritten, 50)
+	scope.addCounter(MetricBlocksCommitted, 1, "reason", "size")
+	scope.setGauge(MetricOpenBlocks, 3)
+	scope.observe(MetricQueryDuration, 0.5)
+	scope.observe(MetricQueryDuration, 2)
+
+	buffer := &bytes.Buffer{}
+	metrics.writeExposition(buffer)
+	exposition := buffer.String()
+
+	expectedLines := []string{
+		"# TYPE iceberg_storage_bytes_written_total counter",
+		`iceberg_storage_bytes_written_total{adapter="s3"} 150`,
+		`iceberg_block_manager_blocks_committed_total{adapter="s3",reason="size"} 1`,
+		"# TYPE iceberg_block_manager_open_blocks gauge",
+		`iceberg_block_manager_open_blocks{adapter="s3"} 3`,
+		"# TYPE iceberg_query_duration_seconds histogram",
+		`iceberg_query_duration_seconds_bucket{adapter="s3",le="0.1"} 0`,
+		`iceberg_query_duration_seconds_bucket{adapter="s3",le="1"} 1`,
+		`iceberg_query_duration_seconds_bucket{adapter="s3",le="+Inf"} 2`,
+		`iceberg_query_duration_seconds_sum{adapter="s3"} 2.5`,
+		`iceberg_query_duration_seconds_count{adapter="s3"} 2`,
+	}
+
+	for _, expectedLine := range expectedLines {
+		if !strings.Contains(exposition, expectedLine+"\n") {
+			t.Errorf("Exposition missing %s:\n%s", expectedLine, exposition)
+		}
+	}
+
+	log.Println("Finished TestPrometheusMetrics")
+}
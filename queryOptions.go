@@ -0,0 +1,41 @@
+package core
+
+type SortOrder int
+
+const (
+	Ascending SortOrder = iota
+	Descending
+)
+
+type QueryOptions struct {
+	Order SortOrder // ordering of results by KeyColumn
+	Limit int       // maximum number of rows returned, 0 for no limit
+
+	Columns    []string    // columns to return, all columns if empty
+	Predicates []Predicate // rows must match every predicate to be returned
+
+	Concurrency int // partitions listed and blocks loaded at once, defaults to 16
+}
+
+const defaultQueryConcurrency = 16
+
+var defaultQueryOptions = &QueryOptions{
+	Order: Ascending,
+}
+
+func (o *QueryOptions) concurrency() int {
+	if o.Concurrency <= 0 {
+		return defaultQueryConcurrency
+	}
+
+	return o.Concurrency
+}
+
+// before reports whether rows with key a are returned ahead of rows with key b.
+func (o *QueryOptions) before(a interface{}, b interface{}) bool {
+	if o.Order == Descending {
+		return compareKeys(a, b) > 0
+	}
+
+	return compareKeys(a, b) < 0
+}
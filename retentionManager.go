@@ -0,0 +1,172 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	goavro "github.com/linkedin/goavro/v2"
+)
+
+// RetentionManager expires rows whose key is older than Retention. Blocks
+// that end before the cutoff are deleted outright; blocks that straddle it are
+// rewritten without their expired rows.
+type RetentionManager struct {
+	Store     BlockStore
+	Codec     *goavro.Codec
+	KeyColumn string
+
+	Retention       time.Duration // age beyond which rows are expired, eg. 90 * 24 * time.Hour
+	Interval        uint32        // between retention passes in milliseconds, periodic passes are disabled if zero
+	PartitionPrefix string        // limits passes to partitions starting with this prefix
+
+	Logger Logger // defaults to slog.Default()
+
+	periodicRunner
+}
+
+// cutoffKey expresses now - Retention in the key column's type. Long keys are
+// taken to be milliseconds since the epoch.
+func (rm *RetentionManager) cutoffKey(now time.Time) (cutoff interface{}, err error) {
+	keyType, err := KeyTypeFromCodec(rm.Codec, rm.KeyColumn)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoffTime := now.Add(-rm.Retention).UTC()
+
+	switch keyType {
+	case Int64Key:
+		return cutoffTime.UnixNano() / int64(time.Millisecond), nil
+	case TimestampMillisKey, TimestampMicrosKey:
+		return cutoffTime, nil
+	}
+
+	return nil, fmt.Errorf("cutoffKey: key column %s is not a timestamp", rm.KeyColumn)
+}
+
+// ExpirePartition removes every row of a partition with a key before cutoff,
+// returning the number of blocks deleted or rewritten.
+func (rm *RetentionManager) ExpirePartition(ctx context.Context, partitionKey string, cutoff interface{}) (expired int, err error) {
+	keyType, err := KeyTypeFromCodec(rm.Codec, rm.KeyColumn)
+	if err != nil {
+		return 0, err
+	}
+
+	if cutoff, err = keyType.Normalize(cutoff); err != nil {
+		return 0, err
+	}
+
+	partitionFileNames, err := rm.Store.GetPartitionFileNames(ctx, partitionKey)
+	if err != nil {
+		return 0, err
+	}
+
+	added := []*Block{}
+	removedFilenames := []string{}
+
+	for _, blockFilename := range partitionFileNames {
+		blockStartKey, blockEndKey, err := parseBlockFilenameKeyRange(blockFilename, keyType.template())
+		if err != nil {
+			return 0, err
+		}
+
+		if compareKeys(blockStartKey, cutoff) >= 0 {
+			continue
+		}
+
+		removedFilenames = append(removedFilenames, blockFilename)
+
+		if compareKeys(blockEndKey, cutoff) < 0 {
+			continue
+		}
+
+		// the block straddles the cutoff, so keep its unexpired rows
+		block, err := readBlock(ctx, rm.Store, partitionKey, blockFilename)
+		if err != nil {
+			return 0, err
+		}
+
+		retained := NewBlock(partitionKey, rm.KeyColumn, rm.Codec)
+		retained.Logger = rm.Logger
+		for _, row := range block.Rows {
+			if key, err := block.rowKey(row); err == nil && compareKeys(key, cutoff) >= 0 {
+				retained.Write(row)
+			}
+		}
+
+		if retained.Length() > 0 {
+			added = append(added, retained)
+		}
+	}
+
+	if len(removedFilenames) == 0 {
+		return 0, nil
+	}
+
+	rm.logger().Info("Expiring blocks", "partition_key", partitionKey, "blocks", len(removedFilenames), "rewritten_blocks", len(added))
+
+	if err = rm.Store.ReplaceBlocks(ctx, partitionKey, added, removedFilenames); err != nil {
+		return 0, err
+	}
+
+	return len(removedFilenames), nil
+}
+
+func (rm *RetentionManager) logger() Logger {
+	return LoggerOrDefault(rm.Logger)
+}
+
+// Expire runs a retention pass over every partition starting with
+// PartitionPrefix, stopping early if ctx ends.
+func (rm *RetentionManager) Expire(ctx context.Context) (err error) {
+	cutoff, err := rm.cutoffKey(time.Now())
+	if err != nil {
+		return err
+	}
+
+	return forEachPartition(ctx, rm.Store, rm.PartitionPrefix, rm.logger(), "Expiring partition failed", func(ctx context.Context, partitionKey string) error {
+		_, err := rm.ExpirePartition(ctx, partitionKey, cutoff)
+		return err
+	})
+}
+
+// Start checks that the key column can be compared with a cutoff and, if
+// Interval is set, expires rows every Interval until Stop is called or ctx
+// ends.
+func (rm *RetentionManager) Start(ctx context.Context) (err error) {
+	if rm.Store == nil {
+		return errors.New("RetentionManager not correctly configured with Store")
+	}
+
+	if rm.Retention <= 0 {
+		return errors.New("RetentionManager not correctly configured with Retention")
+	}
+
+	if _, err = rm.cutoffKey(time.Now()); err != nil {
+		return err
+	}
+
+	if rm.Interval == 0 {
+		return nil
+	}
+
+	rm.startPasses(ctx, time.Duration(rm.Interval)*time.Millisecond, func(ctx context.Context) {
+		rm.Expire(ctx)
+	})
+
+	return nil
+}
+
+// Stop ends periodic retention passes, cancelling one still running when ctx
+// ends.
+func (rm *RetentionManager) Stop(ctx context.Context) (err error) {
+	rm.logger().Info("Stopping RetentionManager")
+
+	if err = rm.stopPasses(ctx); err != nil {
+		return fmt.Errorf("RetentionManager: retention pass did not finish: %w", err)
+	}
+
+	return nil
+}
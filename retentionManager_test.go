@@ -0,0 +1,127 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetentionManagerExpirePartition(t *testing.T) {
+	log.Println("Starting TestRetentionManagerExpirePartition")
+
+	basePath := "./test/retention"
+	os.RemoveAll(basePath)
+	defer os.RemoveAll(basePath)
+
+	partitionKey := "userid-retention"
+	input := make(chan *Block)
+
+	filesystemStorageAdapter := &FilesystemStorageAdapter{
+		BasePath:        basePath,
+		Codec:           GetCodecFixture(),
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		CompressionName: "snappy",
+		Input:           input,
+	}
+
+	if err := filesystemStorageAdapter.Start(context.Background()); err != nil {
+		t.Errorf("filesystemStorageAdapter failed to start: %s", err)
+	}
+
+	// one block entirely before the cutoff of 250, one straddling it, one after it
+	for _, timestamps := range [][]int64{{100, 200}, {200, 300}, {400, 500}} {
+		block := NewBlock(partitionKey, filesystemStorageAdapter.KeyColumn, filesystemStorageAdapter.Codec)
+		for _, timestamp := range timestamps {
+			native := GetNativeFixture().(map[string]interface{})
+			native["user_id"] = partitionKey
+			native["timestamp"] = timestamp
+			block.Write(native)
+		}
+
+		input <- block
+	}
+	close(input)
+
+	filesystemStorageAdapter.Stop(context.Background())
+
+	retentionManager := &RetentionManager{
+		Store:     filesystemStorageAdapter,
+		Codec:     filesystemStorageAdapter.Codec,
+		KeyColumn: filesystemStorageAdapter.KeyColumn,
+		Retention: 90 * 24 * time.Hour,
+	}
+
+	expired, err := retentionManager.ExpirePartition(context.Background(), partitionKey, int64(250))
+	if err != nil {
+		t.Errorf("ExpirePartition failed with error: %s", err)
+	}
+
+	if expired != 2 {
+		t.Errorf("ExpirePartition expired wrong number of blocks: %d", expired)
+	}
+
+	results, err := filesystemStorageAdapter.Query(context.Background(), partitionKey, int64(0), int64(1000))
+	if err != nil {
+		t.Errorf("filesystemStorageAdapter query failed with error: %s", err)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("query after expiry returned wrong number of rows: %d", len(results))
+	}
+
+	if timestamp := results[0].(map[string]interface{})["timestamp"].(int64); timestamp != 300 {
+		t.Errorf("query after expiry returned expired row: %d", timestamp)
+	}
+
+	log.Println("Finished TestRetentionManagerExpirePartition")
+}
+
+func TestRetentionManagerStopDeadline(t *testing.T) {
+	log.Println("Starting TestRetentionManagerStopDeadline")
+
+	store := &blockingBlockStore{listing: make(chan struct{}, 1)}
+
+	retentionManager := &RetentionManager{
+		Store:     store,
+		Codec:     GetCodecFixture(),
+		KeyColumn: "timestamp",
+		Retention: time.Hour,
+		Interval:  10, // milliseconds
+	}
+
+	if err := retentionManager.Start(context.Background()); err != nil {
+		t.Fatalf("RetentionManager failed to start: %s", err)
+	}
+
+	select {
+	case <-store.listing:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("RetentionManager did not start a pass")
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- retentionManager.Stop(stopCtx) }()
+
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("RetentionManager stop returned wrong error for a stuck pass: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("RetentionManager stop did not return once its deadline passed")
+	}
+
+	if atomic.LoadInt32(&store.returned) != 1 {
+		t.Errorf("RetentionManager stop returned before cancelling the running pass")
+	}
+
+	log.Println("Finished TestRetentionManagerStopDeadline")
+}
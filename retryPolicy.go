@@ -0,0 +1,172 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts    = 5
+	defaultRetryInitialBackoff = 1 * time.Second
+	defaultRetryMaxBackoff     = 1 * time.Minute
+)
+
+// RetryPolicy decides how often a StorageAdapter attempts to write a block
+// before giving up on it. Each backoff doubles the one before, up to
+// MaxBackoff, and is randomized to between half and all of that so that
+// adapters failing together do not retry in lockstep.
+type RetryPolicy struct {
+	MaxAttempts    int           // including the first, defaults to 5
+	InitialBackoff time.Duration // before the second attempt, defaults to 1s
+	MaxBackoff     time.Duration // defaults to 1m
+
+	// DeadLetterPath is a local directory that blocks failing every attempt
+	// are written to, laid out as under a FilesystemStorageAdapter's BasePath.
+	// Without it such blocks are dropped.
+	DeadLetterPath string
+}
+
+// BlockWriteError is reported on a StorageAdapter's Errors for a block it
+// gave up writing.
+type BlockWriteError struct {
+	PartitionKey string
+	Filename     string
+	Attempts     int
+	Err          error // from the last attempt
+
+	DeadLetterPath string // the file the block was written to instead, empty if it was not
+	DeadLetterErr  error
+}
+
+func (bwe *BlockWriteError) Error() string {
+	message := fmt.Sprintf("writing block %s/%s failed after %d attempts: %s", bwe.PartitionKey, bwe.Filename, bwe.Attempts, bwe.Err)
+
+	if len(bwe.DeadLetterPath) > 0 {
+		message += fmt.Sprintf("; written to %s", bwe.DeadLetterPath)
+	} else if bwe.DeadLetterErr != nil {
+		message += fmt.Sprintf("; writing dead letter failed with %s", bwe.DeadLetterErr)
+	}
+
+	return message
+}
+
+func (rp *RetryPolicy) withDefaults() (policy RetryPolicy) {
+	if rp != nil {
+		policy = *rp
+	}
+
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaultRetryMaxAttempts
+	}
+
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = defaultRetryInitialBackoff
+	}
+
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = defaultRetryMaxBackoff
+	}
+
+	return policy
+}
+
+// backoff returns the wait after the given failed attempt, counting from 1.
+func (rp *RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := rp.InitialBackoff
+	for i := 1; i < attempt && backoff < rp.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > rp.MaxBackoff {
+		backoff = rp.MaxBackoff
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// writeBlock calls write until it succeeds, the policy's attempts run out or
+// ctx ends, and marks the block durable once it is written. A block that could
+// not be written is sent to the dead letter directory, which also makes it
+// durable, and returned as a BlockWriteError.
+func (rp *RetryPolicy) writeBlock(ctx context.Context, block *Block, write func(context.Context, *Block) error, metrics metricsScope, logger Logger) (err error) {
+	policy := rp.withDefaults()
+
+	attempt := 1
+	for ; ; attempt++ {
+		attemptStart := time.Now()
+		err = write(ctx, block)
+		metrics.observeSince(MetricWriteDuration, attemptStart)
+
+		if err == nil {
+			block.MarkDurable()
+			return nil
+		}
+
+		logger.Warn("Writing block failed", append(blockLogArgs(block), "attempt", attempt, "max_attempts", policy.MaxAttempts, "error", err)...)
+
+		if attempt >= policy.MaxAttempts {
+			break
+		}
+
+		wait := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-wait.C:
+			metrics.addCounter(MetricWriteRetries, 1)
+			continue
+		case <-ctx.Done():
+			wait.Stop()
+		}
+
+		break
+	}
+
+	metrics.addCounter(MetricWriteFailures, 1)
+
+	writeErr := &BlockWriteError{
+		PartitionKey: block.PartitionKey,
+		Filename:     block.GetFilename(),
+		Attempts:     attempt,
+		Err:          err,
+	}
+
+	if len(policy.DeadLetterPath) > 0 {
+		if writeErr.DeadLetterPath, writeErr.DeadLetterErr = policy.deadLetter(block); writeErr.DeadLetterErr == nil {
+			block.MarkDurable()
+		}
+	}
+
+	return writeErr
+}
+
+// deadLetter writes a block as an Avro OCF file under DeadLetterPath.
+func (rp *RetryPolicy) deadLetter(block *Block) (filePath string, err error) {
+	dirPath := filepath.Join(rp.DeadLetterPath, block.PartitionKey, block.KeyColumn)
+	if err = os.MkdirAll(dirPath, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	filePath = filepath.Join(dirPath, block.GetFilename())
+	if _, err = writeOCFFile(filePath, block, block.Codec, ""); err != nil {
+		return "", err
+	}
+
+	return filePath, nil
+}
+
+// reportStorageError sends err to errors, if set, unless ctx ends first.
+func reportStorageError(ctx context.Context, logger Logger, errors chan error, err error) {
+	logger.Error("Giving up writing block", "error", err)
+
+	if errors == nil {
+		return
+	}
+
+	select {
+	case errors <- err:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	log.Println("Starting TestRetryPolicyBackoff")
+
+	policy := (&RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}).withDefaults()
+
+	if policy.MaxAttempts != defaultRetryMaxAttempts {
+		t.Errorf("MaxAttempts not defaulted: %d vs. %d", policy.MaxAttempts, defaultRetryMaxAttempts)
+	}
+
+	expectedBackoffs := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for index, expectedBackoff := range expectedBackoffs {
+		backoff := policy.backoff(index + 1)
+		if backoff < expectedBackoff/2 || backoff > expectedBackoff {
+			t.Errorf("Backoff after attempt %d out of range: %s vs. %s to %s", index+1, backoff, expectedBackoff/2, expectedBackoff)
+		}
+	}
+
+	log.Println("Finished TestRetryPolicyBackoff")
+}
+
+func TestRetryPolicyWriteBlock(t *testing.T) {
+	log.Println("Starting TestRetryPolicyWriteBlock")
+
+	deadLetterPath := "./test/deadletter"
+	os.RemoveAll(deadLetterPath)
+	defer os.RemoveAll(deadLetterPath)
+
+	policy := &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		DeadLetterPath: deadLetterPath,
+	}
+
+	block := NewBlock("userid1", "timestamp", GetCodecFixture())
+	block.Write(GetNativeFixture())
+
+	durable := 0
+	block.OnDurable(func() {
+		durable++
+	})
+
+	// succeeds on the second attempt
+	attempts := 0
+	err := policy.writeBlock(context.Background(), block, func(ctx context.Context, block *Block) error {
+		attempts++
+		if attempts < 2 {
+			return errors.New("unavailable")
+		}
+		return nil
+	}, metricsScope{}, LoggerOrDefault(nil))
+
+	if err != nil || attempts != 2 || durable != 1 {
+		t.Errorf("Retried write returned %v after %d attempts, durable %d times", err, attempts, durable)
+	}
+
+	// fails every attempt and is dead lettered
+	block = NewBlock("userid1", "timestamp", GetCodecFixture())
+	block.Write(GetNativeFixture())
+
+	attempts = 0
+	err = policy.writeBlock(context.Background(), block, func(ctx context.Context, block *Block) error {
+		attempts++
+		return errors.New("unavailable")
+	}, metricsScope{}, LoggerOrDefault(nil))
+
+	writeErr, ok := err.(*BlockWriteError)
+	if !ok {
+		t.Fatalf("Failed write returned %v rather than a BlockWriteError", err)
+	}
+
+	if attempts != 3 || writeErr.Attempts != 3 {
+		t.Errorf("Failed write made wrong number of attempts: %d (reported %d) vs. 3", attempts, writeErr.Attempts)
+	}
+
+	if _, err := os.Stat(writeErr.DeadLetterPath); err != nil {
+		t.Errorf("Dead letter %s not written: %v", writeErr.DeadLetterPath, writeErr.DeadLetterErr)
+	}
+
+	log.Println("Finished TestRetryPolicyWriteBlock")
+}
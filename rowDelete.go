@@ -0,0 +1,77 @@
+package core
+
+import "context"
+
+// deleteRows rewrites every block of a partition holding rows in
+// [startKey, endKey] that match all predicates, dropping those rows. With no
+// predicates every row in the range is deleted. Rows still held by a
+// BlockManager are not yet in storage and are unaffected. Blocks are only
+// replaced if ctx has not ended by the time all of them have been read.
+func deleteRows(ctx context.Context, store BlockStore, logger Logger, keyColumn string, partitionKey string, startKey interface{}, endKey interface{}, predicates []Predicate) (removed int64, err error) {
+	if err = validatePredicates(predicates); err != nil {
+		return 0, err
+	}
+
+	partitionFileNames, err := store.GetPartitionFileNames(ctx, partitionKey)
+	if err != nil {
+		return 0, err
+	}
+
+	added := []*Block{}
+	removedFilenames := []string{}
+
+	for _, blockFilename := range IntersectingBlockFilenames(partitionFileNames, startKey, endKey) {
+		if len(predicates) > 0 {
+			statistics, err := store.LoadStatistics(ctx, partitionKey, blockFilename)
+			if err == nil && !statistics.MightMatchAll(predicates) {
+				continue
+			}
+		}
+
+		block, err := readBlock(ctx, store, partitionKey, blockFilename)
+		if err != nil {
+			return 0, err
+		}
+
+		retained := NewBlock(partitionKey, keyColumn, block.Codec)
+		retained.Logger = logger
+		var blockRemoved int64
+		for _, row := range block.Rows {
+			key, err := block.rowKey(row)
+			inRange := err == nil && compareKeys(key, startKey) >= 0 && compareKeys(key, endKey) <= 0
+
+			if inRange && matchesAllPredicates(row, predicates) {
+				blockRemoved++
+				continue
+			}
+
+			retained.Write(row)
+		}
+
+		if blockRemoved == 0 {
+			continue
+		}
+
+		removed += blockRemoved
+		removedFilenames = append(removedFilenames, blockFilename)
+		if retained.Length() > 0 {
+			added = append(added, retained)
+		}
+	}
+
+	if len(removedFilenames) == 0 {
+		return 0, nil
+	}
+
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	logger.Info("Deleting rows", "partition_key", partitionKey, "rows", removed, "blocks", len(removedFilenames))
+
+	if err = store.ReplaceBlocks(ctx, partitionKey, added, removedFilenames); err != nil {
+		return 0, err
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// rowIdentity renders the values of a row's identity columns, eg. user_id and
+// timestamp, as a string that is equal for two rows exactly when they
+// describe the same event. Rows without all of the columns have no identity.
+func rowIdentity(row interface{}, identityColumns []string) (identity string, ok bool) {
+	rowMap, isRecord := row.(map[string]interface{})
+	if !isRecord {
+		return "", false
+	}
+
+	values := make([]string, 0, len(identityColumns))
+	for _, column := range identityColumns {
+		rawValue, exists := rowMap[column]
+		if !exists {
+			return "", false
+		}
+
+		value := unwrapUnion(rawValue)
+
+		encoded, err := encodeKey(value)
+		if err != nil {
+			encoded = fmt.Sprintf("%v", value)
+		}
+
+		values = append(values, fmt.Sprintf("%T:%s", value, encoded))
+	}
+
+	return strings.Join(values, "\x00"), true
+}
+
+// identityIncludesKey reports whether every row sharing an identity also
+// shares a key, in which case duplicates can only be found among rows with
+// equal keys.
+func identityIncludesKey(identityColumns []string, keyColumn string) bool {
+	for _, column := range identityColumns {
+		if column == keyColumn {
+			return true
+		}
+	}
+
+	return false
+}
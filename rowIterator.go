@@ -0,0 +1,488 @@
+package core
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RowIterator yields query results one row at a time so that callers never
+// need to hold the full result set in memory.
+//
+//	iter, err := adapter.QueryIter(ctx, partitionKey, startKey, endKey, nil)
+//	defer iter.Close()
+//	for iter.Next() {
+//		row := iter.Row()
+//	}
+//	err = iter.Err()
+type RowIterator interface {
+	Next() bool
+	Row() interface{}
+	Err() error
+	Close() error
+}
+
+// blockSource is implemented by storage adapters that can enumerate and load
+// the blocks of a partition.
+type blockSource interface {
+	GetPartitionFileNames(ctx context.Context, partitionKey string) (partitionFileNames []string, err error)
+	Load(ctx context.Context, partitionKey string, blockFilename string, blocks chan *Block, errors chan error)
+	LoadStatistics(ctx context.Context, partitionKey string, blockFilename string) (statistics *BlockStatistics, err error)
+}
+
+type pendingBlock struct {
+	partitionKey string
+	filename     string
+	startingKey  interface{}
+	endingKey    interface{}
+}
+
+// boundaryKey is the first key, in result order, that the block could yield.
+func (pb *pendingBlock) boundaryKey(options *QueryOptions) interface{} {
+	if options.Order == Descending {
+		return pb.endingKey
+	}
+
+	return pb.startingKey
+}
+
+type blockCursor struct {
+	block *Block
+	rows  []interface{}
+}
+
+func (bc *blockCursor) key() interface{} {
+	key, _ := bc.block.rowKey(bc.rows[0])
+	return key
+}
+
+type blockCursorHeap struct {
+	cursors []*blockCursor
+	options *QueryOptions
+}
+
+func (h *blockCursorHeap) Len() int { return len(h.cursors) }
+func (h *blockCursorHeap) Less(i, j int) bool {
+	return h.options.before(h.cursors[i].key(), h.cursors[j].key())
+}
+func (h *blockCursorHeap) Swap(i, j int)      { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+func (h *blockCursorHeap) Push(x interface{}) { h.cursors = append(h.cursors, x.(*blockCursor)) }
+func (h *blockCursorHeap) Pop() interface{} {
+	last := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return last
+}
+
+// blockRowIterator performs a k-way merge over the blocks of one or more
+// partitions, yielding rows in key order. Blocks are read ahead in key order,
+// at most options.concurrency() at once, and only merged once the merge
+// reaches the first key they could contribute, so queries over mostly
+// disjoint blocks hold roughly that many blocks in memory at a time.
+//
+// With identityColumns, a row is only returned the first time its identity is
+// seen, so rows duplicated across blocks by replayed ingestion appear once.
+// When the identity includes the key column duplicates share a key, and only
+// the identities of the current key are remembered; otherwise every identity
+// returned is.
+//
+// The iterator takes over span, the query's, ending it once its rows are
+// exhausted or it is closed.
+type blockRowIterator struct {
+	ctx             context.Context
+	source          blockSource
+	startKey        interface{}
+	endKey          interface{}
+	options         *QueryOptions
+	identityColumns []string
+
+	pending  []*pendingBlock
+	cursors  *blockCursorHeap
+	returned int
+
+	loading     []*pendingLoad // read ahead of the merge, in key order
+	loadCtx     context.Context
+	cancelLoads context.CancelFunc
+	loads       sync.WaitGroup
+
+	identities    map[string]bool // already returned
+	identitiesKey interface{}
+
+	metrics       metricsScope
+	span          trace.Span
+	started       time.Time
+	finished      bool
+	blocksScanned int
+	blocksPruned  int
+
+	row    interface{}
+	err    error
+	closed bool
+}
+
+func newBlockRowIterator(ctx context.Context, source blockSource, partitionKeys []string, startKey interface{}, endKey interface{}, options *QueryOptions, identityColumns []string, metrics metricsScope, span trace.Span) (iter *blockRowIterator, err error) {
+	if options == nil {
+		options = defaultQueryOptions
+	}
+
+	if err = validatePredicates(options.Predicates); err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	started := time.Now()
+	blocksPruned := 0
+
+	partitionsFileNames, err := listPartitionFileNames(ctx, source, partitionKeys, options.concurrency())
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	pending := []*pendingBlock{}
+	for partitionIndex, partitionKey := range partitionKeys {
+		partitionFileNames := partitionsFileNames[partitionIndex]
+
+		intersectingFilenames := IntersectingBlockFilenames(partitionFileNames, startKey, endKey)
+		blocksPruned += len(partitionFileNames) - len(intersectingFilenames)
+
+		for _, blockFilename := range intersectingFilenames {
+			blockStartKey, blockEndKey, err := parseBlockFilenameKeyRange(blockFilename, startKey)
+			if err != nil {
+				endSpan(span, err)
+				return nil, err
+			}
+
+			pending = append(pending, &pendingBlock{
+				partitionKey: partitionKey,
+				filename:     blockFilename,
+				startingKey:  blockStartKey,
+				endingKey:    blockEndKey,
+			})
+		}
+	}
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		return options.before(pending[i].boundaryKey(options), pending[j].boundaryKey(options))
+	})
+
+	metrics.addCounter(MetricQueryBlocksPruned, float64(blocksPruned))
+
+	return &blockRowIterator{
+		ctx:             ctx,
+		source:          source,
+		startKey:        startKey,
+		endKey:          endKey,
+		options:         options,
+		identityColumns: identityColumns,
+		pending:         pending,
+		cursors:         &blockCursorHeap{options: options},
+		identities:      make(map[string]bool),
+		metrics:         metrics,
+		span:            span,
+		started:         started,
+		blocksPruned:    blocksPruned,
+	}, nil
+}
+
+// listPartitionFileNames lists the blocks of every partition, concurrency at
+// a time, returning the first error any listing fails with.
+func listPartitionFileNames(ctx context.Context, source blockSource, partitionKeys []string, concurrency int) (partitionsFileNames [][]string, err error) {
+	partitionsFileNames = make([][]string, len(partitionKeys))
+	listErrors := make([]error, len(partitionKeys))
+
+	partitionIndexes := make(chan int)
+	var listers sync.WaitGroup
+
+	for lister := 0; lister < concurrency && lister < len(partitionKeys); lister++ {
+		listers.Add(1)
+		go func() {
+			defer listers.Done()
+
+			for partitionIndex := range partitionIndexes {
+				partitionsFileNames[partitionIndex], listErrors[partitionIndex] = source.GetPartitionFileNames(ctx, partitionKeys[partitionIndex])
+			}
+		}()
+	}
+
+	for partitionIndex := range partitionKeys {
+		partitionIndexes <- partitionIndex
+	}
+	close(partitionIndexes)
+	listers.Wait()
+
+	for _, err := range listErrors {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return partitionsFileNames, nil
+}
+
+// loadBlock reads a pending block, or returns nil if its statistics rule out
+// every predicate.
+func (it *blockRowIterator) loadBlock(ctx context.Context, pending *pendingBlock) (block *Block, err error) {
+	if len(it.options.Predicates) > 0 {
+		// blocks written before statistics existed have no sidecar and are always read
+		statistics, err := it.source.LoadStatistics(ctx, pending.partitionKey, pending.filename)
+		if err == nil && !statistics.MightMatchAll(it.options.Predicates) {
+			return nil, nil
+		}
+	}
+
+	return readBlock(ctx, it.source, pending.partitionKey, pending.filename)
+}
+
+type blockLoadResult struct {
+	block *Block
+	err   error
+}
+
+// pendingLoad is a pending block being read ahead of the merge.
+type pendingLoad struct {
+	pending *pendingBlock
+	result  chan blockLoadResult
+}
+
+// readAhead starts loading pending blocks, in key order, until
+// options.concurrency() of them are loading or loaded but not yet merged.
+func (it *blockRowIterator) readAhead() {
+	if it.loadCtx == nil {
+		it.loadCtx, it.cancelLoads = context.WithCancel(it.ctx)
+	}
+
+	for len(it.loading) < it.options.concurrency() && len(it.pending) > 0 {
+		load := &pendingLoad{pending: it.pending[0], result: make(chan blockLoadResult, 1)}
+		it.pending = it.pending[1:]
+		it.loading = append(it.loading, load)
+
+		it.loads.Add(1)
+		go func(ctx context.Context) {
+			defer it.loads.Done()
+
+			block, err := it.loadBlock(ctx, load.pending)
+			load.result <- blockLoadResult{block: block, err: err}
+		}(it.loadCtx)
+	}
+}
+
+// stopLoads cancels the blocks still being read ahead and waits for their
+// loads to return.
+func (it *blockRowIterator) stopLoads() {
+	if it.cancelLoads != nil {
+		it.cancelLoads()
+	}
+
+	it.loads.Wait()
+	it.loading = nil
+}
+
+// loadPendingBlocks merges every block that could yield a row ahead of the
+// current head of the merge, reading ahead the blocks after it. A query
+// stopped by its Limit or closed early abandons the blocks read ahead and
+// reads no further.
+func (it *blockRowIterator) loadPendingBlocks() (err error) {
+	for {
+		it.readAhead()
+
+		if len(it.loading) == 0 {
+			return nil
+		}
+
+		load := it.loading[0]
+		if it.cursors.Len() > 0 && it.options.before(it.cursors.cursors[0].key(), load.pending.boundaryKey(it.options)) {
+			return nil
+		}
+		it.loading = it.loading[1:]
+
+		result := <-load.result
+		if result.err != nil {
+			return result.err
+		}
+
+		// statistics that rule out every predicate leave a nil block
+		if result.block == nil {
+			it.blocksPruned++
+			it.metrics.addCounter(MetricQueryBlocksPruned, 1)
+		} else {
+			it.blocksScanned++
+			it.metrics.addCounter(MetricQueryBlocksScanned, 1)
+		}
+		it.pushBlock(result.block)
+	}
+}
+
+func (it *blockRowIterator) pushBlock(block *Block) {
+	if block == nil {
+		return
+	}
+
+	rows := block.RowsForKeyRange(it.startKey, it.endKey)
+
+	if len(it.options.Predicates) > 0 {
+		matchingRows := rows[:0]
+		for _, row := range rows {
+			if matchesAllPredicates(row, it.options.Predicates) {
+				matchingRows = append(matchingRows, row)
+			}
+		}
+		rows = matchingRows
+	}
+
+	if len(rows) == 0 {
+		return
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		iKey, _ := block.rowKey(rows[i])
+		jKey, _ := block.rowKey(rows[j])
+		return it.options.before(iKey, jKey)
+	})
+
+	heap.Push(it.cursors, &blockCursor{
+		block: block,
+		rows:  rows,
+	})
+}
+
+func (it *blockRowIterator) Next() bool {
+	if it.next() {
+		return true
+	}
+
+	it.finish()
+	return false
+}
+
+// finish records the query's metrics once its rows are exhausted or it is
+// closed.
+func (it *blockRowIterator) finish() {
+	if it.finished {
+		return
+	}
+	it.finished = true
+
+	it.stopLoads()
+
+	it.metrics.addCounter(MetricQueryRowsReturned, float64(it.returned))
+	it.metrics.observeSince(MetricQueryDuration, it.started)
+
+	it.span.SetAttributes(
+		attribute.Int(attributeRows, it.returned),
+		attribute.Int(attributeBlocksScanned, it.blocksScanned),
+		attribute.Int(attributeBlocksPruned, it.blocksPruned),
+	)
+	endSpan(it.span, it.err)
+}
+
+func (it *blockRowIterator) next() bool {
+	it.row = nil
+
+	if it.closed || it.err != nil {
+		return false
+	}
+
+	if it.options.Limit > 0 && it.returned >= it.options.Limit {
+		return false
+	}
+
+	for {
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			return false
+		}
+
+		if err := it.loadPendingBlocks(); err != nil {
+			it.err = err
+			return false
+		}
+
+		if it.cursors.Len() == 0 {
+			return false
+		}
+
+		cursor := it.cursors.cursors[0]
+		row := cursor.rows[0]
+		duplicate := it.isDuplicate(cursor, row)
+		cursor.rows = cursor.rows[1:]
+
+		if len(cursor.rows) == 0 {
+			heap.Pop(it.cursors)
+		} else {
+			heap.Fix(it.cursors, 0)
+		}
+
+		if duplicate {
+			continue
+		}
+
+		it.row = projectRow(row, it.options.Columns)
+		it.returned++
+
+		return true
+	}
+}
+
+// isDuplicate reports whether a row with the same identity as the cursor's
+// head row has already been returned.
+func (it *blockRowIterator) isDuplicate(cursor *blockCursor, row interface{}) bool {
+	if len(it.identityColumns) == 0 {
+		return false
+	}
+
+	identity, ok := rowIdentity(row, it.identityColumns)
+	if !ok {
+		return false
+	}
+
+	if identityIncludesKey(it.identityColumns, cursor.block.KeyColumn) {
+		key := cursor.key()
+		if it.identitiesKey == nil || compareKeys(key, it.identitiesKey) != 0 {
+			it.identities = make(map[string]bool)
+			it.identitiesKey = key
+		}
+	}
+
+	if it.identities[identity] {
+		return true
+	}
+
+	it.identities[identity] = true
+	return false
+}
+
+func (it *blockRowIterator) Row() interface{} {
+	return it.row
+}
+
+func (it *blockRowIterator) Err() error {
+	return it.err
+}
+
+func (it *blockRowIterator) Close() error {
+	it.finish()
+
+	it.closed = true
+	it.row = nil
+	it.pending = nil
+	it.cursors.cursors = nil
+
+	return nil
+}
+
+// collectRows drains an iterator into a slice.
+func collectRows(iter RowIterator) (results []interface{}, err error) {
+	defer iter.Close()
+
+	results = make([]interface{}, 0)
+	for iter.Next() {
+		results = append(results, iter.Row())
+	}
+
+	return results, iter.Err()
+}
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// countingBlockSource loads empty blocks once release is closed, or slowly if
+// it is nil, recording the most loads it had in flight at once, and fails
+// loading failFilename.
+type countingBlockSource struct {
+	failFilename string
+	release      chan struct{}
+
+	mutex       sync.Mutex
+	inFlight    int
+	maxInFlight int
+	loads       int
+}
+
+func (cbs *countingBlockSource) GetPartitionFileNames(ctx context.Context, partitionKey string) (partitionFileNames []string, err error) {
+	return nil, nil
+}
+
+func (cbs *countingBlockSource) LoadStatistics(ctx context.Context, partitionKey string, blockFilename string) (statistics *BlockStatistics, err error) {
+	return nil, errors.New("no statistics")
+}
+
+func (cbs *countingBlockSource) Load(ctx context.Context, partitionKey string, blockFilename string, blocks chan *Block, errors chan error) {
+	cbs.mutex.Lock()
+	cbs.inFlight++
+	cbs.loads++
+	if cbs.inFlight > cbs.maxInFlight {
+		cbs.maxInFlight = cbs.inFlight
+	}
+	cbs.mutex.Unlock()
+
+	defer func() {
+		cbs.mutex.Lock()
+		cbs.inFlight--
+		cbs.mutex.Unlock()
+	}()
+
+	if blockFilename == cbs.failFilename {
+		errors <- fmt.Errorf("loading %s failed", blockFilename)
+		return
+	}
+
+	released := cbs.release
+	if released == nil {
+		released = make(chan struct{})
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			close(released)
+		}()
+	}
+
+	select {
+	case <-released:
+		blocks <- &Block{PartitionKey: partitionKey}
+	case <-ctx.Done():
+		errors <- ctx.Err()
+	}
+}
+
+func (cbs *countingBlockSource) loadsInFlight() int {
+	cbs.mutex.Lock()
+	defer cbs.mutex.Unlock()
+
+	return cbs.inFlight
+}
+
+// disjointBlockIterator merges blocks with disjoint, ascending key ranges, as
+// a partition written in key order holds.
+func disjointBlockIterator(source blockSource, blockCount int, concurrency int) *blockRowIterator {
+	pending := []*pendingBlock{}
+	for index := 0; index < blockCount; index++ {
+		pending = append(pending, &pendingBlock{
+			partitionKey: "userid1",
+			filename:     fmt.Sprintf("block-%d", index),
+			startingKey:  int64(index * 10),
+			endingKey:    int64(index*10 + 9),
+		})
+	}
+
+	options := &QueryOptions{Concurrency: concurrency}
+
+	return &blockRowIterator{
+		ctx:        context.Background(),
+		source:     source,
+		startKey:   int64(0),
+		endKey:     int64(blockCount * 10),
+		options:    options,
+		pending:    pending,
+		cursors:    &blockCursorHeap{options: options},
+		identities: make(map[string]bool),
+		span:       trace.SpanFromContext(context.Background()),
+	}
+}
+
+func TestBlockRowIteratorReadsAhead(t *testing.T) {
+	log.Println("Starting TestBlockRowIteratorReadsAhead")
+
+	goroutines := runtime.NumGoroutine()
+
+	source := &countingBlockSource{release: make(chan struct{})}
+	iter := disjointBlockIterator(source, 20, 3)
+
+	finished := make(chan bool)
+	go func() {
+		finished <- iter.Next()
+	}()
+
+	// blocks with disjoint key ranges are still loaded concurrently
+	deadline := time.Now().Add(2 * time.Second)
+	for source.loadsInFlight() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(source.release)
+
+	if <-finished || iter.Err() != nil {
+		t.Errorf("Iterator over empty blocks returned a row or error: %v", iter.Err())
+	}
+
+	if source.maxInFlight < 2 || source.maxInFlight > 3 {
+		t.Errorf("Iterator had %d loads in flight instead of between 2 and 3", source.maxInFlight)
+	}
+
+	if source.loads != 20 {
+		t.Errorf("Iterator loaded %d blocks instead of 20", source.loads)
+	}
+
+	// the first block failing stops reading ahead
+	source = &countingBlockSource{failFilename: "block-0"}
+	iter = disjointBlockIterator(source, 20, 3)
+
+	if iter.Next() || iter.Err() == nil {
+		t.Errorf("Iterator did not report the failed load")
+	}
+	iter.Close()
+
+	if source.loads > 3 {
+		t.Errorf("Iterator loaded %d blocks after the first failed", source.loads)
+	}
+
+	// the loads read ahead, and those readBlock starts, finish once the
+	// iterator has finished
+	time.Sleep(50 * time.Millisecond)
+	if leaked := runtime.NumGoroutine() - goroutines; leaked > 0 {
+		t.Errorf("Iterator leaked %d goroutines", leaked)
+	}
+
+	log.Println("Finished TestBlockRowIteratorReadsAhead")
+}
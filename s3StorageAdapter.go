@@ -0,0 +1,458 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	goavro "github.com/linkedin/goavro/v2"
+	minio "github.com/minio/minio-go/v6"
+	"github.com/minio/minio-go/v6/pkg/credentials"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type S3StorageAdapter struct {
+	Endpoint        string // host[:port], eg. s3.amazonaws.com or localhost:9000 for MinIO
+	AccessKeyID     string
+	SecretAccessKey string
+	Bucket          string
+	Region          string
+	UseSSL          bool
+	PathStyle       bool // address buckets as endpoint/bucket rather than bucket.endpoint
+
+	Codec           *goavro.Codec
+	PartitionColumn string
+	PartitionSpec   *PartitionSpec // partitioning used by the BlockManager, defaults to identity on PartitionColumn
+	KeyColumn       string
+	IdentityColumns []string // rows sharing these column values are returned once by Query
+	CompressionName string
+	IcebergMetadata bool // maintain Iceberg table metadata under metadata/ in the bucket
+
+	Input          chan *Block
+	Retry          *RetryPolicy         // defaults to 5 attempts backing off from 1s, with no dead letter directory
+	Errors         chan error           // reports blocks that could not be written; must be read if set
+	Metrics        Metrics              // defaults to recording nothing
+	Logger         Logger               // defaults to slog.Default()
+	TracerProvider trace.TracerProvider // defaults to the global provider
+
+	table    *icebergTable
+	rewrites partitionLocks // serializes ReplaceBlocks per partition
+	client   *minio.Client
+	done     chan struct{}
+}
+
+func (ssa *S3StorageAdapter) logger() Logger {
+	return LoggerOrDefault(ssa.Logger)
+}
+
+func (ssa *S3StorageAdapter) metrics() metricsScope {
+	return metricsScope{metrics: ssa.Metrics, labels: MetricLabels{"adapter": "s3"}}
+}
+
+func (ssa *S3StorageAdapter) tracer() trace.Tracer {
+	return tracerFrom(ssa.TracerProvider)
+}
+
+func (ssa *S3StorageAdapter) uploadBlock(ctx context.Context, block *Block) (err error) {
+	_, span := ssa.tracer().Start(block.traceContext(ctx), "S3StorageAdapter.uploadBlock", blockSpanAttributes(block))
+	defer func() { endSpan(span, err) }()
+
+	objectFilePath, objectSize, err := ssa.writeBlockObject(ctx, block)
+
+	if err == nil {
+		ssa.metrics().addCounter(MetricBytesWritten, float64(objectSize))
+		span.SetAttributes(attribute.String(attributeBlock, path.Base(objectFilePath)), attribute.Int64(attributeBytes, objectSize))
+	}
+
+	if err == nil && ssa.table != nil {
+		err = ssa.table.appendBlock(ctx, block, objectFilePath, objectSize)
+	}
+
+	return err
+}
+
+// writeBlockObject uploads a block and its statistics, returning the block's
+// object path and size.
+func (ssa *S3StorageAdapter) writeBlockObject(ctx context.Context, block *Block) (objectFilePath string, objectSize int64, err error) {
+	ssa.logger().Debug("Uploading block", blockLogArgs(block)...)
+
+	avroBuffer := new(bytes.Buffer)
+
+	if err = writeBlockOCF(avroBuffer, block, ssa.Codec, ssa.CompressionName); err != nil {
+		return "", 0, err
+	}
+
+	objectFilePath = blockObjectPath(block.PartitionKey, block.KeyColumn, block.GetFilename())
+	objectSize = int64(avroBuffer.Len())
+
+	_, err = ssa.client.PutObjectWithContext(ctx, ssa.Bucket, objectFilePath, avroBuffer, objectSize, minio.PutObjectOptions{
+		ContentType: "avro/binary",
+	})
+
+	if err == nil {
+		err = ssa.uploadStatistics(ctx, block, objectFilePath)
+	}
+
+	if err == nil {
+		ssa.logger().Info("Uploaded block", append(blockLogArgs(block), "block", path.Base(objectFilePath))...)
+	}
+
+	return objectFilePath, objectSize, err
+}
+
+func (ssa *S3StorageAdapter) uploadStatistics(ctx context.Context, block *Block, objectFilePath string) (err error) {
+	if block.Statistics == nil {
+		return nil
+	}
+
+	statisticsBytes, err := block.Statistics.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return ssa.writeObject(ctx, statisticsFilename(objectFilePath), statisticsBytes)
+}
+
+func (ssa *S3StorageAdapter) readObject(ctx context.Context, objectPath string) (data []byte, err error) {
+	object, err := ssa.client.GetObjectWithContext(ctx, ssa.Bucket, objectPath, minio.GetObjectOptions{})
+	if err == nil {
+		defer object.Close()
+		data, err = ioutil.ReadAll(object)
+	}
+
+	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, errObjectNotFound
+	}
+
+	return data, err
+}
+
+func (ssa *S3StorageAdapter) writeObject(ctx context.Context, objectPath string, data []byte) (err error) {
+	_, err = ssa.client.PutObjectWithContext(ctx, ssa.Bucket, objectPath, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+
+	return err
+}
+
+// deleteObject removes an object. S3 reports success for keys that do not
+// exist, so it never returns errObjectNotFound.
+func (ssa *S3StorageAdapter) deleteObject(ctx context.Context, objectPath string) (err error) {
+	// minio-go only takes a ctx when removing objects in bulk
+	objectPaths := make(chan string, 1)
+	objectPaths <- objectPath
+	close(objectPaths)
+
+	for removeErr := range ssa.client.RemoveObjectsWithContext(ctx, ssa.Bucket, objectPaths) {
+		if err == nil {
+			err = removeErr.Err
+		}
+	}
+
+	return err
+}
+
+// listObjectKeys calls fn with the key of every object starting with prefix,
+// returning early with ctx's error if it ends first.
+func (ssa *S3StorageAdapter) listObjectKeys(ctx context.Context, prefix string, fn func(key string)) (err error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	// ListObjectsV2 follows continuation tokens for us, emitting each page's objects in turn.
+	objectInfos := ssa.client.ListObjectsV2(ssa.Bucket, prefix, true, doneCh)
+
+	for {
+		select {
+		case objectInfo, more := <-objectInfos:
+			if !more {
+				return nil
+			}
+
+			if objectInfo.Err != nil {
+				return objectInfo.Err
+			}
+
+			fn(objectInfo.Key)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (ssa *S3StorageAdapter) objectURI(objectPath string) string {
+	return fmt.Sprintf("s3://%s/%s", ssa.Bucket, objectPath)
+}
+
+func (ssa *S3StorageAdapter) buildObjectPath(partitionKey string, keyColumn string) string {
+	return fmt.Sprintf("%s/%s", partitionKey, keyColumn)
+}
+
+func (ssa *S3StorageAdapter) processBlocks(ctx context.Context, done chan struct{}) {
+	go func() {
+		defer close(done)
+
+		for {
+			var block *Block
+			var more bool
+
+			select {
+			case block, more = <-ssa.Input:
+			case <-ctx.Done():
+				ssa.logger().Info("S3StorageAdapter stopped taking blocks", "error", ctx.Err())
+				return
+			}
+
+			if !more {
+				return
+			}
+
+			if err := ssa.Retry.writeBlock(ctx, block, ssa.uploadBlock, ssa.metrics(), ssa.logger()); err != nil {
+				reportStorageError(ctx, ssa.logger(), ssa.Errors, err)
+			}
+		}
+	}()
+}
+
+func (ssa *S3StorageAdapter) Load(ctx context.Context, partitionKey string, blockFilename string, blocks chan *Block, errors chan error) {
+	ctx, span := startLoadSpan(ctx, ssa.tracer(), "S3StorageAdapter.Load", partitionKey, blockFilename)
+
+	objectPath := ssa.buildObjectPath(partitionKey, ssa.KeyColumn)
+	objectFilePath := fmt.Sprintf("%s/%s", objectPath, blockFilename)
+
+	object, err := ssa.client.GetObjectWithContext(ctx, ssa.Bucket, objectFilePath, minio.GetObjectOptions{})
+	if err != nil {
+		endSpan(span, err)
+		errors <- err
+		return
+	}
+	defer object.Close()
+
+	block := newLoadedBlock(partitionKey, ssa.KeyColumn, blockFilename, ssa.Codec, ssa.Logger)
+
+	rows := make(chan interface{})
+	readErrors := make(chan error, 1)
+	ReadOCFIntoChannel(object, rows, readErrors, ssa.logger())
+
+	for {
+		row, more := <-rows
+		if !more {
+			break
+		}
+		block.Rows = append(block.Rows, row)
+	}
+
+	select {
+	case err := <-readErrors:
+		endSpan(span, err)
+		errors <- err
+		return
+	default:
+	}
+
+	span.SetAttributes(attribute.Int(attributeRows, len(block.Rows)))
+	span.End()
+
+	blocks <- block
+}
+
+func (ssa *S3StorageAdapter) LoadStatistics(ctx context.Context, partitionKey string, blockFilename string) (statistics *BlockStatistics, err error) {
+	objectPath := ssa.buildObjectPath(partitionKey, ssa.KeyColumn)
+	objectFilePath := fmt.Sprintf("%s/%s", objectPath, statisticsFilename(blockFilename))
+
+	statisticsBytes, err := ssa.readObject(ctx, objectFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return UnmarshalBlockStatistics(statisticsBytes, ssa.Codec)
+}
+
+func (ssa *S3StorageAdapter) GetPartitionFileNames(ctx context.Context, partitionKey string) (partitionFileNames []string, err error) {
+	partitionFileNames = []string{}
+	partitionPath := ssa.buildObjectPath(partitionKey, ssa.KeyColumn) + "/"
+
+	err = ssa.listObjectKeys(ctx, partitionPath, func(key string) {
+		// partition keys may span several path segments, so take the name after the prefix
+		blockFilename := strings.TrimPrefix(key, partitionPath)
+		if !strings.Contains(blockFilename, "/") && isBlockFilename(blockFilename) {
+			partitionFileNames = append(partitionFileNames, blockFilename)
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return partitionFileNames, nil
+}
+
+// ListPartitions returns the partition keys in the bucket that start with
+// prefix, found from the paths of their block objects.
+func (ssa *S3StorageAdapter) ListPartitions(ctx context.Context, prefix string) (partitionKeys []string, err error) {
+	partitionKeys = []string{}
+	seen := make(map[string]bool)
+	keyColumnSegment := "/" + ssa.KeyColumn + "/"
+
+	err = ssa.listObjectKeys(ctx, prefix, func(key string) {
+		keyColumnIndex := strings.LastIndex(key, keyColumnSegment)
+		if keyColumnIndex <= 0 || !isBlockFilename(key[keyColumnIndex+len(keyColumnSegment):]) {
+			return
+		}
+
+		partitionKey := key[:keyColumnIndex]
+		if !seen[partitionKey] {
+			seen[partitionKey] = true
+			partitionKeys = append(partitionKeys, partitionKey)
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return partitionKeys, nil
+}
+
+func (ssa *S3StorageAdapter) lockPartition(partitionKey string) (unlock func()) {
+	return ssa.rewrites.lock(partitionKey)
+}
+
+func (ssa *S3StorageAdapter) ReplaceBlocks(ctx context.Context, partitionKey string, added []*Block, removedFilenames []string) (err error) {
+	return replaceBlocks(ctx, ssa, ssa.table, ssa.KeyColumn, partitionKey, added, removedFilenames)
+}
+
+func (ssa *S3StorageAdapter) Query(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}) (results []interface{}, err error) {
+	return ssa.QueryWithOptions(ctx, partitionKey, startKey, endKey, nil)
+}
+
+func (ssa *S3StorageAdapter) QueryWithOptions(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, options *QueryOptions) (results []interface{}, err error) {
+	iter, err := ssa.QueryIter(ctx, partitionKey, startKey, endKey, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return collectRows(iter)
+}
+
+func (ssa *S3StorageAdapter) QueryIter(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error) {
+	return ssa.QueryPartitionsIter(ctx, []string{partitionKey}, startKey, endKey, options)
+}
+
+func (ssa *S3StorageAdapter) QueryPartitionsIter(ctx context.Context, partitionKeys []string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error) {
+	ctx, span := startQuerySpan(ctx, ssa.tracer(), "S3StorageAdapter.Query", partitionKeys)
+
+	startKey, endKey, err = normalizeKeyRange(ssa.Codec, ssa.KeyColumn, startKey, endKey)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	return newBlockRowIterator(ctx, ssa, partitionKeys, startKey, endKey, options, ssa.IdentityColumns, ssa.metrics(), span)
+}
+
+func (ssa *S3StorageAdapter) QueryPrefixIter(ctx context.Context, prefix string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error) {
+	partitionKeys, err := ssa.ListPartitions(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssa.QueryPartitionsIter(ctx, partitionKeys, startKey, endKey, options)
+}
+
+func (ssa *S3StorageAdapter) Delete(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, predicates []Predicate) (removed int64, err error) {
+	startKey, endKey, err = normalizeKeyRange(ssa.Codec, ssa.KeyColumn, startKey, endKey)
+	if err != nil {
+		return 0, err
+	}
+
+	return deleteRows(ctx, ssa, ssa.logger(), ssa.KeyColumn, partitionKey, startKey, endKey, predicates)
+}
+
+func (ssa *S3StorageAdapter) SetInput(input chan *Block, errors chan error) {
+	ssa.Input = input
+	ssa.Errors = errors
+}
+
+func (ssa *S3StorageAdapter) Start(ctx context.Context) (err error) {
+	if len(ssa.Endpoint) == 0 {
+		return errors.New("S3StorageAdapter not correctly configured with Endpoint")
+	}
+
+	if len(ssa.AccessKeyID) == 0 {
+		return errors.New("S3StorageAdapter not correctly configured with AccessKeyID")
+	}
+
+	if len(ssa.SecretAccessKey) == 0 {
+		return errors.New("S3StorageAdapter not correctly configured with SecretAccessKey")
+	}
+
+	if len(ssa.Bucket) == 0 {
+		return errors.New("S3StorageAdapter not correctly configured with Bucket")
+	}
+
+	bucketLookup := minio.BucketLookupAuto
+	if ssa.PathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
+
+	ssa.client, err = minio.NewWithOptions(ssa.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(ssa.AccessKeyID, ssa.SecretAccessKey, ""),
+		Secure:       ssa.UseSSL,
+		Region:       ssa.Region,
+		BucketLookup: bucketLookup,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	exists, err := ssa.client.BucketExistsWithContext(ctx, ssa.Bucket)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		if err = ssa.client.MakeBucketWithContext(ctx, ssa.Bucket, ssa.Region); err != nil {
+			return err
+		}
+	}
+
+	if ssa.IcebergMetadata {
+		if ssa.table, err = newIcebergTable(ctx, ssa, ssa.Codec, resolvePartitionSpec(ssa.PartitionSpec, ssa.PartitionColumn)); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	ssa.done = done
+	ssa.processBlocks(ctx, done)
+
+	return nil
+}
+
+// Done is closed once the adapter has stopped taking blocks from Input.
+func (ssa *S3StorageAdapter) Done() <-chan struct{} {
+	return ssa.done
+}
+
+func (ssa *S3StorageAdapter) Stop(ctx context.Context) (err error) {
+	ssa.logger().Info("S3StorageAdapter stopping")
+
+	select {
+	case <-ssa.Done():
+	case <-ctx.Done():
+		return fmt.Errorf("S3StorageAdapter: input did not finish: %w", ctx.Err())
+	}
+
+	if len(ssa.Input) > 0 {
+		errorText := fmt.Sprintf("S3StorageAdapter: input did not finish, still has %d blocks remaining", len(ssa.Input))
+		return errors.New(errorText)
+	}
+
+	ssa.logger().Info("S3StorageAdapter stopped")
+
+	return nil
+}
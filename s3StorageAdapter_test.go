@@ -0,0 +1,508 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3Stub is an in-memory bucket serving the part of the S3 API the
+// S3StorageAdapter uses, listing at most pageSize objects per page so that
+// listings follow continuation tokens.
+type s3Stub struct {
+	bucket   string
+	pageSize int
+
+	mutex        sync.Mutex
+	objects      map[string][]byte
+	failPuts     map[string]bool // object keys whose uploads are refused
+	listRequests int
+}
+
+type s3StubListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []s3StubObject
+}
+
+type s3StubDelete struct {
+	XMLName xml.Name `xml:"Delete"`
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type s3StubObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+func newS3Stub(pageSize int) *s3Stub {
+	return &s3Stub{
+		bucket:   "test",
+		pageSize: pageSize,
+		objects:  make(map[string][]byte),
+		failPuts: make(map[string]bool),
+	}
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucketPath := "/" + s.bucket
+	if r.URL.Path != bucketPath && !strings.HasPrefix(r.URL.Path, bucketPath+"/") {
+		s.writeError(w, http.StatusNotFound, "NoSuchBucket", r.URL.Path)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, bucketPath), "/")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch {
+	case len(key) == 0 && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case len(key) == 0 && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		s.listObjects(w, r.URL.Query())
+	case len(key) == 0 && r.Method == http.MethodPost && r.URL.Query().Has("delete"):
+		s.deleteObjects(w, r)
+	case len(key) > 0 && r.Method == http.MethodPut:
+		s.putObject(w, r, key)
+	case len(key) > 0 && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		data, exists := s.objects[key]
+		if !exists {
+			s.writeError(w, http.StatusNotFound, "NoSuchKey", r.URL.Path)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("ETag", `"stub"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case len(key) > 0 && r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.writeError(w, http.StatusNotImplemented, "NotImplemented", r.URL.Path)
+	}
+}
+
+func (s *s3Stub) listObjects(w http.ResponseWriter, query url.Values) {
+	s.listRequests++
+
+	prefix := query.Get("prefix")
+	keys := []string{}
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// the continuation token is the index of the page's first key
+	start := 0
+	if token := query.Get("continuation-token"); len(token) > 0 {
+		start, _ = strconv.Atoi(token)
+	}
+
+	end := start + s.pageSize
+	if end > len(keys) {
+		end = len(keys)
+	}
+
+	result := s3StubListResult{
+		Name:              s.bucket,
+		Prefix:            prefix,
+		KeyCount:          end - start,
+		MaxKeys:           s.pageSize,
+		IsTruncated:       end < len(keys),
+		ContinuationToken: query.Get("continuation-token"),
+	}
+
+	if result.IsTruncated {
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+
+	for _, key := range keys[start:end] {
+		result.Contents = append(result.Contents, s3StubObject{
+			Key:          key,
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+			ETag:         `"stub"`,
+			Size:         int64(len(s.objects[key])),
+			StorageClass: "STANDARD",
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(result)
+}
+
+// deleteObjects removes the objects of a multi-object delete, which succeeds
+// for keys that do not exist as S3 does.
+func (s *s3Stub) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	var request s3StubDelete
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.writeError(w, http.StatusBadRequest, "MalformedXML", r.URL.Path)
+		return
+	}
+
+	for _, object := range request.Objects {
+		delete(s.objects, object.Key)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><DeleteResult></DeleteResult>`)
+}
+
+func (s *s3Stub) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil && r.Header.Get("X-Amz-Content-Sha256") == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		body, err = decodeAWSChunked(body)
+	}
+
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "IncompleteBody", r.URL.Path)
+		return
+	}
+
+	if s.failPuts[key] {
+		s.writeError(w, http.StatusForbidden, "AccessDenied", r.URL.Path)
+		return
+	}
+
+	s.objects[key] = body
+
+	w.Header().Set("ETag", `"stub"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *s3Stub) writeError(w http.ResponseWriter, status int, code string, resource string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message><Resource>%s</Resource><RequestId>stub</RequestId></Error>`, code, code, resource)
+}
+
+func (s *s3Stub) keys() (keys []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys = []string{}
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// decodeAWSChunked strips the chunk signatures that minio-go adds to uploads
+// sent over plain HTTP.
+func decodeAWSChunked(body []byte) (decoded []byte, err error) {
+	reader := bufio.NewReader(bytes.NewReader(body))
+
+	for {
+		chunkHeader, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		chunkSize, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(chunkHeader), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		if chunkSize == 0 {
+			return decoded, nil
+		}
+
+		// each chunk's data is followed by a CRLF
+		chunk := make([]byte, chunkSize+2)
+		if _, err = io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+
+		decoded = append(decoded, chunk[:chunkSize]...)
+	}
+}
+
+// startStubS3StorageAdapter starts an adapter against an httptest server
+// serving stub, returning the server for the caller to close.
+func startStubS3StorageAdapter(t *testing.T, stub *s3Stub) (s3StorageAdapter *S3StorageAdapter, server *httptest.Server) {
+	server = httptest.NewServer(stub)
+
+	s3StorageAdapter = &S3StorageAdapter{
+		Endpoint:        strings.TrimPrefix(server.URL, "http://"),
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		Bucket:          stub.bucket,
+		Region:          "us-east-1",
+		PathStyle:       true,
+
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		Codec:           GetCodecFixture(),
+
+		Input: make(chan *Block),
+	}
+
+	if err := s3StorageAdapter.Start(context.Background()); err != nil {
+		server.Close()
+		t.Fatalf("S3StorageAdapter failed to start: %s", err)
+	}
+
+	return s3StorageAdapter, server
+}
+
+func stubS3Block(partitionKey string, timestamp int64) *Block {
+	block := NewBlock(partitionKey, "timestamp", GetCodecFixture())
+	native := GetNativeFixture().(map[string]interface{})
+	native["timestamp"] = timestamp
+	block.Write(native)
+
+	return block
+}
+
+// skipWithoutS3 skips tests needing an S3 compatible server, eg. a local
+// MinIO, unless ICEBERG_S3_ENDPOINT names one.
+func skipWithoutS3(t *testing.T) {
+	if len(os.Getenv("ICEBERG_S3_ENDPOINT")) == 0 {
+		t.Skip("ICEBERG_S3_ENDPOINT not set")
+	}
+}
+
+func TestS3StorageAdapterWrite(t *testing.T) {
+	log.Println("Starting TestS3StorageAdapterWrite")
+	skipWithoutS3(t)
+
+	fixtureMap := GetFixtureMap()
+
+	input := make(chan *Block)
+
+	s3StorageAdapter := &S3StorageAdapter{
+		Endpoint:        os.Getenv("ICEBERG_S3_ENDPOINT"),
+		AccessKeyID:     os.Getenv("ICEBERG_S3_ACCESS_KEY"),
+		SecretAccessKey: os.Getenv("ICEBERG_S3_SECRET_KEY"),
+		Bucket:          "test",
+		PathStyle:       true,
+
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		CompressionName: "snappy",
+		Codec:           GetCodecFixture(),
+
+		Input: input,
+	}
+
+	if err := s3StorageAdapter.Start(context.Background()); err != nil {
+		t.Fatalf("S3StorageAdapter failed to start: %s", err)
+	}
+
+	block := NewBlock(fixtureMap["user_id"].(string), s3StorageAdapter.KeyColumn, s3StorageAdapter.Codec)
+	native := GetNativeFixture()
+
+	block.Write(native)
+
+	input <- block
+	close(input)
+
+	if err := s3StorageAdapter.Stop(context.Background()); err != nil {
+		t.Errorf("S3StorageAdapter failed to stop: %s", err)
+	}
+
+	log.Println("Finishing TestS3StorageAdapterWrite")
+}
+
+func TestS3StorageAdapterQuery(t *testing.T) {
+	log.Println("Starting TestS3StorageAdapterQuery")
+	skipWithoutS3(t)
+
+	fixtureMap := GetFixtureMap()
+	beforeTimestamp := fixtureMap["timestamp"].(int64) - 50
+	afterTimestamp := fixtureMap["timestamp"].(int64) + 50
+
+	input := make(chan *Block)
+
+	s3StorageAdapter := &S3StorageAdapter{
+		Endpoint:        os.Getenv("ICEBERG_S3_ENDPOINT"),
+		AccessKeyID:     os.Getenv("ICEBERG_S3_ACCESS_KEY"),
+		SecretAccessKey: os.Getenv("ICEBERG_S3_SECRET_KEY"),
+		Bucket:          "test",
+		PathStyle:       true,
+
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		CompressionName: "snappy",
+		Codec:           GetCodecFixture(),
+
+		Input: input,
+	}
+
+	err := s3StorageAdapter.Start(context.Background())
+	if err != nil {
+		t.Fatalf("S3StorageAdapter failed to start: %s", err)
+	}
+
+	results, err := s3StorageAdapter.Query(context.Background(), fixtureMap["user_id"].(string), beforeTimestamp, afterTimestamp)
+
+	if err != nil {
+		t.Errorf("S3StorageAdapter query failed with error: %s", err)
+	}
+
+	if len(results) != 1 {
+		t.Errorf("S3StorageAdapter query results list wrong length %d vs. 1", len(results))
+	}
+
+	log.Println("Finishing TestS3StorageAdapterQuery")
+}
+
+func TestS3StorageAdapterStubListing(t *testing.T) {
+	log.Println("Starting TestS3StorageAdapterStubListing")
+
+	stub := newS3Stub(3)
+	s3StorageAdapter, server := startStubS3StorageAdapter(t, stub)
+	defer server.Close()
+	defer close(s3StorageAdapter.Input)
+
+	ctx := context.Background()
+	partitionBlocks := map[string][]*Block{
+		"tenant=acme/userid1":  {stubS3Block("tenant=acme/userid1", 100), stubS3Block("tenant=acme/userid1", 200), stubS3Block("tenant=acme/userid1", 300), stubS3Block("tenant=acme/userid1", 400), stubS3Block("tenant=acme/userid1", 500)},
+		"tenant=acme/userid2":  {stubS3Block("tenant=acme/userid2", 100)},
+		"tenant=other/userid3": {stubS3Block("tenant=other/userid3", 100)},
+	}
+
+	for partitionKey, blocks := range partitionBlocks {
+		if err := s3StorageAdapter.ReplaceBlocks(ctx, partitionKey, blocks, nil); err != nil {
+			t.Fatalf("S3StorageAdapter failed to write blocks to %s: %s", partitionKey, err)
+		}
+	}
+
+	// five blocks and their statistics list over four pages of three
+	listRequests := stub.listRequests
+	partitionFileNames, err := s3StorageAdapter.GetPartitionFileNames(ctx, "tenant=acme/userid1")
+	if err != nil {
+		t.Fatalf("S3StorageAdapter failed to list partition: %s", err)
+	}
+
+	if len(partitionFileNames) != 5 {
+		t.Errorf("S3StorageAdapter listed wrong number of blocks: %d vs. 5: %v", len(partitionFileNames), partitionFileNames)
+	}
+
+	if pages := stub.listRequests - listRequests; pages != 4 {
+		t.Errorf("S3StorageAdapter listed wrong number of pages: %d vs. 4", pages)
+	}
+
+	partitionKeys, err := s3StorageAdapter.ListPartitions(ctx, "tenant=acme/")
+	if err != nil {
+		t.Fatalf("S3StorageAdapter failed to list partitions: %s", err)
+	}
+
+	sort.Strings(partitionKeys)
+	if expected := []string{"tenant=acme/userid1", "tenant=acme/userid2"}; !reflect.DeepEqual(partitionKeys, expected) {
+		t.Errorf("S3StorageAdapter listed wrong partitions: %v vs. %v", partitionKeys, expected)
+	}
+
+	if partitionKeys, err = s3StorageAdapter.ListPartitions(ctx, ""); err != nil || len(partitionKeys) != 3 {
+		t.Errorf("S3StorageAdapter listed wrong number of partitions without a prefix: %v, %v", partitionKeys, err)
+	}
+
+	if _, err = s3StorageAdapter.readObject(ctx, "tenant=acme/userid1/timestamp/missing.avro"); err != errObjectNotFound {
+		t.Errorf("S3StorageAdapter did not map NoSuchKey to errObjectNotFound: %v", err)
+	}
+
+	if _, err = s3StorageAdapter.LoadStatistics(ctx, "tenant=acme/userid1", "missing.avro"); err != errObjectNotFound {
+		t.Errorf("S3StorageAdapter did not report missing statistics as errObjectNotFound: %v", err)
+	}
+
+	results, err := s3StorageAdapter.Query(ctx, "tenant=acme/userid1", int64(0), int64(1000))
+	if err != nil {
+		t.Fatalf("S3StorageAdapter query failed with error: %s", err)
+	}
+
+	if len(results) != 5 {
+		t.Errorf("S3StorageAdapter query returned wrong number of rows: %d vs. 5", len(results))
+	}
+
+	log.Println("Finished TestS3StorageAdapterStubListing")
+}
+
+func TestS3StorageAdapterStubReplaceBlocksRollsBack(t *testing.T) {
+	log.Println("Starting TestS3StorageAdapterStubReplaceBlocksRollsBack")
+
+	stub := newS3Stub(1000)
+	s3StorageAdapter, server := startStubS3StorageAdapter(t, stub)
+	defer server.Close()
+	defer close(s3StorageAdapter.Input)
+
+	ctx := context.Background()
+	partitionKey := "userid1"
+
+	removed := stubS3Block(partitionKey, 100)
+	if err := s3StorageAdapter.ReplaceBlocks(ctx, partitionKey, []*Block{removed}, nil); err != nil {
+		t.Fatalf("S3StorageAdapter failed to write block: %s", err)
+	}
+	original := stub.keys()
+
+	// the second added block fails to upload, so the first is deleted again
+	added := []*Block{stubS3Block(partitionKey, 200), stubS3Block(partitionKey, 300)}
+	failingPath := blockObjectPath(partitionKey, "timestamp", added[1].GetFilename())
+
+	stub.mutex.Lock()
+	stub.failPuts[failingPath] = true
+	stub.mutex.Unlock()
+
+	if err := s3StorageAdapter.ReplaceBlocks(ctx, partitionKey, added, []string{removed.GetFilename()}); err == nil {
+		t.Errorf("S3StorageAdapter did not report the failed upload")
+	}
+
+	if keys := stub.keys(); !reflect.DeepEqual(keys, original) {
+		t.Errorf("S3StorageAdapter did not roll back the replacement: %v vs. %v", keys, original)
+	}
+
+	stub.mutex.Lock()
+	delete(stub.failPuts, failingPath)
+	stub.mutex.Unlock()
+
+	if err := s3StorageAdapter.ReplaceBlocks(ctx, partitionKey, added, []string{removed.GetFilename()}); err != nil {
+		t.Fatalf("S3StorageAdapter failed to replace blocks: %s", err)
+	}
+
+	partitionFileNames, err := s3StorageAdapter.GetPartitionFileNames(ctx, partitionKey)
+	sort.Strings(partitionFileNames)
+	expected := []string{added[0].GetFilename(), added[1].GetFilename()}
+	sort.Strings(expected)
+
+	if err != nil || !reflect.DeepEqual(partitionFileNames, expected) {
+		t.Errorf("S3StorageAdapter replaced blocks wrongly: %v vs. %v: %v", partitionFileNames, expected, err)
+	}
+
+	log.Println("Finished TestS3StorageAdapterStubReplaceBlocksRollsBack")
+}
@@ -0,0 +1,484 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	goavro "github.com/linkedin/goavro/v2"
+	core "github.com/timfpark/iceberg-core"
+)
+
+const (
+	jsonContentType   = "application/json"
+	ndjsonContentType = "application/x-ndjson"
+	avroContentType   = "avro/binary"
+
+	avroBatchSize = 100 // rows per OCF block when streaming Avro
+)
+
+// Server exposes a StorageAdapter's Query over HTTP:
+//
+//	GET /partitions/{partitionKey}/rows?start=&end=&limit=&columns=&order=
+//	GET /metrics, if Metrics is set
+//
+// Rows are returned as a JSON array in the codec's textual form, as NDJSON
+// for Accept: application/x-ndjson, or as an Avro OCF for Accept: avro/binary.
+// Partition keys spanning several levels have their slashes escaped as %2F.
+type Server struct {
+	Address   string // eg. ":8080"
+	Adapter   core.StorageAdapter
+	Codec     *goavro.Codec
+	KeyColumn string
+	Metrics   http.Handler // served at /metrics if set, eg. a core.PrometheusMetrics
+	Logger    core.Logger  // defaults to slog.Default()
+
+	httpServer *http.Server
+}
+
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &httpError{status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if httpErr, ok := err.(*httpError); ok {
+		status = httpErr.status
+	} else if errors.Is(err, core.ErrInvalidQuery) {
+		status = http.StatusBadRequest
+	}
+
+	errorBytes, _ := json.Marshal(map[string]string{"error": err.Error()})
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	w.Write(errorBytes)
+}
+
+func (s *Server) logger() core.Logger {
+	return core.LoggerOrDefault(s.Logger)
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/partitions/", s.handleRows)
+
+	if s.Metrics != nil {
+		mux.Handle("/metrics", s.Metrics)
+	}
+
+	return mux
+}
+
+// rowsPartitionKey extracts the partition key from /partitions/{key}/rows,
+// unescaping it only after the route has been matched so that escaped
+// slashes stay within the key.
+func rowsPartitionKey(r *http.Request) (partitionKey string, err error) {
+	escapedPath := r.URL.EscapedPath()
+	if !strings.HasPrefix(escapedPath, "/partitions/") || !strings.HasSuffix(escapedPath, "/rows") {
+		return "", &httpError{status: http.StatusNotFound, message: fmt.Sprintf("%s not found", escapedPath)}
+	}
+
+	escapedKey := strings.TrimSuffix(strings.TrimPrefix(escapedPath, "/partitions/"), "/rows")
+	if len(escapedKey) == 0 {
+		return "", &httpError{status: http.StatusNotFound, message: fmt.Sprintf("%s not found", escapedPath)}
+	}
+
+	partitionKey, err = url.PathUnescape(escapedKey)
+	if err != nil {
+		return "", badRequest("partition key %s is not escaped correctly", escapedKey)
+	}
+
+	if !validPartitionKey(partitionKey) {
+		return "", badRequest("partition key %s is not a partition", escapedKey)
+	}
+
+	return partitionKey, nil
+}
+
+// validPartitionKey reports whether a partition key only names levels below
+// the adapter's root, so that a key such as ../other cannot reach paths
+// outside a FilesystemStorageAdapter's BasePath.
+func validPartitionKey(partitionKey string) bool {
+	if strings.ContainsRune(partitionKey, '\\') || strings.HasPrefix(partitionKey, "/") {
+		return false
+	}
+
+	for _, level := range strings.Split(partitionKey, "/") {
+		if level == "." || level == ".." {
+			return false
+		}
+	}
+
+	return path.Clean(partitionKey) == partitionKey
+}
+
+func (s *Server) parseQuery(values url.Values) (startKey interface{}, endKey interface{}, options *core.QueryOptions, err error) {
+	keyType, err := core.KeyTypeFromCodec(s.Codec, s.KeyColumn)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, parameter := range []string{"start", "end"} {
+		if len(values.Get(parameter)) == 0 {
+			return nil, nil, nil, badRequest("%s is required", parameter)
+		}
+	}
+
+	if startKey, err = keyType.Parse(values.Get("start")); err != nil {
+		return nil, nil, nil, badRequest("start is not a valid key: %s", err)
+	}
+
+	if endKey, err = keyType.Parse(values.Get("end")); err != nil {
+		return nil, nil, nil, badRequest("end is not a valid key: %s", err)
+	}
+
+	options = &core.QueryOptions{}
+
+	if limit := values.Get("limit"); len(limit) > 0 {
+		if options.Limit, err = strconv.Atoi(limit); err != nil || options.Limit < 0 {
+			return nil, nil, nil, badRequest("limit must be a non-negative integer")
+		}
+	}
+
+	if columns := values.Get("columns"); len(columns) > 0 {
+		options.Columns = strings.Split(columns, ",")
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+		options.Order = core.Ascending
+	case "desc":
+		options.Order = core.Descending
+	default:
+		return nil, nil, nil, badRequest("order must be asc or desc")
+	}
+
+	return startKey, endKey, options, nil
+}
+
+// producedContentType maps a media range to the format that satisfies it, if
+// any, JSON satisfying wildcards.
+func producedContentType(mediaType string) string {
+	switch mediaType {
+	case jsonContentType, "application/*", "*/*":
+		return jsonContentType
+	case ndjsonContentType:
+		return ndjsonContentType
+	case avroContentType, "application/avro":
+		return avroContentType
+	}
+
+	return ""
+}
+
+// mediaRangeWeight returns the q weight among a media range's parameters,
+// which is 1 if it is missing or malformed.
+func mediaRangeWeight(parameters []string) float64 {
+	for _, parameter := range parameters {
+		nameValue := strings.SplitN(parameter, "=", 2)
+		if len(nameValue) != 2 || !strings.EqualFold(strings.TrimSpace(nameValue[0]), "q") {
+			continue
+		}
+
+		weight, err := strconv.ParseFloat(strings.TrimSpace(nameValue[1]), 64)
+		if err != nil || weight < 0 || weight > 1 {
+			return 1
+		}
+
+		return weight
+	}
+
+	return 1
+}
+
+// negotiateContentType picks the response format from the Accept header: the
+// acceptable one with the highest q weight, or the first listed among equal
+// weights. Media ranges weighted q=0 are never picked.
+func negotiateContentType(accept string) (contentType string, err error) {
+	if len(accept) == 0 {
+		return jsonContentType, nil
+	}
+
+	bestWeight := 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		parameters := strings.Split(mediaRange, ";")
+		candidate := producedContentType(strings.TrimSpace(parameters[0]))
+		weight := mediaRangeWeight(parameters[1:])
+
+		if len(candidate) > 0 && weight > bestWeight {
+			contentType, bestWeight = candidate, weight
+		}
+	}
+
+	if len(contentType) == 0 {
+		return "", &httpError{status: http.StatusNotAcceptable, message: fmt.Sprintf("none of %s can be produced", accept)}
+	}
+
+	return contentType, nil
+}
+
+// projectedCodec returns a codec for rows holding only columns, in schema order.
+func (s *Server) projectedCodec(columns []string) (codec *goavro.Codec, err error) {
+	if len(columns) == 0 {
+		return s.Codec, nil
+	}
+
+	var schema map[string]interface{}
+	if err = json.Unmarshal([]byte(s.Codec.Schema()), &schema); err != nil {
+		return nil, err
+	}
+
+	requested := make(map[string]bool)
+	for _, column := range columns {
+		requested[column] = true
+	}
+
+	fields, _ := schema["fields"].([]interface{})
+	projectedFields := []interface{}{}
+	for _, field := range fields {
+		if name, _ := field.(map[string]interface{})["name"].(string); requested[name] {
+			projectedFields = append(projectedFields, field)
+			delete(requested, name)
+		}
+	}
+
+	for _, column := range columns {
+		if requested[column] {
+			return nil, badRequest("column %s is not in the schema", column)
+		}
+	}
+
+	schema["fields"] = projectedFields
+
+	projectedSchema, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return goavro.NewCodec(string(projectedSchema))
+}
+
+func (s *Server) handleRows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, &httpError{status: http.StatusMethodNotAllowed, message: fmt.Sprintf("%s not allowed", r.Method)})
+		return
+	}
+
+	partitionKey, err := rowsPartitionKey(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	contentType, err := negotiateContentType(r.Header.Get("Accept"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	startKey, endKey, options, err := s.parseQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	codec, err := s.projectedCodec(options.Columns)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	adapterIter, err := s.Adapter.QueryIter(r.Context(), partitionKey, startKey, endKey, options)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer adapterIter.Close()
+
+	// reading the first row before responding lets errors loading the first
+	// blocks be reported with a status; later errors can only be logged and
+	// the response cut short
+	iter := &peekedIterator{RowIterator: adapterIter}
+	if !iter.peek() && iter.Err() != nil {
+		writeError(w, iter.Err())
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+
+	switch contentType {
+	case ndjsonContentType:
+		err = writeNDJSON(w, iter, codec)
+	case avroContentType:
+		err = writeAvro(w, iter, codec)
+	default:
+		err = writeJSON(w, iter, codec)
+	}
+
+	if err != nil {
+		s.logger().Error("Query failed", "partition_key", partitionKey, "error", err)
+	}
+}
+
+// peekedIterator allows the first row to be read ahead of iteration.
+type peekedIterator struct {
+	core.RowIterator
+	peeked bool
+	hasRow bool
+}
+
+func (p *peekedIterator) peek() bool {
+	p.peeked = true
+	p.hasRow = p.RowIterator.Next()
+
+	return p.hasRow
+}
+
+func (p *peekedIterator) Next() bool {
+	if p.peeked {
+		p.peeked = false
+		return p.hasRow
+	}
+
+	return p.RowIterator.Next()
+}
+
+func flush(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, iter core.RowIterator, codec *goavro.Codec) (err error) {
+	w.Write([]byte("["))
+
+	for rowCount := 0; iter.Next(); rowCount++ {
+		textual, err := codec.TextualFromNative(nil, iter.Row())
+		if err != nil {
+			return err
+		}
+
+		if rowCount > 0 {
+			w.Write([]byte(","))
+		}
+
+		if _, err = w.Write(textual); err != nil {
+			return err
+		}
+	}
+
+	if err = iter.Err(); err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte("]"))
+	return err
+}
+
+func writeNDJSON(w http.ResponseWriter, iter core.RowIterator, codec *goavro.Codec) (err error) {
+	for iter.Next() {
+		textual, err := codec.TextualFromNative(nil, iter.Row())
+		if err != nil {
+			return err
+		}
+
+		if _, err = w.Write(append(textual, '\n')); err != nil {
+			return err
+		}
+
+		flush(w)
+	}
+
+	return iter.Err()
+}
+
+func writeAvro(w http.ResponseWriter, iter core.RowIterator, codec *goavro.Codec) (err error) {
+	ocfWriter, err := goavro.NewOCFWriter(goavro.OCFConfig{
+		W:      w,
+		Schema: codec.Schema(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	batch := make([]interface{}, 0, avroBatchSize)
+	for iter.Next() {
+		batch = append(batch, iter.Row())
+
+		if len(batch) == avroBatchSize {
+			if err = ocfWriter.Append(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+			flush(w)
+		}
+	}
+
+	if err = iter.Err(); err != nil {
+		return err
+	}
+
+	if len(batch) > 0 {
+		return ocfWriter.Append(batch)
+	}
+
+	return nil
+}
+
+func (s *Server) Start() (err error) {
+	if s.Adapter == nil {
+		return errors.New("Server not correctly configured with Adapter")
+	}
+
+	if _, err = core.KeyTypeFromCodec(s.Codec, s.KeyColumn); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return err
+	}
+
+	s.httpServer = &http.Server{Handler: s.Handler()}
+
+	go func() {
+		s.logger().Info("Server listening", "address", listener.Addr().String())
+
+		if err := s.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger().Error("Server failed", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops accepting connections and waits for in-flight requests to finish
+// until ctx ends.
+func (s *Server) Stop(ctx context.Context) (err error) {
+	s.logger().Info("Stopping Server")
+
+	if s.httpServer == nil {
+		return nil
+	}
+
+	return s.httpServer.Shutdown(ctx)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	core "github.com/timfpark/iceberg-core"
+)
+
+func TestServerRows(t *testing.T) {
+	log.Println("Starting TestServerRows")
+
+	basePath := "./test/data"
+	os.RemoveAll(basePath)
+	defer os.RemoveAll("./test")
+
+	// a partition key spanning two levels
+	partitionKey := "tenant=acme/userid1"
+	input := make(chan *core.Block)
+
+	adapter := &core.FilesystemStorageAdapter{
+		BasePath:        basePath,
+		Codec:           core.GetCodecFixture(),
+		PartitionColumn: "user_id",
+		KeyColumn:       "timestamp",
+		Input:           input,
+	}
+
+	if err := adapter.Start(context.Background()); err != nil {
+		t.Errorf("adapter failed to start: %s", err)
+	}
+
+	block := core.NewBlock(partitionKey, adapter.KeyColumn, adapter.Codec)
+	block.Write(core.GetNativeFixture())
+
+	input <- block
+	close(input)
+
+	adapter.Stop(context.Background())
+
+	server := &Server{
+		Adapter:   adapter,
+		Codec:     adapter.Codec,
+		KeyColumn: adapter.KeyColumn,
+	}
+
+	handler := server.Handler()
+
+	cases := []struct {
+		path           string
+		accept         string
+		expectedStatus int
+		expectedType   string
+	}{
+		{"/partitions/tenant=acme%2Fuserid1/rows?start=0&end=200000", "", http.StatusOK, jsonContentType},
+		{"/partitions/tenant=acme%2Fuserid1/rows?start=0&end=200000&columns=timestamp", ndjsonContentType, http.StatusOK, ndjsonContentType},
+		{"/partitions/tenant=acme%2Fuserid1/rows?start=0&end=200000", avroContentType, http.StatusOK, avroContentType},
+		{"/partitions/tenant=acme%2Fuserid1/rows?start=0", "", http.StatusBadRequest, jsonContentType},
+		{"/partitions/tenant=acme%2Fuserid1/rows?start=0&end=200000&columns=missing", "", http.StatusBadRequest, jsonContentType},
+		{"/partitions/tenant=acme%2Fuserid1/rows?start=0&end=200000", "text/csv", http.StatusNotAcceptable, jsonContentType},
+		{"/partitions/tenant=acme%2Fuserid1", "", http.StatusNotFound, jsonContentType},
+		{"/partitions/..%2F..%2Fsomewhere/rows?start=0&end=200000", "", http.StatusBadRequest, jsonContentType},
+		{"/partitions/tenant=acme%2F..%2Fuserid1/rows?start=0&end=200000", "", http.StatusBadRequest, jsonContentType},
+		{"/partitions/tenant=acme%5Cuserid1/rows?start=0&end=200000", "", http.StatusBadRequest, jsonContentType},
+		{"/partitions/%2Fetc/rows?start=0&end=200000", "", http.StatusBadRequest, jsonContentType},
+	}
+
+	for _, c := range cases {
+		request := httptest.NewRequest(http.MethodGet, c.path, nil)
+		if len(c.accept) > 0 {
+			request.Header.Set("Accept", c.accept)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != c.expectedStatus {
+			t.Errorf("%s returned wrong status: %d vs. %d: %s", c.path, recorder.Code, c.expectedStatus, recorder.Body.String())
+		}
+
+		if contentType := recorder.Header().Get("Content-Type"); contentType != c.expectedType {
+			t.Errorf("%s returned wrong content type: %s vs. %s", c.path, contentType, c.expectedType)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/partitions/tenant=acme%2Fuserid1/rows?start=0&end=200000&columns=timestamp", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if body := recorder.Body.String(); !strings.HasPrefix(body, `[{"timestamp":100000}`) {
+		t.Errorf("query returned wrong body: %s", body)
+	}
+
+	log.Println("Finished TestServerRows")
+}
+
+// invalidQueryAdapter rejects every query the way an adapter rejects a key or
+// predicate it cannot apply.
+type invalidQueryAdapter struct {
+	core.StorageAdapter
+}
+
+func (iqa *invalidQueryAdapter) QueryIter(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, options *core.QueryOptions) (core.RowIterator, error) {
+	return nil, fmt.Errorf("%w: start key: Normalize: string is not an integer key", core.ErrInvalidQuery)
+}
+
+func TestServerInvalidQuery(t *testing.T) {
+	log.Println("Starting TestServerInvalidQuery")
+
+	server := &Server{
+		Adapter:   &invalidQueryAdapter{},
+		Codec:     core.GetCodecFixture(),
+		KeyColumn: "timestamp",
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/partitions/userid1/rows?start=0&end=200000", nil)
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("invalid query returned wrong status: %d vs. %d: %s", recorder.Code, http.StatusBadRequest, recorder.Body.String())
+	}
+
+	log.Println("Finished TestServerInvalidQuery")
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	log.Println("Starting TestNegotiateContentType")
+
+	cases := []struct {
+		accept       string
+		expectedType string
+	}{
+		{"", jsonContentType},
+		{"*/*", jsonContentType},
+		{"avro/binary, application/json", avroContentType},
+		{"application/json;q=0.5, application/x-ndjson", ndjsonContentType},
+		{"text/html, application/x-ndjson;q=0.2, avro/binary;q=0.8", avroContentType},
+		{"avro/binary;q=0, */*;q=0.1", jsonContentType},
+		{"application/json; charset=utf-8; q=0.9, avro/binary; q=0.9", jsonContentType},
+		{"application/json;q=0", ""},
+	}
+
+	for _, c := range cases {
+		contentType, err := negotiateContentType(c.accept)
+		if contentType != c.expectedType {
+			t.Errorf("negotiateContentType picked wrong type for %q: %q vs. %q", c.accept, contentType, c.expectedType)
+		}
+
+		if len(c.expectedType) == 0 && err == nil {
+			t.Errorf("negotiateContentType accepted %q", c.accept)
+		}
+	}
+
+	log.Println("Finished TestNegotiateContentType")
+}
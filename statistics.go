@@ -0,0 +1,290 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	goavro "github.com/linkedin/goavro/v2"
+)
+
+const statisticsFileSuffix = ".stats.json"
+
+// ColumnStatistics bounds a column's values. A column holding NaN or an
+// infinity, which JSON cannot encode, has unknown bounds.
+type ColumnStatistics struct {
+	Min           interface{} `json:"min"`
+	Max           interface{} `json:"max"`
+	BoundsUnknown bool        `json:"boundsUnknown,omitempty"`
+	NullCount     int64       `json:"nullCount"`
+	ValueCount    int64       `json:"valueCount"`
+}
+
+// BlockStatistics summarizes every primitive column of a block so that queries
+// can skip blocks that cannot contain a matching row without reading them.
+type BlockStatistics struct {
+	RowCount int64                        `json:"rowCount"`
+	Columns  map[string]*ColumnStatistics `json:"columns"`
+}
+
+func NewBlockStatistics() *BlockStatistics {
+	return &BlockStatistics{
+		Columns: make(map[string]*ColumnStatistics),
+	}
+}
+
+func isPrimitiveValue(value interface{}) bool {
+	switch value.(type) {
+	case nil, bool, int32, int64, float32, float64, string, time.Time:
+		return true
+	}
+
+	return false
+}
+
+func isFiniteValue(value interface{}) bool {
+	switch t := value.(type) {
+	case float32:
+		return !math.IsNaN(float64(t)) && !math.IsInf(float64(t), 0)
+	case float64:
+		return !math.IsNaN(t) && !math.IsInf(t, 0)
+	}
+
+	return true
+}
+
+func (bs *BlockStatistics) Update(row interface{}) {
+	rowMap, ok := row.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	bs.RowCount++
+
+	for column, columnValue := range rowMap {
+		value := unwrapUnion(columnValue)
+		if !isPrimitiveValue(value) {
+			continue
+		}
+
+		columnStatistics, exists := bs.Columns[column]
+		if !exists {
+			columnStatistics = &ColumnStatistics{}
+			bs.Columns[column] = columnStatistics
+		}
+
+		if value == nil {
+			columnStatistics.NullCount++
+			continue
+		}
+
+		columnStatistics.ValueCount++
+
+		if columnStatistics.BoundsUnknown {
+			continue
+		}
+
+		if !isFiniteValue(value) {
+			columnStatistics.BoundsUnknown = true
+			columnStatistics.Min = nil
+			columnStatistics.Max = nil
+			continue
+		}
+
+		if comparison, ok := compareValues(value, columnStatistics.Min); columnStatistics.Min == nil || (ok && comparison < 0) {
+			columnStatistics.Min = value
+		}
+
+		if comparison, ok := compareValues(value, columnStatistics.Max); columnStatistics.Max == nil || (ok && comparison > 0) {
+			columnStatistics.Max = value
+		}
+	}
+}
+
+// MightMatch reports whether a row matching the predicate could exist in the
+// block. It only returns false when the statistics prove no row can match.
+func (bs *BlockStatistics) MightMatch(predicate *Predicate) bool {
+	columnStatistics, exists := bs.Columns[predicate.Column]
+	if !exists {
+		return true
+	}
+
+	switch predicate.Operator {
+	case IsNull:
+		return columnStatistics.NullCount > 0
+	case IsNotNull:
+		return columnStatistics.ValueCount > 0
+	}
+
+	// comparisons never match nulls, so a column of only nulls cannot match
+	if columnStatistics.ValueCount == 0 {
+		return false
+	}
+
+	if columnStatistics.BoundsUnknown {
+		return true
+	}
+
+	minComparison, minOk := compareValues(columnStatistics.Min, predicate.Value)
+	maxComparison, maxOk := compareValues(columnStatistics.Max, predicate.Value)
+
+	switch predicate.Operator {
+	case Equal:
+		return !minOk || !maxOk || (minComparison <= 0 && maxComparison >= 0)
+	case NotEqual:
+		return !minOk || !maxOk || minComparison != 0 || maxComparison != 0
+	case LessThan:
+		return !minOk || minComparison < 0
+	case LessThanOrEqual:
+		return !minOk || minComparison <= 0
+	case GreaterThan:
+		return !maxOk || maxComparison > 0
+	case GreaterThanOrEqual:
+		return !maxOk || maxComparison >= 0
+	case In:
+		for _, candidate := range predicate.Values {
+			minComparison, minOk := compareValues(columnStatistics.Min, candidate)
+			maxComparison, maxOk := compareValues(columnStatistics.Max, candidate)
+			if !minOk || !maxOk || (minComparison <= 0 && maxComparison >= 0) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func (bs *BlockStatistics) MightMatchAll(predicates []Predicate) bool {
+	for i := range predicates {
+		if !bs.MightMatch(&predicates[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (bs *BlockStatistics) Marshal() ([]byte, error) {
+	return json.Marshal(bs)
+}
+
+// UnmarshalBlockStatistics decodes statistics written by Marshal, restoring
+// integral bounds as int64 rather than float64, and the bounds of codec's
+// timestamp and date columns, which are marshalled as text, as time.Time.
+func UnmarshalBlockStatistics(data []byte, codec *goavro.Codec) (statistics *BlockStatistics, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	statistics = NewBlockStatistics()
+	if err = decoder.Decode(statistics); err != nil {
+		return nil, err
+	}
+
+	timeColumns := timeColumnsFromCodec(codec)
+
+	for column, columnStatistics := range statistics.Columns {
+		if timeColumns[column] {
+			columnStatistics.Min = fromJSONTime(columnStatistics.Min)
+			columnStatistics.Max = fromJSONTime(columnStatistics.Max)
+			continue
+		}
+
+		columnStatistics.Min = fromJSONNumber(columnStatistics.Min)
+		columnStatistics.Max = fromJSONNumber(columnStatistics.Max)
+	}
+
+	return statistics, nil
+}
+
+var timeColumnsCache sync.Map // *goavro.Codec -> map[string]bool
+
+// timeColumnsFromCodec names the top level columns of the codec's schema that
+// are decoded as time.Time, whether or not they are nullable.
+func timeColumnsFromCodec(codec *goavro.Codec) map[string]bool {
+	timeColumns := make(map[string]bool)
+	if codec == nil {
+		return timeColumns
+	}
+
+	if cached, ok := timeColumnsCache.Load(codec); ok {
+		return cached.(map[string]bool)
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(codec.Schema()), &schema); err != nil {
+		return timeColumns
+	}
+
+	isTimeType := func(avroType interface{}) bool {
+		typeMap, ok := avroType.(map[string]interface{})
+		if !ok {
+			return false
+		}
+
+		switch typeMap["logicalType"] {
+		case "timestamp-millis", "timestamp-micros", "date":
+			return true
+		}
+		return false
+	}
+
+	fields, _ := schema["fields"].([]interface{})
+	for _, field := range fields {
+		fieldMap, ok := field.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		name, _ := fieldMap["name"].(string)
+		branches, isUnion := fieldMap["type"].([]interface{})
+		if !isUnion {
+			branches = []interface{}{fieldMap["type"]}
+		}
+
+		for _, branch := range branches {
+			if isTimeType(branch) {
+				timeColumns[name] = true
+			}
+		}
+	}
+
+	timeColumnsCache.Store(codec, timeColumns)
+	return timeColumns
+}
+
+func fromJSONTime(value interface{}) interface{} {
+	text, ok := value.(string)
+	if !ok {
+		return value
+	}
+
+	if timeValue, err := time.Parse(time.RFC3339Nano, text); err == nil {
+		return timeValue
+	}
+
+	return value
+}
+
+func fromJSONNumber(value interface{}) interface{} {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+
+	if intValue, err := number.Int64(); err == nil {
+		return intValue
+	}
+
+	if floatValue, err := number.Float64(); err == nil {
+		return floatValue
+	}
+
+	return value
+}
+
+func statisticsFilename(blockFilename string) string {
+	return blockFilename + statisticsFileSuffix
+}
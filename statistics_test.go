@@ -0,0 +1,170 @@
+package core
+
+import (
+	"log"
+	"math"
+	"testing"
+	"time"
+
+	goavro "github.com/linkedin/goavro/v2"
+)
+
+func TestBlockStatistics(t *testing.T) {
+	log.Println("Starting TestBlockStatistics")
+
+	block := NewBlock("userid1", "timestamp", GetCodecFixture())
+
+	for _, timestamp := range []int64{300, 100, 200} {
+		native := GetNativeFixture().(map[string]interface{})
+		native["timestamp"] = timestamp
+		block.Write(native)
+	}
+
+	if block.Statistics.RowCount != 3 {
+		t.Errorf("Statistics row count incorrect: %d vs. 3", block.Statistics.RowCount)
+	}
+
+	timestampStatistics := block.Statistics.Columns["timestamp"]
+	if timestampStatistics.Min.(int64) != 100 || timestampStatistics.Max.(int64) != 300 {
+		t.Errorf("Statistics timestamp bounds incorrect: %+v", timestampStatistics)
+	}
+
+	if block.Statistics.Columns["accuracy"].NullCount != 3 {
+		t.Errorf("Statistics accuracy null count incorrect: %d vs. 3", block.Statistics.Columns["accuracy"].NullCount)
+	}
+
+	if _, exists := block.Statistics.Columns["features"]; exists {
+		t.Errorf("Statistics should not be collected for array column features")
+	}
+
+	statisticsBytes, err := block.Statistics.Marshal()
+	if err != nil {
+		t.Fatalf("Statistics failed to marshal: %s", err)
+	}
+
+	statistics, err := UnmarshalBlockStatistics(statisticsBytes, block.Codec)
+	if err != nil {
+		t.Fatalf("Statistics failed to unmarshal: %s", err)
+	}
+
+	if statistics.Columns["timestamp"].Max.(int64) != 300 {
+		t.Errorf("Statistics timestamp max did not round trip: %+v", statistics.Columns["timestamp"].Max)
+	}
+
+	cases := []struct {
+		predicate  Predicate
+		mightMatch bool
+	}{
+		{Predicate{Column: "timestamp", Operator: Equal, Value: int64(200)}, true},
+		{Predicate{Column: "timestamp", Operator: GreaterThan, Value: int64(300)}, false},
+		{Predicate{Column: "timestamp", Operator: LessThan, Value: int64(100)}, false},
+		{Predicate{Column: "latitude", Operator: In, Values: []interface{}{10.0, 37.0}}, true},
+		{Predicate{Column: "accuracy", Operator: IsNull}, true},
+		{Predicate{Column: "accuracy", Operator: IsNotNull}, false},
+		{Predicate{Column: "accuracy", Operator: LessThan, Value: 10.0}, false},
+	}
+
+	for _, c := range cases {
+		if statistics.MightMatch(&c.predicate) != c.mightMatch {
+			t.Errorf("Statistics MightMatch for %+v should be %t", c.predicate, c.mightMatch)
+		}
+	}
+
+	log.Println("Finished TestBlockStatistics")
+}
+
+func TestBlockStatisticsTimestampPruning(t *testing.T) {
+	log.Println("Starting TestBlockStatisticsTimestampPruning")
+
+	codec, err := goavro.NewCodec(`{
+		"type": "record",
+		"name": "event",
+		"fields": [
+			{ "name": "occurred", "type": ["null", { "type": "long", "logicalType": "timestamp-millis" }] }
+		]
+	}`)
+	if err != nil {
+		t.Fatalf("NewCodec failed with error: %s", err)
+	}
+
+	start := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	statistics := NewBlockStatistics()
+	for hour := 0; hour < 3; hour++ {
+		statistics.Update(map[string]interface{}{"occurred": start.Add(time.Duration(hour) * time.Hour)})
+	}
+
+	statisticsBytes, err := statistics.Marshal()
+	if err != nil {
+		t.Fatalf("Statistics failed to marshal: %s", err)
+	}
+
+	unmarshalled, err := UnmarshalBlockStatistics(statisticsBytes, codec)
+	if err != nil {
+		t.Fatalf("Statistics failed to unmarshal: %s", err)
+	}
+
+	if maxTime, ok := unmarshalled.Columns["occurred"].Max.(time.Time); !ok || !maxTime.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("Statistics timestamp max did not round trip as a time: %#v", unmarshalled.Columns["occurred"].Max)
+	}
+
+	cases := []struct {
+		predicates []Predicate
+		mightMatch bool
+	}{
+		{[]Predicate{
+			{Column: "occurred", Operator: GreaterThanOrEqual, Value: start.Add(time.Hour)},
+			{Column: "occurred", Operator: LessThan, Value: start.Add(90 * time.Minute)},
+		}, true},
+		{[]Predicate{
+			{Column: "occurred", Operator: GreaterThanOrEqual, Value: start.Add(3 * time.Hour)},
+			{Column: "occurred", Operator: LessThan, Value: start.Add(4 * time.Hour)},
+		}, false},
+		{[]Predicate{
+			{Column: "occurred", Operator: LessThan, Value: start},
+		}, false},
+	}
+
+	for _, c := range cases {
+		if unmarshalled.MightMatchAll(c.predicates) != c.mightMatch {
+			t.Errorf("Statistics MightMatchAll for %+v should be %t", c.predicates, c.mightMatch)
+		}
+	}
+
+	log.Println("Finished TestBlockStatisticsTimestampPruning")
+}
+
+func TestBlockStatisticsNonFiniteBounds(t *testing.T) {
+	log.Println("Starting TestBlockStatisticsNonFiniteBounds")
+
+	statistics := NewBlockStatistics()
+	for _, latitude := range []float64{10.0, math.NaN(), math.Inf(1), 20.0} {
+		statistics.Update(map[string]interface{}{"latitude": latitude})
+	}
+
+	statisticsBytes, err := statistics.Marshal()
+	if err != nil {
+		t.Fatalf("Statistics with non-finite values failed to marshal: %s", err)
+	}
+
+	unmarshalled, err := UnmarshalBlockStatistics(statisticsBytes, nil)
+	if err != nil {
+		t.Fatalf("Statistics failed to unmarshal: %s", err)
+	}
+
+	latitudeStatistics := unmarshalled.Columns["latitude"]
+	if !latitudeStatistics.BoundsUnknown || latitudeStatistics.Min != nil || latitudeStatistics.Max != nil {
+		t.Errorf("Statistics kept bounds for a column holding NaN: %+v", latitudeStatistics)
+	}
+
+	if latitudeStatistics.ValueCount != 4 {
+		t.Errorf("Statistics latitude value count incorrect: %d vs. 4", latitudeStatistics.ValueCount)
+	}
+
+	// without bounds the block can never be skipped on a comparison
+	if !unmarshalled.MightMatch(&Predicate{Column: "latitude", Operator: GreaterThan, Value: 100.0}) {
+		t.Errorf("Statistics with unknown bounds ruled out a block")
+	}
+
+	log.Println("Finished TestBlockStatisticsNonFiniteBounds")
+}
@@ -1,8 +1,54 @@
 package core
 
+import (
+	"context"
+	"errors"
+)
+
+// ErrInvalidQuery is wrapped by the errors of queries and deletes given keys
+// or predicates they cannot use, as opposed to ones failing in storage.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// StorageAdapter writes the blocks it receives on its input and queries them.
+//
+// Start's ctx scopes the adapter's lifetime: cancelling it abandons writes in
+// progress and stops the adapter taking blocks from its input. Queries and
+// deletes take their own ctx, bounding the blocks they read.
 type StorageAdapter interface {
-	Query(partitionKey string, startKey interface{}, endKey interface{}) (results []interface{}, err error)
+	Query(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}) (results []interface{}, err error)
+	QueryWithOptions(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, options *QueryOptions) (results []interface{}, err error)
+	QueryIter(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error)
+
+	// QueryPartitionsIter merges several partitions into one key ordered
+	// result, eg. every partition PartitionSpec.PartitionKeys returns.
+	QueryPartitionsIter(ctx context.Context, partitionKeys []string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error)
+
+	// QueryPrefixIter merges every partition whose key starts with prefix, or
+	// every partition if prefix is empty, eg. all users in a time window.
+	QueryPrefixIter(ctx context.Context, prefix string, startKey interface{}, endKey interface{}, options *QueryOptions) (iter RowIterator, err error)
+
+	// ListPartitions returns the keys of the partitions holding blocks that
+	// start with prefix, or of every partition if prefix is empty.
+	ListPartitions(ctx context.Context, prefix string) (partitionKeys []string, err error)
+
+	// Delete removes the rows of a partition in [startKey, endKey] matching
+	// every predicate, or all of them if there are none, by rewriting the
+	// blocks that hold them. It reports the number of rows removed. It fails,
+	// and may be retried, if a Compactor or RetentionManager rewrote one of
+	// those blocks first.
+	Delete(ctx context.Context, partitionKey string, startKey interface{}, endKey interface{}, predicates []Predicate) (removed int64, err error)
+
+	// SetInput connects the adapter to the channel of blocks it writes and to
+	// the channel it reports a BlockWriteError on for each block it gives up
+	// writing, which may be nil.
+	SetInput(input chan *Block, errors chan error)
+
+	Start(ctx context.Context) (err error)
+
+	// Stop waits for the input to be closed and every block on it written, or
+	// for ctx to end, in which case it returns ctx's error.
+	Stop(ctx context.Context) (err error)
 
-	Start() (err error)
-	Stop() (err error)
+	// Done is closed once the adapter has stopped taking blocks from its input.
+	Done() <-chan struct{}
 }
@@ -1,39 +1,75 @@
 package core
 
 import (
+	"context"
 	"io"
-	"log"
 
-	goavro "gopkg.in/linkedin/goavro.v2"
+	goavro "github.com/linkedin/goavro/v2"
 )
 
 type StreamAdapter interface {
-	Start() (err error)
-	Stop() (err error)
+	// SetOutput connects the adapter to the channel it emits rows on, which it
+	// closes once it has no more rows, and the channel it reports errors on.
+	SetOutput(output chan interface{}, errors chan error)
+
+	// Start begins emitting rows until the source is exhausted, Stop is
+	// called or ctx is cancelled. A StreamAdapter that fails to start emits
+	// nothing and leaves its output open.
+	Start(ctx context.Context) (err error)
+
+	// Stop ends emitting rows and releases the adapter's resources, waiting
+	// no longer than ctx allows.
+	Stop(ctx context.Context) (err error)
+
+	// Done is closed once the adapter has closed its output.
+	Done() <-chan struct{}
+}
+
+// TrackedRow can be emitted by a StreamAdapter in place of a bare row to learn
+// when the row has been durably written: the BlockManager calls OnDurable
+// once the storage adapter has written the block holding it. Context carries
+// the trace context the row arrived with, which the span committing its block
+// links to.
+type TrackedRow struct {
+	Row       interface{}
+	OnDurable func()
+	Context   context.Context
 }
 
-func ReadOCFIntoChannel(reader io.Reader, output chan interface{}, errors chan error) {
+// ReadOCFIntoChannel decodes the rows of an Avro OCF onto output, closing it
+// at the end of the file or after the first error, which is sent to errors.
+// A nil logger logs to slog.Default().
+func ReadOCFIntoChannel(reader io.Reader, output chan interface{}, errors chan error, logger Logger) {
+	logger = LoggerOrDefault(logger)
+
 	ocf, err := goavro.NewOCFReader(reader)
 	if err != nil {
-		log.Printf("NewOCFReader error: %s\n", err)
+		logger.Error("Opening OCF failed", "error", err)
 		errors <- err
 		close(output)
 		return
 	}
 
 	go func(ocf *goavro.OCFReader) {
+		rows := 0
 		for ocf.Scan() {
 			native, err := ocf.Read()
 			if err != nil {
-				log.Printf("Read error: %s\n", err)
-				errors <- err
 				break
 			}
 
 			output <- native
+			rows++
+		}
+
+		// Err holds a failed Read, and also a truncated or corrupt block,
+		// at which Scan stops as it does at the end of the file
+		if err := ocf.Err(); err != nil {
+			logger.Error("Reading OCF failed", "rows", rows, "error", err)
+			errors <- err
 		}
 
-		log.Printf("Input finished\n")
+		logger.Debug("Finished reading OCF", "rows", rows)
 
 		close(output)
 	}(ocf)
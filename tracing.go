@@ -0,0 +1,109 @@
+package core
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/timfpark/iceberg-core"
+
+	maxBlockSourceLinks = 128 // spans a commit links to, from the rows in its block
+)
+
+// Span attributes.
+const (
+	attributePartitionKey  = "iceberg.partition_key"
+	attributePartitionKeys = "iceberg.partition_keys"
+	attributeBlock         = "iceberg.block"
+	attributeRows          = "iceberg.rows"
+	attributeBytes         = "iceberg.bytes"
+	attributeCommitReason  = "iceberg.commit_reason"
+	attributeBlocksScanned = "iceberg.blocks_scanned"
+	attributeBlocksPruned  = "iceberg.blocks_pruned"
+	attributeCacheTier     = "iceberg.cache_tier" // memory, disk or miss
+)
+
+// tracerFrom returns a Tracer from provider, or from the global provider,
+// which records nothing until otel.SetTracerProvider is called.
+func tracerFrom(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+
+	return provider.Tracer(instrumentationName)
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+func blockSpanAttributes(block *Block) trace.SpanStartEventOption {
+	return trace.WithAttributes(
+		attribute.String(attributePartitionKey, block.PartitionKey),
+		attribute.Int(attributeRows, len(block.Rows)),
+	)
+}
+
+// extractTraceContext returns ctx carrying the trace context propagated in
+// carrier, eg. a request's or message's headers.
+func extractTraceContext(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// linkSource remembers the span a row arrived in so that the block's commit
+// span can link to it. Rows of one request or message batch arrive together,
+// so only a change from the last span linked adds a link.
+func (b *Block) linkSource(ctx context.Context) {
+	if ctx == nil || len(b.sourceLinks) >= maxBlockSourceLinks {
+		return
+	}
+
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return
+	}
+
+	if last := len(b.sourceLinks) - 1; last >= 0 && b.sourceLinks[last].SpanContext.Equal(spanContext) {
+		return
+	}
+
+	b.sourceLinks = append(b.sourceLinks, trace.Link{SpanContext: spanContext})
+}
+
+// traceContext returns ctx with the block's commit span as its parent, for
+// the spans writing the block.
+func (b *Block) traceContext(ctx context.Context) context.Context {
+	if !b.commitSpanContext.IsValid() {
+		return ctx
+	}
+
+	return trace.ContextWithSpanContext(ctx, b.commitSpanContext)
+}
+
+// startLoadSpan starts the span of loading a partition's block.
+func startLoadSpan(ctx context.Context, tracer trace.Tracer, spanName string, partitionKey string, blockFilename string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, spanName, trace.WithAttributes(
+		attribute.String(attributePartitionKey, partitionKey),
+		attribute.String(attributeBlock, blockFilename),
+	))
+}
+
+// startQuerySpan starts the span of a query, which the query's row iterator
+// ends.
+func startQuerySpan(ctx context.Context, tracer trace.Tracer, spanName string, partitionKeys []string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, spanName, trace.WithAttributes(
+		attribute.StringSlice(attributePartitionKeys, partitionKeys),
+	))
+}
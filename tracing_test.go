@@ -0,0 +1,44 @@
+package core
+
+import (
+	"context"
+	"log"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestBlockLinkSource(t *testing.T) {
+	log.Println("Starting TestBlockLinkSource")
+
+	spanContext := func(spanID byte) context.Context {
+		return trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    trace.TraceID{1},
+			SpanID:     trace.SpanID{spanID},
+			TraceFlags: trace.FlagsSampled,
+		}))
+	}
+
+	block := &Block{}
+
+	// rows of one request share its span, so only the first of them links
+	block.linkSource(spanContext(1))
+	block.linkSource(spanContext(1))
+	block.linkSource(nil)
+	block.linkSource(context.Background())
+	block.linkSource(spanContext(2))
+
+	if len(block.sourceLinks) != 2 {
+		t.Errorf("Block linked %d sources instead of 2", len(block.sourceLinks))
+	}
+
+	for spanID := 0; spanID < maxBlockSourceLinks*2; spanID++ {
+		block.linkSource(spanContext(byte(spanID)))
+	}
+
+	if len(block.sourceLinks) != maxBlockSourceLinks {
+		t.Errorf("Block linked %d sources, more than %d", len(block.sourceLinks), maxBlockSourceLinks)
+	}
+
+	log.Println("Finished TestBlockLinkSource")
+}